@@ -0,0 +1,242 @@
+package main
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "sort"
+    "strings"
+    "syscall"
+)
+
+var errArtifactNotFound = errors.New("Artifact does not exist")
+
+// An `ArtifactStatus` describes a file a `ScriptRun` published by writing its
+// path to `_artifact`
+type ArtifactStatus struct {
+    Name  string
+    Size  int64
+    ModTs int64
+}
+
+// Return a string that represents this `ArtifactStatus`
+func (self *ArtifactStatus) String() string {
+    return fmt.Sprintf("%s size %d\n%s mod_ts %d\n", self.Name, self.Size, self.Name, self.ModTs)
+}
+
+// Return the dir in which the artifacts of the run with id `id` are stored.
+// Like `runLogDir`, this is under the state dir if there is one so that
+// artifacts survive restarts.
+func getArtifactDir(id string) string {
+    if config.StateDir != "" {
+        return filepath.Join(config.StateDir, "artifacts", id)
+    }
+    return filepath.Join(os.TempDir(), "gobashd-artifacts", id)
+}
+
+// Publish the file at `path`, written to `_artifact` by the script, as an
+// artifact of this run named after its base name. A relative `path` is
+// relative to where the script started. Names must be unique within a run. The
+// file is hardlinked into the artifact dir if possible, otherwise copied. The
+// file of a script with `@run_as` is always copied, and read by a helper
+// running as its user, so the script can only publish what its user can read.
+func (self *ScriptRun) addArtifact(path string) error {
+    if !filepath.IsAbs(path) && self.Workdir != "" {
+        path = filepath.Join(self.Workdir, path)
+    }
+    name := filepath.Base(path)
+    artifactDir := getArtifactDir(self.Id)
+    if _, err := os.Lstat(filepath.Join(artifactDir, name)); err == nil {
+        return errors.New(fmt.Sprintf("Artifact %s already published", name))
+    }
+    // Stage the artifact out of sight, then link it into place
+    tmpDir := filepath.Join(filepath.Dir(artifactDir), ".tmp")
+    for _, dir := range []string{artifactDir, tmpDir} {
+        if err := os.MkdirAll(dir, 0700); err != nil {
+            return err
+        }
+    }
+    tmpPath := filepath.Join(tmpDir, fmt.Sprintf("%s.%s", self.Id, name))
+    os.Remove(tmpPath)
+    defer os.Remove(tmpPath)
+    var err error
+    if self.Script.Credential != nil {
+        err = self.copyArtifactAsUser(path, tmpPath)
+    } else {
+        err = linkOrCopyFile(path, tmpPath)
+    }
+    if err != nil {
+        return err
+    }
+    // Unlike a rename, a link does not replace an artifact of the same name
+    if err = os.Link(tmpPath, filepath.Join(artifactDir, name)); os.IsExist(err) {
+        return errors.New(fmt.Sprintf("Artifact %s already published", name))
+    }
+    return err
+}
+
+// Open the file at `path` for reading, failing if it is not a regular file.
+// Opening does not block on FIFOs.
+func openRegularFile(path string) (*os.File, error) {
+    file, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+    if err != nil {
+        return nil, err
+    }
+    if fileInfo, err := file.Stat(); err != nil {
+        file.Close()
+        return nil, err
+    } else if !fileInfo.Mode().IsRegular() {
+        file.Close()
+        return nil, errors.New(fmt.Sprintf("%s is not a regular file", path))
+    }
+    return file, nil
+}
+
+// Hardlink the regular file at `srcPath` to `dstPath`, or copy it if it cannot
+// be linked, e.g., across filesystems or because `srcPath` is a symlink
+func linkOrCopyFile(srcPath string, dstPath string) error {
+    srcFile, err := openRegularFile(srcPath)
+    if err != nil {
+        return err
+    }
+    defer srcFile.Close()
+    if linkInfo, err := os.Lstat(srcPath); err == nil && linkInfo.Mode().IsRegular() && os.Link(srcPath, dstPath) == nil {
+        return nil
+    }
+    return copyToFile(srcFile, dstPath)
+}
+
+// Copy the file at `srcPath` to `dstPath` as the user of the script's
+// `@run_as`, with `gobashd -cat-artifact` running as that user reading it
+func (self *ScriptRun) copyArtifactAsUser(srcPath string, dstPath string) error {
+    exePath, err := os.Executable()
+    if err != nil {
+        return err
+    }
+    var stderrBuf bytes.Buffer
+    catCmd := exec.Command(exePath, "-cat-artifact", srcPath)
+    catCmd.Stderr = &stderrBuf
+    catCmd.SysProcAttr = &syscall.SysProcAttr{Credential: self.Script.Credential}
+    stdout, err := catCmd.StdoutPipe()
+    if err != nil {
+        return err
+    } else if err = catCmd.Start(); err != nil {
+        return err
+    }
+    if err = copyToFile(stdout, dstPath); err != nil {
+        catCmd.Process.Kill()
+    }
+    if waitErr := catCmd.Wait(); waitErr != nil && stderrBuf.Len() > 0 {
+        return errors.New(strings.TrimSpace(stderrBuf.String()))
+    } else if waitErr != nil {
+        return waitErr
+    }
+    return err
+}
+
+// Write the regular file at `path` to stdout. This is the entry point of
+// `-cat-artifact`. Return the exit code.
+func catArtifact(path string) int {
+    file, err := openRegularFile(path)
+    if err == nil {
+        _, err = io.Copy(os.Stdout, file)
+        file.Close()
+    }
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "%v\n", err)
+        return 1
+    }
+    return 0
+}
+
+// Copy the rest of `src` to a new file at `dstPath`
+func copyToFile(src io.Reader, dstPath string) error {
+    dstFile, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+    if err != nil {
+        return err
+    }
+    if _, err = io.Copy(dstFile, src); err != nil {
+        dstFile.Close()
+        return err
+    }
+    return dstFile.Close()
+}
+
+// Return the `ArtifactStatus` of every artifact of the run with id `id`,
+// ordered by name
+func getArtifactStatii(id string) ([]*ArtifactStatus, error) {
+    fileInfos, err := ioutil.ReadDir(getArtifactDir(id))
+    if os.IsNotExist(err) {
+        return []*ArtifactStatus{}, nil
+    } else if err != nil {
+        return nil, err
+    }
+    statii := make([]*ArtifactStatus, 0, len(fileInfos))
+    for _, fileInfo := range fileInfos {
+        if !fileInfo.Mode().IsRegular() {
+            continue
+        }
+        statii = append(statii, &ArtifactStatus{
+            Name:  fileInfo.Name(),
+            Size:  fileInfo.Size(),
+            ModTs: fileInfo.ModTime().Unix(),
+        })
+    }
+    sort.Slice(statii, func(i, j int) bool {
+        return statii[i].Name < statii[j].Name
+    })
+    return statii, nil
+}
+
+// Open artifact `name` of the run with id `id`
+func openArtifact(id string, name string) (*os.File, error) {
+    if name == "" || strings.Contains(name, "/") {
+        return nil, errArtifactNotFound
+    }
+    file, err := os.Open(filepath.Join(getArtifactDir(id), name))
+    if os.IsNotExist(err) {
+        return nil, errArtifactNotFound
+    } else if err != nil {
+        return nil, err
+    }
+    if fileInfo, statErr := file.Stat(); statErr != nil || !fileInfo.Mode().IsRegular() {
+        // E.g., `.` or `..`
+        file.Close()
+        return nil, errArtifactNotFound
+    }
+    return file, nil
+}
+
+// Remove the artifacts of this run, e.g., when it is purged
+func (self *ScriptRun) removeArtifacts() {
+    if err := os.RemoveAll(getArtifactDir(self.Id)); err != nil {
+        self.logErr("os.RemoveAll failed err=%v\n", err)
+    }
+}
+
+// Return the `ArtifactStatus` of every artifact of the `ScriptRun` with id
+// `id`. Listing artifacts requires the `view` permission.
+func (self *Server) getRunArtifacts(id string, principal *Principal) ([]*ArtifactStatus, error) {
+    self.ScriptRunsLock.Lock()
+    defer self.ScriptRunsLock.Unlock()
+    if _, err := self.getAllowedRunById(id, principal, "view"); err != nil {
+        return nil, err
+    }
+    return getArtifactStatii(id)
+}
+
+// Open artifact `name` of the `ScriptRun` with id `id` for download.
+// Downloading artifacts requires the `view` permission.
+func (self *Server) openRunArtifact(id string, name string, principal *Principal) (*os.File, error) {
+    self.ScriptRunsLock.Lock()
+    defer self.ScriptRunsLock.Unlock()
+    if _, err := self.getAllowedRunById(id, principal, "view"); err != nil {
+        return nil, err
+    }
+    return openArtifact(id, name)
+}
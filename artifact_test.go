@@ -0,0 +1,135 @@
+package main
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "syscall"
+    "testing"
+)
+
+func TestAddArtifact(t *testing.T) {
+    defer func(stateDir string) { config.StateDir = stateDir }(config.StateDir)
+    config.StateDir = t.TempDir()
+    workdir := t.TempDir()
+    otherDir := t.TempDir()
+    ioutil.WriteFile(filepath.Join(workdir, "report.txt"), []byte("report"), 0600)
+    ioutil.WriteFile(filepath.Join(otherDir, "report.txt"), []byte("other"), 0600)
+    ioutil.WriteFile(filepath.Join(otherDir, "data.csv"), []byte("a,b\n"), 0600)
+    os.Symlink(filepath.Join(otherDir, "data.csv"), filepath.Join(workdir, "link.csv"))
+    os.Mkdir(filepath.Join(workdir, "subdir"), 0700)
+    syscall.Mkfifo(filepath.Join(workdir, "fifo"), 0600)
+    tests := []struct {
+        name      string
+        path      string
+        expectErr string
+    }{
+        {"relative", "report.txt", ""},
+        {"same name", filepath.Join(otherDir, "report.txt"), "already published"},
+        {"absolute", filepath.Join(otherDir, "data.csv"), ""},
+        {"symlink", "link.csv", ""},
+        {"missing", "missing.txt", "no such file"},
+        {"dir", "subdir", "not a regular file"},
+        {"fifo", "fifo", "not a regular file"},
+    }
+    scriptRun := &ScriptRun{Script: &Script{Name: "a.sh"}, Id: "abc", Workdir: workdir}
+    for _, test := range tests {
+        err := scriptRun.addArtifact(test.path)
+        if test.expectErr == "" && err != nil {
+            t.Errorf("%s: addArtifact err=%v", test.name, err)
+        } else if test.expectErr != "" && (err == nil || !strings.Contains(err.Error(), test.expectErr)) {
+            t.Errorf("%s: addArtifact err=%v, expected %q", test.name, err, test.expectErr)
+        }
+    }
+
+    statii, err := getArtifactStatii("abc")
+    if err != nil {
+        t.Fatalf("getArtifactStatii err=%v", err)
+    }
+    names := make([]string, 0, len(statii))
+    for _, status := range statii {
+        names = append(names, status.Name)
+    }
+    if strings.Join(names, " ") != "data.csv link.csv report.txt" {
+        t.Errorf("getArtifactStatii returned %v, expected [data.csv link.csv report.txt]", names)
+    }
+    if content, _ := ioutil.ReadFile(filepath.Join(getArtifactDir("abc"), "report.txt")); string(content) != "report" {
+        t.Errorf("Artifact report.txt has %q, expected the first one published", content)
+    }
+    if tmpInfos, _ := ioutil.ReadDir(filepath.Join(config.StateDir, "artifacts", ".tmp")); len(tmpInfos) != 0 {
+        t.Errorf("%d staged files left behind", len(tmpInfos))
+    }
+
+    scriptRun.removeArtifacts()
+    if statii, err = getArtifactStatii("abc"); err != nil || len(statii) != 0 {
+        t.Errorf("getArtifactStatii returned %d artifacts err=%v after removeArtifacts", len(statii), err)
+    }
+}
+
+func TestOpenArtifact(t *testing.T) {
+    defer func(stateDir string) { config.StateDir = stateDir }(config.StateDir)
+    config.StateDir = t.TempDir()
+    artifactDir := getArtifactDir("abc")
+    os.MkdirAll(filepath.Join(artifactDir, "subdir"), 0700)
+    ioutil.WriteFile(filepath.Join(artifactDir, "report.txt"), []byte("report"), 0600)
+    ioutil.WriteFile(filepath.Join(config.StateDir, "artifacts", "secret"), []byte("secret"), 0600)
+    tests := []struct {
+        name      string
+        id        string
+        artifact  string
+        expectErr error
+    }{
+        {"artifact", "abc", "report.txt", nil},
+        {"missing", "abc", "missing.txt", errArtifactNotFound},
+        {"empty", "abc", "", errArtifactNotFound},
+        {"dot", "abc", ".", errArtifactNotFound},
+        {"dot dot", "abc", "..", errArtifactNotFound},
+        {"traversal", "abc", "../secret", errArtifactNotFound},
+        {"nested", "abc", "subdir/x", errArtifactNotFound},
+        {"dir", "abc", "subdir", errArtifactNotFound},
+        {"other run", "def", "report.txt", errArtifactNotFound},
+    }
+    for _, test := range tests {
+        file, err := openArtifact(test.id, test.artifact)
+        if err != test.expectErr {
+            t.Errorf("%s: openArtifact err=%v, expected %v", test.name, err, test.expectErr)
+        }
+        if file != nil {
+            file.Close()
+        }
+    }
+}
+
+func TestCatArtifact(t *testing.T) {
+    dir := t.TempDir()
+    ioutil.WriteFile(filepath.Join(dir, "report.txt"), []byte("report\n"), 0600)
+    syscall.Mkfifo(filepath.Join(dir, "fifo"), 0600)
+    tests := []struct {
+        name       string
+        path       string
+        expectCode int
+        expectOut  string
+    }{
+        {"file", filepath.Join(dir, "report.txt"), 0, "report\n"},
+        {"missing", filepath.Join(dir, "missing"), 1, ""},
+        {"dir", dir, 1, ""},
+        {"fifo", filepath.Join(dir, "fifo"), 1, ""},
+    }
+    for _, test := range tests {
+        stdout, stderr := os.Stdout, os.Stderr
+        outFile, _ := ioutil.TempFile(dir, "stdout-")
+        os.Stdout, os.Stderr = outFile, outFile
+        code := catArtifact(test.path)
+        os.Stdout, os.Stderr = stdout, stderr
+        outFile.Close()
+        out, _ := ioutil.ReadFile(outFile.Name())
+        if code != test.expectCode {
+            t.Errorf("%s: catArtifact returned %d, expected %d", test.name, code, test.expectCode)
+        } else if test.expectCode == 0 && string(out) != test.expectOut {
+            t.Errorf("%s: catArtifact wrote %q, expected %q", test.name, out, test.expectOut)
+        } else if test.expectCode != 0 && len(out) == 0 {
+            t.Errorf("%s: catArtifact wrote no error", test.name)
+        }
+    }
+}
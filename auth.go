@@ -0,0 +1,227 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "crypto/sha256"
+    "crypto/subtle"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "os/user"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+var (
+    errAuthFailed   = errors.New("Authentication failed")
+    errAuthRequired = errors.New("Authentication required")
+
+    errPermissionDenied = errors.New("Permission denied")
+)
+
+// A `Principal` is an authenticated client identity
+type Principal struct {
+    Name   string
+    Groups []string
+}
+
+// An `Authenticator` verifies client credentials. A `ServerInterface` with an
+// `Authenticator` refuses to pass a `Request` to its handler until the client
+// has authenticated. `Reload` is called on SIGHUP.
+type Authenticator interface {
+    CheckPassword(user string, password string) (*Principal, error)
+    CheckToken(token string) (*Principal, error)
+    CheckClientCert(clientCert *x509.Certificate) (*Principal, error)
+    CheckPeerCred(peerCred *PeerCred) (*Principal, error)
+    Reload() error
+}
+
+// A `SaslMechanism` verifies a decoded SASL client response
+type SaslMechanism func(authenticator Authenticator, response []byte) (*Principal, error)
+
+// SASL mechanisms supported by the textproto `AUTH` command, keyed by name
+var saslMechanisms = map[string]SaslMechanism{
+    "PLAIN": saslPlain,
+}
+
+// A `FileAuthenticator` checks credentials against a local file with one
+// credential per line:
+//
+//     # kind name secret [group,...]
+//     user alice s3cret ops,backup
+//     user bob sha256:5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8
+//     token cron 6f1c2d3e4a5b backup
+//     cert backup01.example.com - backup
+//     peer mysql - backup
+//
+// `user` entries are checked by HTTP basic auth and SASL PLAIN. `token`
+// entries are checked by HTTP bearer auth. `cert` entries match the common
+// name of a verified TLS client certificate. `peer` entries match the local
+// user name or uid of a unix socket peer. The secret of `cert` and `peer`
+// entries is ignored and should be `-`. A secret prefixed with `sha256:` is compared against the hex
+// SHA-256 of the presented secret.
+type FileAuthenticator struct {
+    Path    string
+    entries []*authEntry
+    lock    sync.Mutex
+}
+
+type authEntry struct {
+    Kind   string
+    Secret string
+    *Principal
+}
+
+// Make a `FileAuthenticator` and load credentials from `path`
+func newFileAuthenticator(path string) (*FileAuthenticator, error) {
+    authenticator := &FileAuthenticator{Path: path}
+    if err := authenticator.Reload(); err != nil {
+        return nil, err
+    }
+    return authenticator, nil
+}
+
+// Re-read the credentials file. On error, the previously loaded credentials
+// remain in effect.
+func (self *FileAuthenticator) Reload() error {
+    fileBytes, err := ioutil.ReadFile(self.Path)
+    if err != nil {
+        return err
+    }
+    entries := make([]*authEntry, 0)
+    scanner := bufio.NewScanner(bytes.NewReader(fileBytes))
+    for lineNum := 1; scanner.Scan(); lineNum++ {
+        fields := strings.Fields(scanner.Text())
+        if len(fields) < 1 || strings.HasPrefix(fields[0], "#") {
+            continue
+        } else if len(fields) < 3 || len(fields) > 4 {
+            return errors.New(fmt.Sprintf("%s:%d: expected kind, name, secret, and optional groups", self.Path, lineNum))
+        }
+        entry := &authEntry{
+            Kind:      fields[0],
+            Secret:    fields[2],
+            Principal: &Principal{Name: fields[1], Groups: make([]string, 0)},
+        }
+        if entry.Kind != "user" && entry.Kind != "token" && entry.Kind != "cert" && entry.Kind != "peer" {
+            return errors.New(fmt.Sprintf("%s:%d: unrecognized kind %s", self.Path, lineNum, entry.Kind))
+        }
+        if len(fields) == 4 {
+            entry.Groups = strings.Split(fields[3], ",")
+        }
+        entries = append(entries, entry)
+    }
+    if err = scanner.Err(); err != nil {
+        return err
+    }
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.entries = entries
+    return nil
+}
+
+// Return the `Principal` for `user` if `password` is correct
+func (self *FileAuthenticator) CheckPassword(user string, password string) (*Principal, error) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    for _, entry := range self.entries {
+        if entry.Kind == "user" && entry.Name == user && checkSecret(entry.Secret, password) {
+            return entry.Principal, nil
+        }
+    }
+    return nil, errAuthFailed
+}
+
+// Return the `Principal` that owns `token`
+func (self *FileAuthenticator) CheckToken(token string) (*Principal, error) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    for _, entry := range self.entries {
+        if entry.Kind == "token" && checkSecret(entry.Secret, token) {
+            return entry.Principal, nil
+        }
+    }
+    return nil, errAuthFailed
+}
+
+// Return the `Principal` whose name is the common name of `clientCert`. The
+// certificate must already be verified.
+func (self *FileAuthenticator) CheckClientCert(clientCert *x509.Certificate) (*Principal, error) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    for _, entry := range self.entries {
+        if entry.Kind == "cert" && entry.Name == clientCert.Subject.CommonName {
+            return entry.Principal, nil
+        }
+    }
+    return nil, errAuthFailed
+}
+
+// Return the `Principal` whose name is the user name or uid of a unix socket
+// peer
+func (self *FileAuthenticator) CheckPeerCred(peerCred *PeerCred) (*Principal, error) {
+    uidStr := strconv.FormatUint(uint64(peerCred.Uid), 10)
+    userName := ""
+    if peerUser, err := user.LookupId(uidStr); err == nil {
+        userName = peerUser.Username
+    }
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    for _, entry := range self.entries {
+        if entry.Kind == "peer" && (entry.Name == uidStr || entry.Name == userName) {
+            return entry.Principal, nil
+        }
+    }
+    return nil, errAuthFailed
+}
+
+// Compare a presented secret to a stored one in constant time
+func checkSecret(stored string, presented string) bool {
+    if strings.HasPrefix(stored, "sha256:") {
+        sum := sha256.Sum256([]byte(presented))
+        presented = hex.EncodeToString(sum[:])
+        stored = strings.ToLower(strings.TrimPrefix(stored, "sha256:"))
+    }
+    return subtle.ConstantTimeCompare([]byte(stored), []byte(presented)) == 1
+}
+
+// Verify a base64-encoded SASL client `response` for `mechanism`
+func saslAuthenticate(authenticator Authenticator, mechanism string, response string) (*Principal, error) {
+    saslMechanism, exists := saslMechanisms[strings.ToUpper(mechanism)]
+    if !exists {
+        return nil, errors.New(fmt.Sprintf("Unsupported SASL mechanism %s", mechanism))
+    }
+    decoded, err := base64.StdEncoding.DecodeString(response)
+    if err != nil {
+        return nil, errAuthFailed
+    }
+    return saslMechanism(authenticator, decoded)
+}
+
+// SASL PLAIN (RFC 4616). The response is `[authzid] NUL authcid NUL passwd`.
+// Acting on behalf of another identity is not supported, so authzid must be
+// empty or equal to authcid.
+func saslPlain(authenticator Authenticator, response []byte) (*Principal, error) {
+    parts := bytes.Split(response, []byte{0})
+    if len(parts) != 3 {
+        return nil, errAuthFailed
+    }
+    authzid, authcid, passwd := string(parts[0]), string(parts[1]), string(parts[2])
+    if authzid != "" && authzid != authcid {
+        return nil, errAuthFailed
+    }
+    return authenticator.CheckPassword(authcid, passwd)
+}
+
+// Make a 401 `Response` for `err`
+func newAuthErrorResponse(err error) *Response {
+    return &Response{
+        StatusCode: 401,
+        Error:      err,
+        ErrorStr:   err.Error(),
+    }
+}
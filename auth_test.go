@@ -0,0 +1,157 @@
+package main
+
+import (
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/base64"
+    "io/ioutil"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+const testAuthFile = `# kind name secret [group,...]
+user alice s3cret ops,backup
+user bob sha256:5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8
+token cron 6f1c2d3e4a5b backup
+cert backup01.example.com - backup
+peer 0 - ops
+`
+
+// Write `content` to a credentials file in a temp dir and return its path
+func writeTestAuthFile(t *testing.T, content string) string {
+    path := filepath.Join(t.TempDir(), "auth")
+    if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+        t.Fatalf("ioutil.WriteFile err=%v", err)
+    }
+    return path
+}
+
+func TestNewFileAuthenticator(t *testing.T) {
+    tests := []struct {
+        name      string
+        content   string
+        expectErr string
+    }{
+        {"valid", testAuthFile, ""},
+        {"empty", "", ""},
+        {"comments and blank lines", "# nothing\n\n   \n", ""},
+        {"too few fields", "user alice\n", ":1: expected kind"},
+        {"too many fields", "\nuser alice s3cret ops extra\n", ":2: expected kind"},
+        {"unknown kind", "group ops - alice\n", ":1: unrecognized kind group"},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            _, err := newFileAuthenticator(writeTestAuthFile(t, test.content))
+            if test.expectErr == "" && err != nil {
+                t.Errorf("newFileAuthenticator err=%v", err)
+            } else if test.expectErr != "" && (err == nil || !strings.Contains(err.Error(), test.expectErr)) {
+                t.Errorf("newFileAuthenticator err=%v, expected %q", err, test.expectErr)
+            }
+        })
+    }
+    if _, err := newFileAuthenticator(filepath.Join(t.TempDir(), "missing")); err == nil {
+        t.Errorf("newFileAuthenticator of a missing file succeeded")
+    }
+}
+
+func TestFileAuthenticatorCheck(t *testing.T) {
+    authenticator, err := newFileAuthenticator(writeTestAuthFile(t, testAuthFile))
+    if err != nil {
+        t.Fatalf("newFileAuthenticator err=%v", err)
+    }
+    certFor := func(commonName string) *x509.Certificate {
+        return &x509.Certificate{Subject: pkix.Name{CommonName: commonName}}
+    }
+    tests := []struct {
+        name         string
+        check        func() (*Principal, error)
+        expectName   string
+        expectGroups string
+    }{
+        {"password", func() (*Principal, error) { return authenticator.CheckPassword("alice", "s3cret") }, "alice", "ops,backup"},
+        {"wrong password", func() (*Principal, error) { return authenticator.CheckPassword("alice", "s3cre") }, "", ""},
+        {"unknown user", func() (*Principal, error) { return authenticator.CheckPassword("carol", "s3cret") }, "", ""},
+        {"hashed password", func() (*Principal, error) { return authenticator.CheckPassword("bob", "password") }, "bob", ""},
+        {"hash as password", func() (*Principal, error) {
+            return authenticator.CheckPassword("bob", "5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8")
+        }, "", ""},
+        {"token as password", func() (*Principal, error) { return authenticator.CheckPassword("cron", "6f1c2d3e4a5b") }, "", ""},
+        {"token", func() (*Principal, error) { return authenticator.CheckToken("6f1c2d3e4a5b") }, "cron", "backup"},
+        {"wrong token", func() (*Principal, error) { return authenticator.CheckToken("6f1c2d3e4a5") }, "", ""},
+        {"password as token", func() (*Principal, error) { return authenticator.CheckToken("s3cret") }, "", ""},
+        {"cert", func() (*Principal, error) { return authenticator.CheckClientCert(certFor("backup01.example.com")) }, "backup01.example.com", "backup"},
+        {"unknown cert", func() (*Principal, error) { return authenticator.CheckClientCert(certFor("alice")) }, "", ""},
+        {"peer uid", func() (*Principal, error) { return authenticator.CheckPeerCred(&PeerCred{Uid: 0}) }, "0", "ops"},
+        {"unknown peer", func() (*Principal, error) { return authenticator.CheckPeerCred(&PeerCred{Uid: 12345}) }, "", ""},
+    }
+    for _, test := range tests {
+        principal, err := test.check()
+        if test.expectName == "" {
+            if err != errAuthFailed {
+                t.Errorf("%s: returned %v, err=%v, expected errAuthFailed", test.name, principal, err)
+            }
+        } else if err != nil {
+            t.Errorf("%s: err=%v", test.name, err)
+        } else if principal.Name != test.expectName || strings.Join(principal.Groups, ",") != test.expectGroups {
+            t.Errorf("%s: returned %+v, expected %s in %q", test.name, principal, test.expectName, test.expectGroups)
+        }
+    }
+}
+
+func TestFileAuthenticatorReload(t *testing.T) {
+    path := writeTestAuthFile(t, "user alice s3cret\n")
+    authenticator, err := newFileAuthenticator(path)
+    if err != nil {
+        t.Fatalf("newFileAuthenticator err=%v", err)
+    }
+    ioutil.WriteFile(path, []byte("user alice n3w\n"), 0600)
+    if err = authenticator.Reload(); err != nil {
+        t.Errorf("Reload err=%v", err)
+    } else if _, err = authenticator.CheckPassword("alice", "n3w"); err != nil {
+        t.Errorf("New password not accepted after Reload; err=%v", err)
+    } else if _, err = authenticator.CheckPassword("alice", "s3cret"); err == nil {
+        t.Errorf("Old password still accepted after Reload")
+    }
+    ioutil.WriteFile(path, []byte("bogus line\n"), 0600)
+    if err = authenticator.Reload(); err == nil {
+        t.Errorf("Reload of a bad file succeeded")
+    } else if _, err = authenticator.CheckPassword("alice", "n3w"); err != nil {
+        t.Errorf("Password not accepted after failed Reload; err=%v", err)
+    }
+}
+
+func TestSaslAuthenticate(t *testing.T) {
+    authenticator, err := newFileAuthenticator(writeTestAuthFile(t, testAuthFile))
+    if err != nil {
+        t.Fatalf("newFileAuthenticator err=%v", err)
+    }
+    encode := func(response string) string {
+        return base64.StdEncoding.EncodeToString([]byte(response))
+    }
+    tests := []struct {
+        name       string
+        mechanism  string
+        response   string
+        expectName string
+        expectErr  bool
+    }{
+        {"plain", "PLAIN", encode("\x00alice\x00s3cret"), "alice", false},
+        {"lowercase mechanism", "plain", encode("\x00alice\x00s3cret"), "alice", false},
+        {"authzid same as authcid", "PLAIN", encode("alice\x00alice\x00s3cret"), "alice", false},
+        {"authzid of another user", "PLAIN", encode("bob\x00alice\x00s3cret"), "", true},
+        {"wrong password", "PLAIN", encode("\x00alice\x00wrong"), "", true},
+        {"too few parts", "PLAIN", encode("alice\x00s3cret"), "", true},
+        {"too many parts", "PLAIN", encode("\x00alice\x00s3cret\x00"), "", true},
+        {"bad base64", "PLAIN", "!!!", "", true},
+        {"unsupported mechanism", "CRAM-MD5", encode("alice s3cret"), "", true},
+    }
+    for _, test := range tests {
+        principal, err := saslAuthenticate(authenticator, test.mechanism, test.response)
+        if (err != nil) != test.expectErr {
+            t.Errorf("%s: err=%v, expected err %t", test.name, err, test.expectErr)
+        } else if err == nil && principal.Name != test.expectName {
+            t.Errorf("%s: authenticated %s, expected %s", test.name, principal.Name, test.expectName)
+        }
+    }
+}
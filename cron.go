@@ -0,0 +1,170 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const (
+    CRON_MAX_SEARCH_YEARS = 5
+)
+
+// A `CronSpec` is a parsed 5-field cron expression (minute, hour, day of
+// month, month, day of week). Each field is a bitset of matching values.
+type CronSpec struct {
+    Expr    string
+    Minutes uint64
+    Hours   uint64
+    Doms    uint64
+    Months  uint64
+    Dows    uint64
+    DomStar bool
+    DowStar bool
+}
+
+var cronMacros = map[string]string{
+    "@yearly":   "0 0 1 1 *",
+    "@annually": "0 0 1 1 *",
+    "@monthly":  "0 0 1 * *",
+    "@weekly":   "0 0 * * 0",
+    "@daily":    "0 0 * * *",
+    "@midnight": "0 0 * * *",
+    "@hourly":   "0 * * * *",
+}
+
+var cronMonthNames = []string{"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+var cronDowNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// Parse cron expression `expr`. Each field may be `*`, a value, a range
+// `a-b`, any of those followed by a step `/n`, or a comma-separated list of
+// them. Months and days of week may be given by their three-letter English
+// names. Day of week 7 is Sunday, like 0. The macros `@yearly`, `@monthly`,
+// `@weekly`, `@daily`, and `@hourly` are also accepted.
+func parseCronSpec(expr string) (*CronSpec, error) {
+    var err error
+    spec := &CronSpec{Expr: expr}
+    if macroExpr, isMacro := cronMacros[strings.ToLower(expr)]; isMacro {
+        expr = macroExpr
+    }
+    fields := strings.Fields(expr)
+    if len(fields) != 5 {
+        return nil, errors.New(fmt.Sprintf("Cron expression %q does not have 5 fields", spec.Expr))
+    }
+    if spec.Minutes, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+        return nil, err
+    } else if spec.Hours, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+        return nil, err
+    } else if spec.Doms, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+        return nil, err
+    } else if spec.Months, err = parseCronField(fields[3], 1, 12, cronMonthNames); err != nil {
+        return nil, err
+    } else if spec.Dows, err = parseCronField(fields[4], 0, 7, cronDowNames); err != nil {
+        return nil, err
+    }
+    if spec.Dows&(1<<7) != 0 {
+        spec.Dows |= 1
+    }
+    spec.DomStar = strings.HasPrefix(fields[2], "*")
+    spec.DowStar = strings.HasPrefix(fields[4], "*")
+    return spec, nil
+}
+
+// Parse one field of a cron expression into a bitset of values between
+// `min` and `max`. `names`, if not nil, maps names to their index.
+func parseCronField(field string, min int, max int, names []string) (uint64, error) {
+    var bits uint64
+    for _, part := range strings.Split(field, ",") {
+        step := 1
+        rangeStr := part
+        if slashIdx := strings.Index(part, "/"); slashIdx >= 0 {
+            var err error
+            rangeStr = part[:slashIdx]
+            if step, err = strconv.Atoi(part[slashIdx+1:]); err != nil || step < 1 {
+                return 0, errors.New(fmt.Sprintf("Invalid step in cron field %q", field))
+            }
+        }
+        var lo, hi int
+        var err error
+        if rangeStr == "*" {
+            lo, hi = min, max
+        } else if dashIdx := strings.Index(rangeStr, "-"); dashIdx >= 0 {
+            if lo, err = parseCronVal(rangeStr[:dashIdx], names); err != nil {
+                return 0, err
+            } else if hi, err = parseCronVal(rangeStr[dashIdx+1:], names); err != nil {
+                return 0, err
+            }
+        } else if lo, err = parseCronVal(rangeStr, names); err != nil {
+            return 0, err
+        } else if step > 1 {
+            hi = max
+        } else {
+            hi = lo
+        }
+        if lo < min || hi > max || lo > hi {
+            return 0, errors.New(fmt.Sprintf("Cron field %q out of range %d-%d", field, min, max))
+        }
+        for val := lo; val <= hi; val += step {
+            bits |= 1 << uint(val)
+        }
+    }
+    return bits, nil
+}
+
+// Parse a single cron value, either a number or one of `names`
+func parseCronVal(valStr string, names []string) (int, error) {
+    for idx, name := range names {
+        if name != "" && strings.EqualFold(valStr, name) {
+            return idx, nil
+        }
+    }
+    val, err := strconv.Atoi(valStr)
+    if err != nil {
+        return 0, errors.New(fmt.Sprintf("Invalid cron value %q", valStr))
+    }
+    return val, nil
+}
+
+// Return whether the minute of `ts` matches this `CronSpec`. As in cron, if
+// both day of month and day of week are restricted, either may match.
+func (self *CronSpec) Match(ts time.Time) bool {
+    return self.Minutes&(1<<uint(ts.Minute())) != 0 &&
+        self.Hours&(1<<uint(ts.Hour())) != 0 &&
+        self.Months&(1<<uint(ts.Month())) != 0 &&
+        self.matchDay(ts)
+}
+
+// Return whether the day of `ts` matches this `CronSpec`
+func (self *CronSpec) matchDay(ts time.Time) bool {
+    domMatch := self.Doms&(1<<uint(ts.Day())) != 0
+    dowMatch := self.Dows&(1<<uint(ts.Weekday())) != 0
+    if self.DomStar || self.DowStar {
+        return domMatch && dowMatch
+    }
+    return domMatch || dowMatch
+}
+
+// Return the first minute after `ts` that matches this `CronSpec`, or the
+// zero `time.Time` if there is none within `CRON_MAX_SEARCH_YEARS` (e.g.,
+// February 30th)
+func (self *CronSpec) Next(ts time.Time) time.Time {
+    loc := ts.Location()
+    ts = time.Date(ts.Year(), ts.Month(), ts.Day(), ts.Hour(), ts.Minute(), 0, 0, loc).Add(time.Minute)
+    limit := ts.AddDate(CRON_MAX_SEARCH_YEARS, 0, 0)
+    for ts.Before(limit) {
+        if self.Months&(1<<uint(ts.Month())) == 0 {
+            ts = time.Date(ts.Year(), ts.Month()+1, 1, 0, 0, 0, 0, loc)
+        } else if !self.matchDay(ts) {
+            ts = time.Date(ts.Year(), ts.Month(), ts.Day()+1, 0, 0, 0, 0, loc)
+        } else if self.Hours&(1<<uint(ts.Hour())) == 0 {
+            ts = time.Date(ts.Year(), ts.Month(), ts.Day(), ts.Hour()+1, 0, 0, 0, loc)
+        } else if self.Minutes&(1<<uint(ts.Minute())) == 0 {
+            ts = ts.Add(time.Minute)
+        } else {
+            return ts
+        }
+    }
+    return time.Time{}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func TestParseCronSpec(t *testing.T) {
+    tests := []struct {
+        expr      string
+        expectErr bool
+        minutes   uint64
+        hours     uint64
+        dows      uint64
+        domStar   bool
+        dowStar   bool
+    }{
+        {"* * * * *", false, 1<<60 - 1, 1<<24 - 1, 1<<8 - 1, true, true},
+        {"*/15 0 * * *", false, 1 | 1<<15 | 1<<30 | 1<<45, 1, 1<<8 - 1, true, true},
+        {"5,10-12 * * * *", false, 1<<5 | 1<<10 | 1<<11 | 1<<12, 1<<24 - 1, 1<<8 - 1, true, true},
+        {"0 9-17/4 * * mon-fri", false, 1, 1<<9 | 1<<13 | 1<<17, 0x3e, true, false},
+        {"0 0 * * 7", false, 1, 1, 1 | 1<<7, true, false},
+        {"30 2 1 * *", false, 1 << 30, 1 << 2, 1<<8 - 1, false, true},
+        {"@daily", false, 1, 1, 1<<8 - 1, true, true},
+        {"@HOURLY", false, 1, 1<<24 - 1, 1<<8 - 1, true, true},
+        {"* * * *", true, 0, 0, 0, false, false},
+        {"60 * * * *", true, 0, 0, 0, false, false},
+        {"* 5-3 * * *", true, 0, 0, 0, false, false},
+        {"*/0 * * * *", true, 0, 0, 0, false, false},
+        {"* * 0 * *", true, 0, 0, 0, false, false},
+        {"* * * foo *", true, 0, 0, 0, false, false},
+        {"@reboot", true, 0, 0, 0, false, false},
+    }
+    for _, test := range tests {
+        spec, err := parseCronSpec(test.expr)
+        if test.expectErr {
+            if err == nil {
+                t.Errorf("parseCronSpec(%q) succeeded, expected err", test.expr)
+            }
+            continue
+        } else if err != nil {
+            t.Errorf("parseCronSpec(%q) err=%v", test.expr, err)
+            continue
+        }
+        if spec.Minutes != test.minutes || spec.Hours != test.hours || spec.Dows != test.dows {
+            t.Errorf("parseCronSpec(%q) minutes=%x hours=%x dows=%x, expected %x %x %x", test.expr, spec.Minutes, spec.Hours, spec.Dows, test.minutes, test.hours, test.dows)
+        }
+        if spec.DomStar != test.domStar || spec.DowStar != test.dowStar {
+            t.Errorf("parseCronSpec(%q) domStar=%t dowStar=%t, expected %t %t", test.expr, spec.DomStar, spec.DowStar, test.domStar, test.dowStar)
+        }
+        if spec.Expr != test.expr {
+            t.Errorf("parseCronSpec(%q) kept expr %q", test.expr, spec.Expr)
+        }
+    }
+}
+
+func TestCronSpecNext(t *testing.T) {
+    from := time.Date(2024, time.January, 31, 10, 30, 45, 0, time.UTC) // A Wednesday
+    tests := []struct {
+        expr   string
+        expect time.Time
+    }{
+        {"* * * * *", time.Date(2024, time.January, 31, 10, 31, 0, 0, time.UTC)},
+        {"30 10 * * *", time.Date(2024, time.February, 1, 10, 30, 0, 0, time.UTC)},
+        {"0 0 1 * *", time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)},
+        {"0 0 29 feb *", time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)},
+        {"0 12 * * sun", time.Date(2024, time.February, 4, 12, 0, 0, 0, time.UTC)},
+        {"0 12 15 * fri", time.Date(2024, time.February, 2, 12, 0, 0, 0, time.UTC)},
+        {"@yearly", time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)},
+        {"0 0 30 feb *", time.Time{}},
+    }
+    for _, test := range tests {
+        spec, err := parseCronSpec(test.expr)
+        if err != nil {
+            t.Errorf("parseCronSpec(%q) err=%v", test.expr, err)
+            continue
+        }
+        if next := spec.Next(from); !next.Equal(test.expect) {
+            t.Errorf("Next of %q is %v, expected %v", test.expr, next, test.expect)
+        } else if !next.IsZero() && !spec.Match(next) {
+            t.Errorf("Next of %q is %v, which it does not match", test.expr, next)
+        }
+    }
+}
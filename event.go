@@ -0,0 +1,118 @@
+package main
+
+import (
+    "fmt"
+)
+
+const (
+    RUN_EVENT_BUFFER = 256
+)
+
+// A `RunEvent` is a single thing that happened during a `ScriptRun`: a line
+// of stdout or stderr, an output var being set or cleared, an artifact being
+// published, or the run finishing. `Type` is one of stdout, stderr, output,
+// clear, artifact, or finished, or dropped, which tells a subscriber that fell
+// behind how many events it missed.
+type RunEvent struct {
+    Type string
+    Name string `json:",omitempty"`
+    Text string
+}
+
+// Return a string that represents this `RunEvent`
+func (self *RunEvent) String() string {
+    if self.Type == "output" {
+        return fmt.Sprintf("%s %s %s", self.Type, self.Name, self.Text)
+    } else if self.Type == "clear" || self.Type == "artifact" {
+        return fmt.Sprintf("%s %s", self.Type, self.Name)
+    }
+    return fmt.Sprintf("%s %s", self.Type, self.Text)
+}
+
+// Subscribe to `RunEvent`s of this `ScriptRun`. The returned chan is closed
+// after the finished event is sent. If the run has already finished, only the
+// finished event is sent. Call the returned func to unsubscribe early.
+func (self *ScriptRun) Subscribe() (<-chan *RunEvent, func()) {
+    self.followLock.Lock()
+    defer self.followLock.Unlock()
+    events := make(chan *RunEvent, RUN_EVENT_BUFFER)
+    if self.Finished {
+        events <- self.finishedEvent()
+        close(events)
+        return events, func() {}
+    }
+    if self.followers == nil {
+        self.followers = make(map[chan *RunEvent]int)
+    }
+    self.followers[events] = 0
+    unsubscribe := func() {
+        self.followLock.Lock()
+        defer self.followLock.Unlock()
+        if _, exists := self.followers[events]; exists {
+            delete(self.followers, events)
+            close(events)
+        }
+    }
+    return events, unsubscribe
+}
+
+// Send `event` to all subscribers. Subscribers that fall more than
+// `RUN_EVENT_BUFFER` events behind miss events rather than holding up the
+// run. Once they catch up, they get a dropped event with the number missed.
+func (self *ScriptRun) publish(event *RunEvent) {
+    self.followLock.Lock()
+    defer self.followLock.Unlock()
+    for events, dropped := range self.followers {
+        if dropped > 0 && trySendEvent(events, newDroppedEvent(dropped)) {
+            dropped = 0
+        }
+        if dropped > 0 || !trySendEvent(events, event) {
+            dropped++
+        }
+        self.followers[events] = dropped
+    }
+}
+
+// Send `event` to `events` unless it is full. Return whether it was sent.
+func trySendEvent(events chan *RunEvent, event *RunEvent) bool {
+    select {
+    case events <- event:
+        return true
+    default:
+        return false
+    }
+}
+
+// Return the event that tells a subscriber it missed `dropped` events
+func newDroppedEvent(dropped int) *RunEvent {
+    return &RunEvent{Type: "dropped", Text: fmt.Sprintf("%d", dropped)}
+}
+
+// Send the finished event to all subscribers and close their chans. This
+// function expects `Finished` to already be set.
+func (self *ScriptRun) publishFinished() {
+    self.followLock.Lock()
+    defer self.followLock.Unlock()
+    for events, dropped := range self.followers {
+        // Make room for the dropped and finished events; they are the ones
+        // that matter
+        for len(events) > cap(events)-2 {
+            select {
+            case <-events:
+                dropped++
+            default:
+            }
+        }
+        if dropped > 0 {
+            events <- newDroppedEvent(dropped)
+        }
+        events <- self.finishedEvent()
+        close(events)
+        delete(self.followers, events)
+    }
+}
+
+// Return the event that marks the end of this run
+func (self *ScriptRun) finishedEvent() *RunEvent {
+    return &RunEvent{Type: "finished", Text: fmt.Sprintf("%d", self.ExitCode)}
+}
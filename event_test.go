@@ -0,0 +1,143 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "net/http/httptest"
+    "net/textproto"
+    "strings"
+    "testing"
+)
+
+func TestRunEventString(t *testing.T) {
+    tests := []struct {
+        event    RunEvent
+        expected string
+    }{
+        {RunEvent{Type: "stdout", Text: "hello world"}, "stdout hello world"},
+        {RunEvent{Type: "output", Name: "rows", Text: "42"}, "output rows 42"},
+        {RunEvent{Type: "clear", Name: "rows"}, "clear rows"},
+        {RunEvent{Type: "artifact", Name: "report.txt"}, "artifact report.txt"},
+        {RunEvent{Type: "dropped", Text: "3"}, "dropped 3"},
+        {RunEvent{Type: "finished", Text: "1"}, "finished 1"},
+    }
+    for _, test := range tests {
+        if str := test.event.String(); str != test.expected {
+            t.Errorf("String returned %q, expected %q", str, test.expected)
+        }
+    }
+}
+
+// Return the events left in `events` as one string, one event per line
+func readTestEvents(events <-chan *RunEvent) string {
+    strs := make([]string, 0)
+    for event := range events {
+        strs = append(strs, event.String())
+    }
+    return strings.Join(strs, "\n")
+}
+
+func TestScriptRunPublish(t *testing.T) {
+    tests := []struct {
+        name      string
+        published int
+        expected  string
+    }{
+        {"none", 0, "finished 3"},
+        {"some", 2, "stdout 0\nstdout 1\nfinished 3"},
+        {"full", RUN_EVENT_BUFFER, fmt.Sprintf("stdout 2\n...\nstdout %d\ndropped 2\nfinished 3", RUN_EVENT_BUFFER-1)},
+        {"overflowed", RUN_EVENT_BUFFER + 5, fmt.Sprintf("stdout 2\n...\nstdout %d\ndropped 7\nfinished 3", RUN_EVENT_BUFFER-1)},
+    }
+    for _, test := range tests {
+        scriptRun := &ScriptRun{Id: "abc", ExitCode: 3}
+        events, _ := scriptRun.Subscribe()
+        for idx := 0; idx < test.published; idx++ {
+            scriptRun.publish(&RunEvent{Type: "stdout", Text: fmt.Sprintf("%d", idx)})
+        }
+        scriptRun.Finished = true
+        scriptRun.publishFinished()
+        got := strings.Split(readTestEvents(events), "\n")
+        if len(got) > 5 {
+            got = append(got[:1], append([]string{"..."}, got[len(got)-3:]...)...)
+        }
+        if str := strings.Join(got, "\n"); str != test.expected {
+            t.Errorf("%s: received %q, expected %q", test.name, str, test.expected)
+        }
+    }
+}
+
+func TestScriptRunPublishCatchUp(t *testing.T) {
+    scriptRun := &ScriptRun{Id: "abc"}
+    events, unsubscribe := scriptRun.Subscribe()
+    for idx := 0; idx < RUN_EVENT_BUFFER+3; idx++ {
+        scriptRun.publish(&RunEvent{Type: "stdout", Text: fmt.Sprintf("%d", idx)})
+    }
+    for idx := 0; idx < RUN_EVENT_BUFFER; idx++ {
+        <-events
+    }
+    scriptRun.publish(&RunEvent{Type: "stderr", Text: "late"})
+    unsubscribe()
+    if str := readTestEvents(events); str != "dropped 3\nstderr late" {
+        t.Errorf("Caught up subscriber received %q, expected %q", str, "dropped 3\nstderr late")
+    }
+    unsubscribe()
+    scriptRun.publish(&RunEvent{Type: "stdout", Text: "unheard"})
+}
+
+func TestScriptRunSubscribeFinished(t *testing.T) {
+    scriptRun := &ScriptRun{Id: "abc", ExitCode: 1, Finished: true}
+    events, _ := scriptRun.Subscribe()
+    if str := readTestEvents(events); str != "finished 1" {
+        t.Errorf("Subscribing to a finished run received %q, expected %q", str, "finished 1")
+    }
+}
+
+// Make a `Response` with `events` already published and the chan closed
+func newTestEventsResponse(events ...*RunEvent) (*Response, *bool) {
+    eventChan := make(chan *RunEvent, len(events))
+    for _, event := range events {
+        eventChan <- event
+    }
+    close(eventChan)
+    stopped := false
+    return &Response{StatusCode: 200, Events: eventChan, StopEvents: func() { stopped = true }}, &stopped
+}
+
+func TestWriteEvents(t *testing.T) {
+    events := []*RunEvent{
+        {Type: "stdout", Text: "hi"},
+        {Type: "output", Name: "rows", Text: "42"},
+        {Type: "finished", Text: "0"},
+    }
+
+    resp, stopped := newTestEventsResponse(events...)
+    recorder := httptest.NewRecorder()
+    (&JsonServerInterface{}).writeEvents(recorder, httptest.NewRequest("GET", "/", nil), resp)
+    expected := "event: stdout\ndata: {\"Type\":\"stdout\",\"Text\":\"hi\"}\n\n" +
+        "event: output\ndata: {\"Type\":\"output\",\"Name\":\"rows\",\"Text\":\"42\"}\n\n" +
+        "event: finished\ndata: {\"Type\":\"finished\",\"Text\":\"0\"}\n\n"
+    if body := recorder.Body.String(); body != expected {
+        t.Errorf("SSE writeEvents wrote %q, expected %q", body, expected)
+    } else if contentType := recorder.Header().Get("Content-Type"); contentType != "text/event-stream" {
+        t.Errorf("SSE writeEvents Content-Type is %q, expected text/event-stream", contentType)
+    } else if !*stopped {
+        t.Errorf("SSE writeEvents did not unsubscribe")
+    }
+
+    resp, _ = newTestEventsResponse(events...)
+    var buf bytes.Buffer
+    textConn := textproto.NewConn(&testReadWriteCloser{&buf})
+    (&TextprotoServerInterface{}).writeEvents(textConn, resp)
+    expected = "OK 200\r\nstdout hi\r\noutput rows 42\r\nfinished 0\r\n"
+    if str := buf.String(); str != expected {
+        t.Errorf("Textproto writeEvents wrote %q, expected %q", str, expected)
+    }
+}
+
+type testReadWriteCloser struct {
+    *bytes.Buffer
+}
+
+func (self *testReadWriteCloser) Close() error {
+    return nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// A `RunFilter` selects, orders, and paginates `ScriptRunStatus`es for the
+// `status` command. It is made from request params like so:
+//
+//     <field>=<val>    field equals val
+//     <field>!=<val>   field does not equal val
+//     <field>>=<val>   field is greater than or equal to val
+//     <field><=<val>   field is less than or equal to val
+//     order_by=[-]<field>
+//     limit=<n>
+//     offset=<n>
+//
+// Fields are script, state, logid, schedule_id, finished, exit_code,
+// start_ts, finish_ts, timeout_set_ts, param.<name>, and output.<name>.
+// `started_after`, `started_before`, `finished_after`, and `finished_before`
+// are shorthands for strict timestamp comparisons. Values are compared
+// numerically when both sides are numbers, otherwise as strings. Prefix the
+// `order_by` field with `-` to sort descending. Params beginning with `_` are
+// ignored.
+type RunFilter struct {
+    Conds   []RunCond
+    OrderBy string
+    Desc    bool
+    Limit   uint64
+    Offset  uint64
+}
+
+type RunCond struct {
+    Field string
+    Op    string
+    Value string
+}
+
+// Make a `RunFilter` out of request params
+func newRunFilter(params map[string]string) (*RunFilter, error) {
+    var err error
+    filter := &RunFilter{Conds: make([]RunCond, 0)}
+    for key, val := range params {
+        if key == "id" || strings.HasPrefix(key, "_") {
+            continue
+        } else if key == "order_by" {
+            filter.OrderBy = strings.TrimPrefix(val, "-")
+            filter.Desc = strings.HasPrefix(val, "-")
+            if !isRunFilterField(filter.OrderBy) {
+                return nil, errors.New(fmt.Sprintf("Cannot order_by %s", filter.OrderBy))
+            }
+            continue
+        } else if key == "limit" {
+            if filter.Limit, err = strconv.ParseUint(val, 10, 64); err != nil {
+                return nil, errors.New(fmt.Sprintf("Invalid limit %s", val))
+            }
+            continue
+        } else if key == "offset" {
+            if filter.Offset, err = strconv.ParseUint(val, 10, 64); err != nil {
+                return nil, errors.New(fmt.Sprintf("Invalid offset %s", val))
+            }
+            continue
+        }
+
+        // The textproto and HTTP interfaces split `key!=val` into `key!` and
+        // `val`, so the operator is at the end of the key
+        cond := RunCond{Field: key, Op: "=", Value: val}
+        for _, op := range []string{"!", ">", "<"} {
+            if strings.HasSuffix(key, op) {
+                cond.Field = strings.TrimSuffix(key, op)
+                cond.Op = op + "="
+                break
+            }
+        }
+        switch cond.Field {
+        case "started_after":
+            cond.Field, cond.Op = "start_ts", ">"
+        case "started_before":
+            cond.Field, cond.Op = "start_ts", "<"
+        case "finished_after":
+            cond.Field, cond.Op = "finish_ts", ">"
+        case "finished_before":
+            cond.Field, cond.Op = "finish_ts", "<"
+        }
+        if !isRunFilterField(cond.Field) {
+            return nil, errors.New(fmt.Sprintf("Cannot filter on %s", cond.Field))
+        }
+        filter.Conds = append(filter.Conds, cond)
+    }
+    return filter, nil
+}
+
+// Return whether `field` can be filtered or ordered on
+func isRunFilterField(field string) bool {
+    switch field {
+    case "script", "state", "logid", "id", "schedule_id", "finished", "exit_code", "start_ts", "finish_ts", "timeout_set_ts":
+        return true
+    }
+    return strings.HasPrefix(field, "param.") || strings.HasPrefix(field, "output.")
+}
+
+// Return whether `status` satisfies every condition of the filter
+func (self *RunFilter) Match(status *ScriptRunStatus) bool {
+    for _, cond := range self.Conds {
+        val, exists := getRunFilterVal(status, cond.Field)
+        if !exists {
+            return false
+        }
+        cmp := compareRunFilterVals(val, cond.Value)
+        if cmp != 0 && strings.HasPrefix(cond.Field, "param.") {
+            // String params are stored shell-escaped
+            if val == escapeShellArg(cond.Value) {
+                cmp = 0
+            }
+        }
+        switch cond.Op {
+        case "=":
+            if cmp != 0 {
+                return false
+            }
+        case "!=":
+            if cmp == 0 {
+                return false
+            }
+        case ">=":
+            if cmp < 0 {
+                return false
+            }
+        case "<=":
+            if cmp > 0 {
+                return false
+            }
+        case ">":
+            if cmp <= 0 {
+                return false
+            }
+        case "<":
+            if cmp >= 0 {
+                return false
+            }
+        }
+    }
+    return true
+}
+
+// Sort and paginate `statii` in place and return the result
+func (self *RunFilter) Apply(statii []*ScriptRunStatus) []*ScriptRunStatus {
+    if self.OrderBy != "" {
+        sort.SliceStable(statii, func(i, j int) bool {
+            vi, _ := getRunFilterVal(statii[i], self.OrderBy)
+            vj, _ := getRunFilterVal(statii[j], self.OrderBy)
+            if self.Desc {
+                return compareRunFilterVals(vi, vj) > 0
+            }
+            return compareRunFilterVals(vi, vj) < 0
+        })
+    }
+    if self.Offset >= uint64(len(statii)) {
+        return statii[:0]
+    }
+    statii = statii[self.Offset:]
+    if self.Limit > 0 && self.Limit < uint64(len(statii)) {
+        statii = statii[:self.Limit]
+    }
+    return statii
+}
+
+// Return the value of `field` in `status` as a string and whether it exists
+func getRunFilterVal(status *ScriptRunStatus, field string) (string, bool) {
+    switch field {
+    case "script":
+        return status.ScriptName, true
+    case "state":
+        return status.State, true
+    case "logid":
+        return status.LogId, true
+    case "id":
+        return status.Id, true
+    case "schedule_id":
+        return status.ScheduleId, true
+    case "finished":
+        return strconv.FormatBool(status.Finished), true
+    case "exit_code":
+        return strconv.Itoa(status.ExitCode), true
+    case "start_ts":
+        return strconv.FormatInt(status.StartTs, 10), true
+    case "finish_ts":
+        return strconv.FormatInt(status.FinishTs, 10), true
+    case "timeout_set_ts":
+        return strconv.FormatInt(status.TimeoutSetTs, 10), true
+    }
+    if strings.HasPrefix(field, "param.") {
+        val, exists := status.Params[strings.TrimPrefix(field, "param.")]
+        return val, exists
+    } else if strings.HasPrefix(field, "output.") {
+        val, exists := status.Outputs[strings.TrimPrefix(field, "output.")]
+        return strings.TrimSpace(val), exists
+    }
+    return "", false
+}
+
+// Compare `a` and `b` numerically if both are numbers, otherwise as strings.
+// Return -1, 0, or 1.
+func compareRunFilterVals(a string, b string) int {
+    af, aErr := strconv.ParseFloat(a, 64)
+    bf, bErr := strconv.ParseFloat(b, 64)
+    if aErr == nil && bErr == nil {
+        if af < bf {
+            return -1
+        } else if af > bf {
+            return 1
+        }
+        return 0
+    }
+    return strings.Compare(a, b)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestNewRunFilter(t *testing.T) {
+    tests := []struct {
+        params       map[string]string
+        expectErr    bool
+        expectConds  []RunCond
+        expectOrder  string
+        expectDesc   bool
+        expectLimit  uint64
+        expectOffset uint64
+    }{
+        {map[string]string{"script": "a.sh"}, false, []RunCond{{"script", "=", "a.sh"}}, "", false, 0, 0},
+        {map[string]string{"state!": "failed"}, false, []RunCond{{"state", "!=", "failed"}}, "", false, 0, 0},
+        {map[string]string{"exit_code>": "1"}, false, []RunCond{{"exit_code", ">=", "1"}}, "", false, 0, 0},
+        {map[string]string{"param.n<": "5"}, false, []RunCond{{"param.n", "<=", "5"}}, "", false, 0, 0},
+        {map[string]string{"started_after": "100"}, false, []RunCond{{"start_ts", ">", "100"}}, "", false, 0, 0},
+        {map[string]string{"finished_before": "200"}, false, []RunCond{{"finish_ts", "<", "200"}}, "", false, 0, 0},
+        {map[string]string{"order_by": "-start_ts", "limit": "10", "offset": "5"}, false, []RunCond{}, "start_ts", true, 10, 5},
+        {map[string]string{"order_by": "output.n"}, false, []RunCond{}, "output.n", false, 0, 0},
+        {map[string]string{"id": "abc", "_follow": "1"}, false, []RunCond{}, "", false, 0, 0},
+        {map[string]string{"order_by": "bogus"}, true, nil, "", false, 0, 0},
+        {map[string]string{"limit": "-1"}, true, nil, "", false, 0, 0},
+        {map[string]string{"offset": "x"}, true, nil, "", false, 0, 0},
+        {map[string]string{"bogus": "1"}, true, nil, "", false, 0, 0},
+    }
+    for _, test := range tests {
+        filter, err := newRunFilter(test.params)
+        if (err != nil) != test.expectErr {
+            t.Errorf("newRunFilter(%v) err=%v, expected err %t", test.params, err, test.expectErr)
+            continue
+        } else if err != nil {
+            continue
+        }
+        if len(filter.Conds) != len(test.expectConds) {
+            t.Errorf("newRunFilter(%v) conds=%v, expected %v", test.params, filter.Conds, test.expectConds)
+        } else {
+            for idx, cond := range filter.Conds {
+                if cond != test.expectConds[idx] {
+                    t.Errorf("newRunFilter(%v) conds=%v, expected %v", test.params, filter.Conds, test.expectConds)
+                }
+            }
+        }
+        if filter.OrderBy != test.expectOrder || filter.Desc != test.expectDesc || filter.Limit != test.expectLimit || filter.Offset != test.expectOffset {
+            t.Errorf("newRunFilter(%v) returned %+v", test.params, filter)
+        }
+    }
+}
+
+func TestRunFilterMatch(t *testing.T) {
+    status := &ScriptRunStatus{
+        ScriptName: "backup.sh",
+        State:      STATE_FINISHED,
+        Finished:   true,
+        ExitCode:   0,
+        StartTs:    1000,
+        FinishTs:   1060,
+        Params:     map[string]string{"host": "'db1'", "n": "10"},
+        Outputs:    map[string]string{"bytes": "2048\n"},
+    }
+    tests := []struct {
+        params map[string]string
+        expect bool
+    }{
+        {map[string]string{}, true},
+        {map[string]string{"script": "backup.sh"}, true},
+        {map[string]string{"script": "other.sh"}, false},
+        {map[string]string{"state!": STATE_LOST}, true},
+        {map[string]string{"finished": "true"}, true},
+        {map[string]string{"exit_code": "0", "script": "backup.sh"}, true},
+        {map[string]string{"exit_code": "0", "script": "other.sh"}, false},
+        {map[string]string{"started_after": "999"}, true},
+        {map[string]string{"started_after": "1000"}, false},
+        {map[string]string{"finished_before": "1061"}, true},
+        {map[string]string{"start_ts>": "1000"}, true},
+        {map[string]string{"start_ts<": "999"}, false},
+        {map[string]string{"param.host": "db1"}, true},
+        {map[string]string{"param.host": "'db1'"}, true},
+        {map[string]string{"param.host!": "db1"}, false},
+        {map[string]string{"param.n>": "9"}, true},
+        {map[string]string{"param.n>": "9.5"}, true},
+        {map[string]string{"param.n<": "9"}, false},
+        {map[string]string{"param.missing": "x"}, false},
+        {map[string]string{"output.bytes": "2048"}, true},
+        {map[string]string{"output.bytes>": "10000"}, false},
+    }
+    for _, test := range tests {
+        filter, err := newRunFilter(test.params)
+        if err != nil {
+            t.Errorf("newRunFilter(%v) err=%v", test.params, err)
+        } else if match := filter.Match(status); match != test.expect {
+            t.Errorf("Match with %v returned %t, expected %t", test.params, match, test.expect)
+        }
+    }
+}
+
+func TestRunFilterApply(t *testing.T) {
+    newStatii := func() []*ScriptRunStatus {
+        return []*ScriptRunStatus{
+            {Id: "a", StartTs: 30, Outputs: map[string]string{"n": "9"}},
+            {Id: "b", StartTs: 10, Outputs: map[string]string{"n": "10"}},
+            {Id: "c", StartTs: 20, Outputs: map[string]string{"n": "100"}},
+        }
+    }
+    tests := []struct {
+        params map[string]string
+        expect string
+    }{
+        {map[string]string{}, "abc"},
+        {map[string]string{"order_by": "start_ts"}, "bca"},
+        {map[string]string{"order_by": "-start_ts"}, "acb"},
+        {map[string]string{"order_by": "output.n"}, "abc"},
+        {map[string]string{"order_by": "-id", "limit": "2"}, "cb"},
+        {map[string]string{"order_by": "start_ts", "offset": "1"}, "ca"},
+        {map[string]string{"limit": "1", "offset": "2"}, "c"},
+        {map[string]string{"offset": "3"}, ""},
+        {map[string]string{"offset": "10"}, ""},
+    }
+    for _, test := range tests {
+        filter, err := newRunFilter(test.params)
+        if err != nil {
+            t.Errorf("newRunFilter(%v) err=%v", test.params, err)
+            continue
+        }
+        ids := ""
+        for _, status := range filter.Apply(newStatii()) {
+            ids += status.Id
+        }
+        if ids != test.expect {
+            t.Errorf("Apply with %v returned %q, expected %q", test.params, ids, test.expect)
+        }
+    }
+}
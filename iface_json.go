@@ -1,31 +1,151 @@
 package main
 
 import (
+    "context"
+    "crypto/tls"
     "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "math"
+    "mime"
+    "net"
     "net/http"
+    "net/url"
+    "path/filepath"
     "strings"
     "sync"
     "time"
 )
 
+const (
+    MULTIPART_MAX_MEMORY = 1 << 20
+)
+
 type JsonServerInterface struct {
-    handler HandlerFn
+    handler         HandlerFn
+    authenticator   Authenticator
+    tlsConfig       *tls.Config
+    getStdinMaxSize func(string) int64
+    httpServer      *http.Server
+    lock            sync.Mutex
+}
+
+// Per-connection info stashed in each `http.Request` context
+type jsonConnInfo struct {
+    RemoteAddr string
+    PeerCred   *PeerCred
 }
 
-// Listen for HTTP on `addr`, let `handler` handle requests, signal
+type jsonConnInfoKey struct{}
+
+// Listen for HTTP (or HTTPS if there is a `tlsConfig`) on `addr`, which may be
+// a TCP address or `unix:<path>`, let `handler` handle requests, signal
 // `waitGroup` when done
 func (self *JsonServerInterface) Listen(addr string, handler HandlerFn, waitGroup *sync.WaitGroup) {
     self.handler = handler
     defer waitGroup.Done()
-    err := http.ListenAndServe(addr, self)
+    listener, err := listen(addr)
     if err != nil {
-        errLog.Printf("http.ListenAndServe err=%v\n", err)
+        errLog.Printf("listen err=%v\n", err)
+        return
+    }
+    httpServer := &http.Server{
+        Handler:   self,
+        TLSConfig: self.tlsConfig,
+        ErrorLog:  errLog,
+        ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+            return context.WithValue(ctx, jsonConnInfoKey{}, &jsonConnInfo{
+                RemoteAddr: getRemoteAddr(conn),
+                PeerCred:   getPeerCred(conn),
+            })
+        },
+    }
+    self.lock.Lock()
+    self.httpServer = httpServer
+    self.lock.Unlock()
+    if self.tlsConfig != nil {
+        err = httpServer.ServeTLS(listener, "", "")
+    } else {
+        err = httpServer.Serve(listener)
+    }
+    if err != nil && err != http.ErrServerClosed {
+        errLog.Printf("httpServer.Serve err=%v\n", err)
+    }
+}
+
+// Stop accepting requests. Requests in flight get `SHUTDOWN_HTTP_SECS` to
+// finish before their conns are closed.
+func (self *JsonServerInterface) Shutdown() {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    shutdownHttpServer(self.httpServer)
+}
+
+// Gracefully shut down `httpServer`, if not nil, closing conns that are
+// still busy after `SHUTDOWN_HTTP_SECS`
+func shutdownHttpServer(httpServer *http.Server) {
+    if httpServer == nil {
+        return
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_HTTP_SECS*time.Second)
+    defer cancel()
+    if err := httpServer.Shutdown(ctx); err != nil {
+        errLog.Printf("httpServer.Shutdown err=%v\n", err)
+        httpServer.Close()
     }
 }
 
 // Handle a JSON request and write response
 func (self *JsonServerInterface) ServeHTTP(httpResp http.ResponseWriter, httpReq *http.Request) {
+    connInfo, _ := httpReq.Context().Value(jsonConnInfoKey{}).(*jsonConnInfo)
+    if connInfo == nil {
+        connInfo = &jsonConnInfo{RemoteAddr: httpReq.RemoteAddr}
+    }
+    clientCert := getVerifiedClientCert(httpReq.TLS)
+    principal := getClientCertPrincipal(self.authenticator, clientCert)
+    if principal == nil {
+        principal = getPeerCredPrincipal(self.authenticator, connInfo.PeerCred)
+    }
+    if self.authenticator != nil && (principal == nil || httpReq.Header.Get("Authorization") != "") {
+        var authErr error
+        if principal, authErr = self.authenticate(httpReq); authErr != nil {
+            errLog.Printf("Rejected client remote_addr=%s err=%v\n", connInfo.RemoteAddr, authErr)
+            httpResp.Header().Set("WWW-Authenticate", `Basic realm="gobashd"`)
+            self.writeResponse(httpResp, newAuthErrorResponse(authErr))
+            return
+        }
+    }
+    // Bound the body by what the script takes on stdin, plus room for params
+    scriptName := strings.Trim(httpReq.URL.Path, "/")
+    maxBodySize := int64(MULTIPART_MAX_MEMORY)
+    stdinMaxSize := int64(0)
+    if self.getStdinMaxSize != nil {
+        stdinMaxSize = self.getStdinMaxSize(scriptName)
+    }
+    if stdinMaxSize > math.MaxInt64-maxBodySize {
+        maxBodySize = math.MaxInt64 // unlimited
+    } else {
+        maxBodySize += stdinMaxSize
+    }
+    if httpReq.Body != nil {
+        httpReq.Body = http.MaxBytesReader(httpResp, httpReq.Body, maxBodySize)
+    }
+    stdin, multipartVals, err := getHttpStdin(httpReq, stdinMaxSize > 0)
+    if err != nil {
+        self.writeResponse(httpResp, &Response{StatusCode: 400, Error: err, ErrorStr: err.Error()})
+        return
+    }
     httpReq.ParseForm()
+    for key, vals := range multipartVals {
+        httpReq.Form[key] = append(httpReq.Form[key], vals...)
+    }
+    delete(httpReq.Form, "_stdin")
+    clientCertSubject := ""
+    if clientCert != nil {
+        clientCertSubject = clientCert.Subject.String()
+    }
     params := make(map[string]string)
     for key, vals := range httpReq.Form {
         if len(vals) > 1 {
@@ -35,12 +155,93 @@ func (self *JsonServerInterface) ServeHTTP(httpResp http.ResponseWriter, httpReq
         }
     }
     resp := self.handler(&Request{
-        ScriptName:      strings.Trim(httpReq.RequestURI, "/"),
-        Params:          params,
-        ServerInterface: self,
-        Ts:              time.Now().Unix(),
-        RemoteAddr:      httpReq.RemoteAddr,
+        ScriptName:        scriptName,
+        Params:            params,
+        ServerInterface:   self,
+        Ts:                time.Now().Unix(),
+        RemoteAddr:        connInfo.RemoteAddr,
+        Principal:         principal,
+        ClientCertSubject: clientCertSubject,
+        PeerCred:          connInfo.PeerCred,
+        Stdin:             stdin,
     })
+    if resp.Events != nil {
+        self.writeEvents(httpResp, httpReq, resp)
+        return
+    } else if resp.File != nil {
+        self.writeFile(httpResp, httpReq, resp)
+        return
+    }
+    self.writeResponse(httpResp, resp)
+}
+
+// Return the stdin payload of `httpReq`, or nil if it has none. The payload is
+// the `_stdin` part of a multipart form, or else, if the script `takesStdin`,
+// the raw body of a request that is not a url-encoded form. Otherwise the raw
+// body is ignored, as it was before `@stdin`. The multipart form is streamed:
+// parts before `_stdin` are returned as param values, and parts after it are
+// ignored.
+func getHttpStdin(httpReq *http.Request, takesStdin bool) (io.Reader, url.Values, error) {
+    if httpReq.Body == nil || httpReq.Body == http.NoBody || httpReq.ContentLength == 0 {
+        return nil, nil, nil
+    }
+    mediaType, _, _ := mime.ParseMediaType(httpReq.Header.Get("Content-Type"))
+    if mediaType == "application/x-www-form-urlencoded" {
+        return nil, nil, nil
+    } else if mediaType != "multipart/form-data" {
+        if !takesStdin {
+            return nil, nil, nil
+        }
+        return httpReq.Body, nil, nil
+    }
+    multipartReader, err := httpReq.MultipartReader()
+    if err != nil {
+        return nil, nil, err
+    }
+    vals := make(url.Values)
+    valsSize := int64(0)
+    for {
+        part, err := multipartReader.NextPart()
+        if err == io.EOF {
+            return nil, vals, nil
+        } else if err != nil {
+            return nil, nil, err
+        } else if part.FormName() == "_stdin" {
+            return part, vals, nil
+        } else if part.FileName() != "" {
+            // Only `_stdin` may be a file
+            continue
+        }
+        val, err := ioutil.ReadAll(io.LimitReader(part, MULTIPART_MAX_MEMORY-valsSize+1))
+        if err != nil {
+            return nil, nil, err
+        } else if valsSize += int64(len(val)); valsSize > MULTIPART_MAX_MEMORY {
+            return nil, nil, errors.New("Multipart form values are too large")
+        }
+        vals.Add(part.FormName(), string(val))
+    }
+}
+
+// Return the `Principal` identified by the bearer token or basic auth
+// credentials of `httpReq`
+func (self *JsonServerInterface) authenticate(httpReq *http.Request) (*Principal, error) {
+    authHeader := httpReq.Header.Get("Authorization")
+    if authHeader == "" {
+        return nil, errAuthRequired
+    } else if len(authHeader) > 7 && strings.EqualFold(authHeader[:7], "Bearer ") {
+        return self.authenticator.CheckToken(strings.TrimSpace(authHeader[7:]))
+    } else if user, password, ok := httpReq.BasicAuth(); ok {
+        return self.authenticator.CheckPassword(user, password)
+    }
+    return nil, errAuthFailed
+}
+
+// Write `resp` as JSON, or its `Body` as is if it has a `ContentType`
+func (self *JsonServerInterface) writeResponse(httpResp http.ResponseWriter, resp *Response) {
+    if resp.ContentType != "" {
+        writeRawResponse(httpResp, resp)
+        return
+    }
     httpResp.Header().Set("Content-Type", "application/json")
     if jsonBytes, err := json.MarshalIndent(resp, "", "    "); err != nil {
         httpResp.WriteHeader(http.StatusInternalServerError)
@@ -52,3 +253,59 @@ func (self *JsonServerInterface) ServeHTTP(httpResp http.ResponseWriter, httpReq
         }
     }
 }
+
+// Write the `Body` of `resp` as is, with its `ContentType`
+func writeRawResponse(httpResp http.ResponseWriter, resp *Response) {
+    httpResp.Header().Set("Content-Type", resp.ContentType)
+    httpResp.WriteHeader(resp.StatusCode)
+    if _, err := httpResp.Write([]byte(resp.Body)); err != nil {
+        errLog.Printf("httpResp.Write err=%v\n", err)
+    }
+}
+
+// Write `resp.File` as a download, then close it. `http.ServeContent` sets
+// Content-Length and serves Range requests.
+func (self *JsonServerInterface) writeFile(httpResp http.ResponseWriter, httpReq *http.Request, resp *Response) {
+    defer resp.File.Close()
+    fileInfo, err := resp.File.Stat()
+    if err != nil {
+        errLog.Printf("File.Stat err=%v\n", err)
+        httpResp.WriteHeader(http.StatusInternalServerError)
+        return
+    }
+    name := filepath.Base(resp.File.Name())
+    httpResp.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+    http.ServeContent(httpResp, httpReq, name, fileInfo.ModTime(), resp.File)
+}
+
+// Write `RunEvent`s from `resp.Events` as Server-Sent Events as they happen,
+// until the run finishes or the client goes away
+func (self *JsonServerInterface) writeEvents(httpResp http.ResponseWriter, httpReq *http.Request, resp *Response) {
+    defer resp.StopEvents()
+    flusher, canFlush := httpResp.(http.Flusher)
+    httpResp.Header().Set("Content-Type", "text/event-stream")
+    httpResp.Header().Set("Cache-Control", "no-cache")
+    httpResp.WriteHeader(resp.StatusCode)
+    for {
+        select {
+        case event, ok := <-resp.Events:
+            if !ok {
+                return
+            }
+            jsonBytes, err := json.Marshal(event)
+            if err != nil {
+                errLog.Printf("json.Marshal err=%v\n", err)
+                return
+            }
+            if _, err = fmt.Fprintf(httpResp, "event: %s\ndata: %s\n\n", event.Type, jsonBytes); err != nil {
+                errLog.Printf("httpResp.Write err=%v\n", err)
+                return
+            }
+            if canFlush {
+                flusher.Flush()
+            }
+        case <-httpReq.Context().Done():
+            return
+        }
+    }
+}
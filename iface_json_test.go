@@ -0,0 +1,76 @@
+package main
+
+import (
+    "bytes"
+    "io/ioutil"
+    "mime/multipart"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+// Make a multipart form body out of `parts`, alternating names and values.
+// The `_stdin` part is sent as a file.
+func newTestMultipartBody(parts ...string) (string, string) {
+    var body bytes.Buffer
+    writer := multipart.NewWriter(&body)
+    for idx := 0; idx+1 < len(parts); idx += 2 {
+        if parts[idx] == "_stdin" || parts[idx] == "file" {
+            fileWriter, _ := writer.CreateFormFile(parts[idx], "payload")
+            fileWriter.Write([]byte(parts[idx+1]))
+        } else {
+            writer.WriteField(parts[idx], parts[idx+1])
+        }
+    }
+    writer.Close()
+    return body.String(), writer.FormDataContentType()
+}
+
+func TestGetHttpStdin(t *testing.T) {
+    multipartBody, multipartType := newTestMultipartBody("a", "1", "file", "skipped", "_stdin", "payload", "b", "2")
+    noStdinBody, noStdinType := newTestMultipartBody("a", "1")
+    tests := []struct {
+        name        string
+        body        string
+        contentType string
+        takesStdin  bool
+        expectStdin string
+        expectVals  string
+        expectErr   bool
+    }{
+        {"no body", "", "text/plain", true, "", "", false},
+        {"raw body", "payload", "text/csv", true, "payload", "", false},
+        {"raw body without content type", "payload", "", true, "payload", "", false},
+        {"raw body to none script", "payload", "text/plain", false, "", "", false},
+        {"json to none script", `{"a":1}`, "application/json", false, "", "", false},
+        {"url-encoded form", "a=1", "application/x-www-form-urlencoded", true, "", "", false},
+        {"multipart", multipartBody, multipartType, true, "payload", "a=1", false},
+        {"multipart to none script", multipartBody, multipartType, false, "payload", "a=1", false},
+        {"multipart without stdin", noStdinBody, noStdinType, true, "", "a=1", false},
+        {"bad multipart", "garbage", "multipart/form-data; boundary=x", true, "", "", true},
+    }
+    for _, test := range tests {
+        httpReq := httptest.NewRequest("POST", "/a.sh", strings.NewReader(test.body))
+        if test.contentType != "" {
+            httpReq.Header.Set("Content-Type", test.contentType)
+        }
+        stdin, vals, err := getHttpStdin(httpReq, test.takesStdin)
+        if (err != nil) != test.expectErr {
+            t.Errorf("%s: getHttpStdin err=%v, expected err %t", test.name, err, test.expectErr)
+            continue
+        }
+        stdinStr := ""
+        if stdin != nil {
+            stdinBytes, _ := ioutil.ReadAll(stdin)
+            stdinStr = string(stdinBytes)
+            if stdinStr == "" {
+                t.Errorf("%s: got empty stdin, expected nil", test.name)
+            }
+        }
+        if stdinStr != test.expectStdin {
+            t.Errorf("%s: got stdin %q, expected %q", test.name, stdinStr, test.expectStdin)
+        } else if vals.Encode() != test.expectVals {
+            t.Errorf("%s: got vals %q, expected %q", test.name, vals.Encode(), test.expectVals)
+        }
+    }
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+    "net/http"
+    "sync"
+    "time"
+)
+
+// A `MetricsServerInterface` serves only `GET /metrics`, without
+// authentication, so a Prometheus server can scrape gobashd without
+// credentials for the JSON interface. Bind it to a trusted address.
+type MetricsServerInterface struct {
+    handler    HandlerFn
+    httpServer *http.Server
+    lock       sync.Mutex
+}
+
+// Listen for HTTP on `addr`, which may be a TCP address or `unix:<path>`,
+// let `handler` handle metrics requests, signal `waitGroup` when done
+func (self *MetricsServerInterface) Listen(addr string, handler HandlerFn, waitGroup *sync.WaitGroup) {
+    self.handler = handler
+    defer waitGroup.Done()
+    listener, err := listen(addr)
+    if err != nil {
+        errLog.Printf("listen err=%v\n", err)
+        return
+    }
+    httpServer := &http.Server{
+        Handler:  self,
+        ErrorLog: errLog,
+    }
+    self.lock.Lock()
+    self.httpServer = httpServer
+    self.lock.Unlock()
+    if err = httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+        errLog.Printf("httpServer.Serve err=%v\n", err)
+    }
+}
+
+// Stop accepting requests
+func (self *MetricsServerInterface) Shutdown() {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    shutdownHttpServer(self.httpServer)
+}
+
+// Handle a metrics request and write response
+func (self *MetricsServerInterface) ServeHTTP(httpResp http.ResponseWriter, httpReq *http.Request) {
+    if httpReq.URL.Path != "/metrics" {
+        http.NotFound(httpResp, httpReq)
+        return
+    } else if httpReq.Method != "GET" && httpReq.Method != "HEAD" {
+        httpResp.Header().Set("Allow", "GET, HEAD")
+        http.Error(httpResp, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    writeRawResponse(httpResp, self.handler(&Request{
+        ScriptName:      "metrics",
+        Params:          make(map[string]string),
+        ServerInterface: self,
+        Ts:              time.Now().Unix(),
+        RemoteAddr:      httpReq.RemoteAddr,
+    }))
+}
@@ -1,52 +1,99 @@
 package main
 
 import (
+    "crypto/tls"
+    "errors"
+    "fmt"
     "io"
     "net"
     "net/textproto"
+    "strconv"
     "strings"
     "sync"
     "time"
 )
 
 type TextprotoServerInterface struct {
-    handler HandlerFn
+    handler       HandlerFn
+    authenticator Authenticator
+    tlsConfig     *tls.Config
+    listener      net.Listener
+    lock          sync.Mutex
 }
 
-// Listen for HTTP on `addr`, let `handler` handle requests, signal
-// `waitGroup` when done
+// Listen for textproto (over TLS if there is a `tlsConfig`) on `addr`, which
+// may be a TCP address or `unix:<path>`, let `handler` handle requests,
+// signal `waitGroup` when done
 func (self *TextprotoServerInterface) Listen(addr string, handler HandlerFn, waitGroup *sync.WaitGroup) {
     self.handler = handler
     defer waitGroup.Done()
 
-    tcpAddr, resolveErr := net.ResolveTCPAddr("tcp", addr)
-    if resolveErr != nil {
-        errLog.Printf("net.ResolveTCPAddr err=%v\n", resolveErr)
-        return
-    }
-
-    tcpListener, listenErr := net.ListenTCP("tcp", tcpAddr)
+    listener, listenErr := listen(addr)
     if listenErr != nil {
-        errLog.Printf("net.ListenTCP err=%v\n", listenErr)
+        errLog.Printf("listen err=%v\n", listenErr)
         return
     }
+    self.lock.Lock()
+    self.listener = listener
+    self.lock.Unlock()
 
     for {
-        if tcpConn, acceptErr := tcpListener.AcceptTCP(); acceptErr != nil {
-            errLog.Printf("tcpListener.AcceptTCP err=%v\n", acceptErr)
+        if conn, acceptErr := listener.Accept(); errors.Is(acceptErr, net.ErrClosed) {
+            // Shut down
+            return
+        } else if acceptErr != nil {
+            errLog.Printf("listener.Accept err=%v\n", acceptErr)
             return
         } else {
-            go self.handleConn(tcpConn)
+            go self.handleConn(conn)
+        }
+    }
+}
+
+// Stop accepting conns. Conns already accepted are served to completion.
+func (self *TextprotoServerInterface) Shutdown() {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    if self.listener != nil {
+        if err := self.listener.Close(); err != nil {
+            errLog.Printf("listener.Close err=%v\n", err)
         }
     }
 }
 
-// Handle a text conn. Read requests and write responses.
-func (self *TextprotoServerInterface) handleConn(tcpConn *net.TCPConn) {
+// Handle a text conn. Read requests and write responses. If there is an
+// `Authenticator`, the client must first authenticate like so:
+//
+//     AUTH <mechanism> [<base64 initial response>]
+//
+// If the initial response is omitted, the server replies `+` and reads it
+// from the next line. Over TLS, a verified client certificate may identify
+// the client instead. Over a unix socket, the peer's local user may too.
+func (self *TextprotoServerInterface) handleConn(conn net.Conn) {
     var err error
-    textConn := textproto.NewConn(tcpConn)
+    peerCred := getPeerCred(conn)
+    principal := getPeerCredPrincipal(self.authenticator, peerCred)
+    clientCertSubject := ""
+    if self.tlsConfig != nil {
+        conn = tls.Server(conn, self.tlsConfig)
+    }
+    if tlsConn, isTls := conn.(*tls.Conn); isTls {
+        if err = tlsConn.Handshake(); err != nil {
+            errLog.Printf("tlsConn.Handshake err=%v\n", err)
+            conn.Close()
+            return
+        }
+        state := tlsConn.ConnectionState()
+        if clientCert := getVerifiedClientCert(&state); clientCert != nil {
+            if certPrincipal := getClientCertPrincipal(self.authenticator, clientCert); certPrincipal != nil {
+                principal = certPrincipal
+            }
+            clientCertSubject = clientCert.Subject.String()
+        }
+    }
+    textConn := textproto.NewConn(conn)
 
-    // For-once loop
+    // Loop until a request is handled. AUTH lines may come first.
     for {
         // Read line from socket
         requestLine := ""
@@ -64,6 +111,24 @@ func (self *TextprotoServerInterface) handleConn(tcpConn *net.TCPConn) {
             break
         }
 
+        // Authenticate
+        if self.authenticator != nil && strings.ToUpper(scriptArgs[0]) == "AUTH" {
+            var authErr error
+            if principal, authErr = self.authenticate(textConn, scriptArgs[1:]); authErr != nil {
+                errLog.Printf("Rejected client remote_addr=%s err=%v\n", getRemoteAddr(conn), authErr)
+                self.writeResponse(textConn, newAuthErrorResponse(authErr))
+                break
+            }
+            self.writeResponse(textConn, &Response{
+                StatusCode: 200,
+                Body:       fmt.Sprintf("Authenticated as %s", principal.Name),
+            })
+            continue
+        } else if self.authenticator != nil && principal == nil {
+            self.writeResponse(textConn, newAuthErrorResponse(errAuthRequired))
+            break
+        }
+
         // Expect each arg in the format of '-*key=val'. Again, not perfect.
         scriptParams := make(map[string]string)
         for _, scriptArg := range scriptArgs[1:] {
@@ -73,17 +138,45 @@ func (self *TextprotoServerInterface) handleConn(tcpConn *net.TCPConn) {
             }
         }
 
+        // A `_stdin` param says a stdin payload follows the request line,
+        // either as a dot-terminated block (`.`) or as exactly that many bytes
+        var stdin io.Reader
+        if stdinArg, hasStdin := scriptParams["_stdin"]; hasStdin {
+            delete(scriptParams, "_stdin")
+            if stdinArg == "." {
+                stdin = textConn.DotReader()
+            } else if size, sizeErr := strconv.ParseInt(stdinArg, 10, 64); sizeErr == nil && size >= 0 {
+                stdin = &sizedReader{reader: textConn.R, remaining: size}
+            } else {
+                self.writeResponse(textConn, &Response{
+                    StatusCode: 400,
+                    Body:       fmt.Sprintf("Invalid _stdin %s; expected a byte count or .", stdinArg),
+                })
+                break
+            }
+        }
+
         // Pass to server code for handling
         resp := self.handler(&Request{
-            ScriptName:      scriptArgs[0],
-            Params:          scriptParams,
-            ServerInterface: self,
-            Ts:              time.Now().Unix(),
-            RemoteAddr:      tcpConn.RemoteAddr().String(),
+            ScriptName:        scriptArgs[0],
+            Params:            scriptParams,
+            ServerInterface:   self,
+            Ts:                time.Now().Unix(),
+            RemoteAddr:        getRemoteAddr(conn),
+            Principal:         principal,
+            ClientCertSubject: clientCertSubject,
+            PeerCred:          peerCred,
+            Stdin:             stdin,
         })
 
         // Write response
-        self.writeResponse(textConn, resp)
+        if resp.Events != nil {
+            self.writeEvents(textConn, resp)
+        } else if resp.File != nil {
+            self.writeFile(textConn, resp)
+        } else {
+            self.writeResponse(textConn, resp)
+        }
         break
     }
 
@@ -93,6 +186,52 @@ func (self *TextprotoServerInterface) handleConn(tcpConn *net.TCPConn) {
     }
 }
 
+// A `sizedReader` reads exactly `remaining` bytes from `reader`, failing if
+// it ends early
+type sizedReader struct {
+    reader    io.Reader
+    remaining int64
+}
+
+// Read up to the rest of the bytes
+func (self *sizedReader) Read(buf []byte) (int, error) {
+    if self.remaining <= 0 {
+        return 0, io.EOF
+    } else if int64(len(buf)) > self.remaining {
+        buf = buf[:self.remaining]
+    }
+    n, err := self.reader.Read(buf)
+    self.remaining -= int64(n)
+    if err == io.EOF && self.remaining > 0 {
+        err = io.ErrUnexpectedEOF
+    }
+    return n, err
+}
+
+// Verify the SASL exchange started by an AUTH line with args `authArgs`
+func (self *TextprotoServerInterface) authenticate(textConn *textproto.Conn, authArgs []string) (*Principal, error) {
+    if len(authArgs) < 1 {
+        return nil, errors.New("Expected AUTH <mechanism> [<initial response>]")
+    }
+    response := ""
+    if len(authArgs) > 1 {
+        response = authArgs[1]
+    } else {
+        var err error
+        if err = textConn.Writer.PrintfLine("+"); err != nil {
+            return nil, err
+        }
+        if response, err = textConn.ReadLine(); err != nil {
+            return nil, err
+        }
+    }
+    if response == "=" {
+        // Empty response
+        response = ""
+    }
+    return saslAuthenticate(self.authenticator, authArgs[0], response)
+}
+
 // Try to write `resp` to `textConn`
 func (self *TextprotoServerInterface) writeResponse(textConn *textproto.Conn, resp *Response) {
     var err error
@@ -106,6 +245,24 @@ func (self *TextprotoServerInterface) writeResponse(textConn *textproto.Conn, re
             err = textConn.Writer.PrintfLine("%s", resp.Body)
         } else if resp.Error != nil {
             err = textConn.Writer.PrintfLine("%s", resp.Error.Error())
+        } else if resp.Schedules != nil {
+            schedules := make([]string, 0)
+            for _, schedule := range resp.Schedules {
+                schedules = append(schedules, schedule.String())
+            }
+            err = textConn.Writer.PrintfLine("%s", strings.Join(schedules, ""))
+        } else if resp.Artifacts != nil {
+            artifacts := make([]string, 0)
+            for _, artifact := range resp.Artifacts {
+                artifacts = append(artifacts, artifact.String())
+            }
+            err = textConn.Writer.PrintfLine("%s", strings.Join(artifacts, ""))
+        } else if resp.LogLines != nil {
+            for _, logLine := range resp.LogLines {
+                if err = textConn.Writer.PrintfLine("%s %s", logLine.Stream, logLine.Text); err != nil {
+                    break
+                }
+            }
         } else {
             statii := make([]string, 0)
             for _, status := range resp.RunStatii {
@@ -118,3 +275,40 @@ func (self *TextprotoServerInterface) writeResponse(textConn *textproto.Conn, re
         errLog.Printf("textConn.Writer.PrintfLine err=%v\n", err)
     }
 }
+
+// Write `resp.File` to `textConn` as is, after a status line with its size,
+// like a length-prefixed `_stdin`. Then close it.
+func (self *TextprotoServerInterface) writeFile(textConn *textproto.Conn, resp *Response) {
+    defer resp.File.Close()
+    fileInfo, err := resp.File.Stat()
+    if err != nil {
+        errLog.Printf("File.Stat err=%v\n", err)
+        self.writeResponse(textConn, &Response{StatusCode: 500, Error: err})
+        return
+    } else if err = textConn.Writer.PrintfLine("OK %d %d", resp.StatusCode, fileInfo.Size()); err != nil {
+        errLog.Printf("textConn.Writer.PrintfLine err=%v\n", err)
+        return
+    }
+    if _, err = io.CopyN(textConn.Writer.W, resp.File, fileInfo.Size()); err != nil {
+        errLog.Printf("io.CopyN err=%v\n", err)
+    } else if err = textConn.Writer.W.Flush(); err != nil {
+        errLog.Printf("textConn.Writer.W.Flush err=%v\n", err)
+    }
+}
+
+// Write `RunEvent`s from `resp.Events` to `textConn` as they happen, one per
+// line, until the run finishes or the client goes away
+func (self *TextprotoServerInterface) writeEvents(textConn *textproto.Conn, resp *Response) {
+    if err := textConn.Writer.PrintfLine("OK %d", resp.StatusCode); err != nil {
+        errLog.Printf("textConn.Writer.PrintfLine err=%v\n", err)
+        resp.StopEvents()
+        return
+    }
+    for event := range resp.Events {
+        if err := textConn.Writer.PrintfLine("%s", event.String()); err != nil {
+            errLog.Printf("textConn.Writer.PrintfLine err=%v\n", err)
+            resp.StopEvents()
+            return
+        }
+    }
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "os/exec"
+    "os/user"
+    "path/filepath"
+    "runtime"
+    "strconv"
+    "strings"
+    "syscall"
+    "time"
+)
+
+const (
+    RLIM_INFINITY = ^uint64(0)
+
+    IONICE_CLASS_REALTIME    = 1
+    IONICE_CLASS_BEST_EFFORT = 2
+    IONICE_CLASS_IDLE        = 3
+
+    CGROUP_KILL_POLL_MS = 10
+    CGROUP_KILL_WAIT_MS = 5000
+)
+
+// Rlimits that `@limit` may set, besides those in `platformRlimits`
+var rlimits = map[string]int{
+    "nofile":  syscall.RLIMIT_NOFILE,
+    "core":    syscall.RLIMIT_CORE,
+    "cputime": syscall.RLIMIT_CPU,
+    "data":    syscall.RLIMIT_DATA,
+    "fsize":   syscall.RLIMIT_FSIZE,
+    "stack":   syscall.RLIMIT_STACK,
+    "as":      syscall.RLIMIT_AS,
+}
+
+var ioniceClasses = map[string]int{
+    "realtime":    IONICE_CLASS_REALTIME,
+    "best-effort": IONICE_CLASS_BEST_EFFORT,
+    "idle":        IONICE_CLASS_IDLE,
+}
+
+// `RunLimits` are the resource limits of a script's runs. Rlimits, nice, and
+// ionice are set on the script's process before it starts, so its children
+// inherit them. Memory, CPU, and IO weight are cgroup v2 limits, which need
+// `-cgroup`; they apply to all processes of a run together. `Credential` is
+// not a limit, but is applied along with them, after the rest: it is the user
+// and groups of `@run_as` that the script runs as.
+type RunLimits struct {
+    Rlimits     map[string]uint64
+    Nice        *int
+    IoniceClass int
+    IoniceLevel int
+    MemoryMax   string
+    CpuMax      string
+    IoWeight    string
+    Cgroup      string
+    Credential  *syscall.Credential
+}
+
+func newRunLimits() *RunLimits {
+    return &RunLimits{Rlimits: make(map[string]uint64)}
+}
+
+// Set limit `name` to `val`, as given to `@limit`
+func (self *RunLimits) setLimit(name string, val string) error {
+    if name == "memory" {
+        size, err := parseLimitSize(val)
+        if err != nil {
+            return err
+        } else if size == RLIM_INFINITY {
+            self.MemoryMax = "max"
+        } else {
+            self.MemoryMax = strconv.FormatUint(size, 10)
+        }
+    } else if name == "cpu" {
+        percent, err := strconv.ParseUint(strings.TrimSuffix(val, "%"), 10, 64)
+        if err != nil || !strings.HasSuffix(val, "%") || percent == 0 {
+            return errors.New(fmt.Sprintf("Invalid cpu limit %s; expected a percent of one CPU, e.g., 50%%", val))
+        }
+        self.CpuMax = fmt.Sprintf("%d 100000", percent*1000)
+    } else if name == "io_weight" {
+        weight, err := strconv.ParseUint(val, 10, 64)
+        if err != nil || weight < 1 || weight > 10000 {
+            return errors.New(fmt.Sprintf("Invalid io_weight %s; expected 1 to 10000", val))
+        }
+        self.IoWeight = fmt.Sprintf("default %d", weight)
+    } else if _, exists := getRlimitResource(name); exists {
+        size, err := parseLimitSize(val)
+        if err != nil {
+            return err
+        }
+        self.Rlimits[name] = size
+    } else {
+        return errors.New(fmt.Sprintf("Unsupported limit %s", name))
+    }
+    return nil
+}
+
+// Set the ionice class `className` and priority `level`, as given to
+// `@ionice`
+func (self *RunLimits) setIonice(className string, level string) error {
+    self.IoniceClass = ioniceClasses[className]
+    if level == "" {
+        self.IoniceLevel = 4
+        return nil
+    } else if self.IoniceClass == IONICE_CLASS_IDLE {
+        return errors.New("Idle ionice class takes no priority level")
+    }
+    levelVal, err := strconv.Atoi(level)
+    if err != nil || levelVal < 0 || levelVal > 7 {
+        return errors.New(fmt.Sprintf("Invalid ionice level %s; expected 0 to 7", level))
+    }
+    self.IoniceLevel = levelVal
+    return nil
+}
+
+// Return whether any cgroup limits are set
+func (self *RunLimits) hasCgroupLimits() bool {
+    return self.MemoryMax != "" || self.CpuMax != "" || self.IoWeight != ""
+}
+
+// Return whether there is nothing to apply
+func (self *RunLimits) isEmpty() bool {
+    return len(self.Rlimits) == 0 && self.Nice == nil && self.IoniceClass == 0 && self.Cgroup == "" && self.Credential == nil
+}
+
+// Return the rlimit resource named `name`
+func getRlimitResource(name string) (int, bool) {
+    if resource, exists := rlimits[name]; exists {
+        return resource, true
+    }
+    resource, exists := platformRlimits[name]
+    return resource, exists
+}
+
+// Parse `val`, a count or size with an optional K, M, G, or T suffix (powers
+// of 1024), or `unlimited`
+func parseLimitSize(val string) (uint64, error) {
+    if val == "unlimited" || val == "max" {
+        return RLIM_INFINITY, nil
+    }
+    multiplier := uint64(1)
+    if suffixIdx := strings.IndexAny(strings.ToUpper(val), "KMGT"); suffixIdx > 0 && suffixIdx == len(val)-1 {
+        multiplier = uint64(1) << uint(10*(strings.Index("KMGT", strings.ToUpper(val[suffixIdx:]))+1))
+        val = val[:suffixIdx]
+    }
+    size, err := strconv.ParseUint(val, 10, 64)
+    if err != nil {
+        return 0, errors.New(fmt.Sprintf("Invalid limit %s; expected a number with an optional K, M, G, or T suffix, or unlimited", val))
+    }
+    return size * multiplier, nil
+}
+
+// Return the dir of the cgroup of the run with id `id`
+func getRunCgroup(id string) string {
+    return filepath.Join(config.Cgroup, fmt.Sprintf("gobashd-%s", id))
+}
+
+// Enable the memory, cpu, and io controllers for child cgroups of
+// `config.Cgroup`. Controllers that are not available are logged and left
+// out.
+func enableCgroupControllers() {
+    controlPath := filepath.Join(config.Cgroup, "cgroup.subtree_control")
+    for _, controller := range []string{"memory", "cpu", "io"} {
+        if err := ioutil.WriteFile(controlPath, []byte(fmt.Sprintf("+%s", controller)), 0644); err != nil {
+            errLog.Printf("Failed to enable cgroup controller %s in %s; err=%v\n", controller, config.Cgroup, err)
+        }
+    }
+}
+
+// Make the cgroup `Cgroup` and set its limits
+func (self *RunLimits) makeCgroup() error {
+    if err := os.Mkdir(self.Cgroup, 0755); err != nil {
+        return err
+    }
+    for fileName, val := range map[string]string{"memory.max": self.MemoryMax, "cpu.max": self.CpuMax, "io.weight": self.IoWeight} {
+        if val == "" {
+            continue
+        } else if err := ioutil.WriteFile(filepath.Join(self.Cgroup, fileName), []byte(val), 0644); err != nil {
+            os.Remove(self.Cgroup)
+            return err
+        }
+    }
+    return nil
+}
+
+// Apply the limits to this process. Nice and ionice are per thread on Linux,
+// so the caller must be locked to the thread that goes on to exec the script.
+func (self *RunLimits) apply() error {
+    if self.Cgroup != "" {
+        if err := ioutil.WriteFile(filepath.Join(self.Cgroup, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+            return err
+        }
+    }
+    for name, val := range self.Rlimits {
+        resource, _ := getRlimitResource(name)
+        if err := syscall.Setrlimit(resource, &syscall.Rlimit{Cur: val, Max: val}); err != nil {
+            return errors.New(fmt.Sprintf("Failed to set %s limit; err=%v", name, err))
+        }
+    }
+    if self.Nice != nil {
+        if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, *self.Nice); err != nil {
+            return errors.New(fmt.Sprintf("Failed to set nice; err=%v", err))
+        }
+    }
+    if self.IoniceClass != 0 {
+        if err := setIonice(self.IoniceClass, self.IoniceLevel); err != nil {
+            return errors.New(fmt.Sprintf("Failed to set ionice; err=%v", err))
+        }
+    }
+    if self.Credential != nil {
+        if err := dropPrivileges(self.Credential); err != nil {
+            return errors.New(fmt.Sprintf("Failed to switch user; err=%v", err))
+        }
+    }
+    return nil
+}
+
+// Switch this process to the user and groups in `credential` for good
+func dropPrivileges(credential *syscall.Credential) error {
+    groups := make([]int, len(credential.Groups))
+    for groupIdx, group := range credential.Groups {
+        groups[groupIdx] = int(group)
+    }
+    if err := syscall.Setgroups(groups); err != nil {
+        return err
+    } else if err = syscall.Setgid(int(credential.Gid)); err != nil {
+        return err
+    }
+    return syscall.Setuid(int(credential.Uid))
+}
+
+// Look up the `syscall.Credential` of `userGroup`, formatted as
+// `user[:group]`, including the user's supplementary groups
+func lookupCredential(userGroup string) (*syscall.Credential, error) {
+    uid, gid, err := lookupUserGroup(userGroup)
+    if err != nil {
+        return nil, err
+    }
+    runAsUser, err := user.LookupId(strconv.Itoa(uid))
+    if err != nil {
+        return nil, err
+    }
+    groupIds, err := runAsUser.GroupIds()
+    if err != nil {
+        return nil, err
+    }
+    credential := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+    for _, groupId := range groupIds {
+        if group, convErr := strconv.ParseUint(groupId, 10, 32); convErr == nil {
+            credential.Groups = append(credential.Groups, uint32(group))
+        }
+    }
+    return credential, nil
+}
+
+// Apply the limits in JSON `spec` to this process, then exec `args`. This is
+// the entry point of `-launch`. Only returns, with an exit code, on error.
+func launchScript(spec string, args []string) int {
+    runtime.LockOSThread()
+    limits := newRunLimits()
+    err := json.Unmarshal([]byte(spec), limits)
+    if err == nil && len(args) == 0 {
+        err = errors.New("No command to launch")
+    }
+    if err == nil {
+        err = limits.apply()
+    }
+    var path string
+    if err == nil {
+        path, err = exec.LookPath(args[0])
+    }
+    if err == nil {
+        err = syscall.Exec(path, args, os.Environ())
+    }
+    fmt.Fprintf(os.Stderr, "gobashd -launch: %v\n", err)
+    return 127
+}
+
+// Wrap `Cmd` in `gobashd -launch` to apply the script's limits and
+// `@run_as`. With `-cgroup`, every run gets its own cgroup for limits and
+// usage accounting. If the cgroup cannot be made, the run fails if it has
+// cgroup limits, and goes without one otherwise.
+func (self *ScriptRun) wrapLimits() error {
+    limits := newRunLimits()
+    if self.Script.Limits != nil {
+        *limits = *self.Script.Limits
+    }
+    limits.Credential = self.Script.Credential
+    if config.Cgroup != "" {
+        limits.Cgroup = getRunCgroup(self.Id)
+        if err := limits.makeCgroup(); err != nil && limits.hasCgroupLimits() {
+            return err
+        } else if err != nil {
+            self.logErr("Running without a cgroup; err=%v\n", err)
+            limits.Cgroup = ""
+        }
+    }
+    if limits.isEmpty() {
+        return nil
+    }
+    spec, err := json.Marshal(limits)
+    if err != nil {
+        return err
+    }
+    exePath, err := os.Executable()
+    if err != nil {
+        return err
+    }
+    args := append([]string{"-launch", string(spec), "--", self.Cmd.Path}, self.Cmd.Args[1:]...)
+    launchCmd := exec.Command(exePath, args...)
+    launchCmd.Env = self.Cmd.Env
+    launchCmd.Dir = self.Cmd.Dir
+    launchCmd.Stdin = self.Cmd.Stdin
+    self.Cmd = launchCmd
+    return nil
+}
+
+// Set `CpuSecs` and `PeakMemory` from the rusage in `processState`. This
+// covers the script and the children it waited for.
+func (self *ScriptRun) setRusage(processState *os.ProcessState) {
+    if rusage, isRusage := processState.SysUsage().(*syscall.Rusage); isRusage {
+        self.CpuSecs = float64(rusage.Utime.Nano()+rusage.Stime.Nano()) / 1e9
+        self.PeakMemory = getMaxRssBytes(rusage)
+    }
+}
+
+// Kill what is left of the run's cgroup, if it has one, e.g., background
+// processes the script did not wait for. Then set `CpuSecs` and `PeakMemory`
+// from the cgroup, which covers every process of the run, and remove it.
+func (self *ScriptRun) finishCgroup() {
+    if config.Cgroup == "" {
+        return
+    }
+    cgroup := getRunCgroup(self.Id)
+    if _, err := os.Stat(cgroup); err != nil {
+        return
+    } else if err = killCgroup(cgroup); err != nil {
+        self.logErr("Failed to empty cgroup; err=%v\n", err)
+    }
+    if cpuStat, err := ioutil.ReadFile(filepath.Join(cgroup, "cpu.stat")); err == nil {
+        for _, line := range strings.Split(string(cpuStat), "\n") {
+            if fields := strings.Fields(line); len(fields) == 2 && fields[0] == "usage_usec" {
+                if usec, convErr := strconv.ParseInt(fields[1], 10, 64); convErr == nil {
+                    self.CpuSecs = float64(usec) / 1e6
+                }
+            }
+        }
+    }
+    if memoryPeak, err := ioutil.ReadFile(filepath.Join(cgroup, "memory.peak")); err == nil {
+        if peak, convErr := strconv.ParseInt(strings.TrimSpace(string(memoryPeak)), 10, 64); convErr == nil {
+            self.PeakMemory = peak
+        }
+    }
+    if err := os.Remove(cgroup); err != nil {
+        self.logErr("Failed to remove cgroup; err=%v\n", err)
+    }
+}
+
+// Kill every process in `cgroup` and wait for them to go away. Writing
+// `cgroup.kill` needs Linux 5.14; before that, processes are killed one by
+// one until none are left.
+func killCgroup(cgroup string) error {
+    ioutil.WriteFile(filepath.Join(cgroup, "cgroup.kill"), []byte("1"), 0644)
+    for waitedMs := 0; ; waitedMs += CGROUP_KILL_POLL_MS {
+        procs, err := ioutil.ReadFile(filepath.Join(cgroup, "cgroup.procs"))
+        if err != nil {
+            return err
+        } else if len(strings.TrimSpace(string(procs))) == 0 {
+            return nil
+        } else if waitedMs >= CGROUP_KILL_WAIT_MS {
+            return errors.New(fmt.Sprintf("Processes left in %s after %dms", cgroup, waitedMs))
+        }
+        for _, field := range strings.Fields(string(procs)) {
+            if pid, convErr := strconv.Atoi(field); convErr == nil {
+                syscall.Kill(pid, syscall.SIGKILL)
+            }
+        }
+        time.Sleep(CGROUP_KILL_POLL_MS * time.Millisecond)
+    }
+}
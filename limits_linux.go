@@ -0,0 +1,32 @@
+//go:build linux
+
+package main
+
+import (
+    "syscall"
+)
+
+const (
+    IOPRIO_WHO_PROCESS = 1
+    IOPRIO_CLASS_SHIFT = 13
+)
+
+// Rlimits that `@limit` may set on Linux only
+var platformRlimits = map[string]int{
+    "nproc": 6, // RLIMIT_NPROC
+}
+
+// Set the IO scheduling class and priority level of the calling thread via
+// ioprio_set
+func setIonice(class int, level int) error {
+    _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, IOPRIO_WHO_PROCESS, 0, uintptr(class<<IOPRIO_CLASS_SHIFT|level))
+    if errno != 0 {
+        return errno
+    }
+    return nil
+}
+
+// Return the max RSS in `rusage` in bytes. Linux reports it in KiB.
+func getMaxRssBytes(rusage *syscall.Rusage) int64 {
+    return int64(rusage.Maxrss) * 1024
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package main
+
+import (
+    "errors"
+    "syscall"
+)
+
+// Rlimits that `@limit` may set on this platform only
+var platformRlimits = map[string]int{}
+
+// ioprio_set is Linux-only, so `@ionice` is not supported here
+func setIonice(class int, level int) error {
+    return errors.New("ionice is not supported on this platform")
+}
+
+// Return the max RSS in `rusage` in bytes, as reported on macOS
+func getMaxRssBytes(rusage *syscall.Rusage) int64 {
+    return int64(rusage.Maxrss)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+    "io/ioutil"
+    "os"
+    "os/user"
+    "path/filepath"
+    "strconv"
+    "testing"
+)
+
+func TestParseLimitSize(t *testing.T) {
+    tests := []struct {
+        val       string
+        expect    uint64
+        expectErr bool
+    }{
+        {"0", 0, false},
+        {"1024", 1024, false},
+        {"4k", 4 << 10, false},
+        {"4K", 4 << 10, false},
+        {"512M", 512 << 20, false},
+        {"2G", 2 << 30, false},
+        {"1T", 1 << 40, false},
+        {"unlimited", RLIM_INFINITY, false},
+        {"max", RLIM_INFINITY, false},
+        {"", 0, true},
+        {"K", 0, true},
+        {"-1", 0, true},
+        {"1.5G", 0, true},
+        {"10X", 0, true},
+        {"1KB", 0, true},
+        {"M10", 0, true},
+    }
+    for _, test := range tests {
+        size, err := parseLimitSize(test.val)
+        if (err != nil) != test.expectErr {
+            t.Errorf("parseLimitSize(%q) err=%v, expected err %t", test.val, err, test.expectErr)
+        } else if size != test.expect {
+            t.Errorf("parseLimitSize(%q) returned %d, expected %d", test.val, size, test.expect)
+        }
+    }
+}
+
+func TestRunLimitsSetLimit(t *testing.T) {
+    tests := []struct {
+        name      string
+        val       string
+        expectErr bool
+        check     func(limits *RunLimits) bool
+    }{
+        {"memory", "1G", false, func(limits *RunLimits) bool { return limits.MemoryMax == "1073741824" }},
+        {"memory", "unlimited", false, func(limits *RunLimits) bool { return limits.MemoryMax == "max" }},
+        {"memory", "lots", true, nil},
+        {"cpu", "50%", false, func(limits *RunLimits) bool { return limits.CpuMax == "50000 100000" }},
+        {"cpu", "200%", false, func(limits *RunLimits) bool { return limits.CpuMax == "200000 100000" }},
+        {"cpu", "50", true, nil},
+        {"cpu", "0%", true, nil},
+        {"io_weight", "100", false, func(limits *RunLimits) bool { return limits.IoWeight == "default 100" }},
+        {"io_weight", "0", true, nil},
+        {"io_weight", "10001", true, nil},
+        {"nofile", "4096", false, func(limits *RunLimits) bool { return limits.Rlimits["nofile"] == 4096 }},
+        {"core", "unlimited", false, func(limits *RunLimits) bool { return limits.Rlimits["core"] == RLIM_INFINITY }},
+        {"stack", "8M", false, func(limits *RunLimits) bool { return limits.Rlimits["stack"] == 8<<20 }},
+        {"nofile", "many", true, nil},
+        {"bogus", "1", true, nil},
+    }
+    for _, test := range tests {
+        limits := newRunLimits()
+        err := limits.setLimit(test.name, test.val)
+        if (err != nil) != test.expectErr {
+            t.Errorf("setLimit(%q, %q) err=%v, expected err %t", test.name, test.val, err, test.expectErr)
+        } else if test.check != nil && !test.check(limits) {
+            t.Errorf("setLimit(%q, %q) set %+v", test.name, test.val, limits)
+        }
+        if err == nil && limits.hasCgroupLimits() != (test.name == "memory" || test.name == "cpu" || test.name == "io_weight") {
+            t.Errorf("setLimit(%q, %q) hasCgroupLimits=%t", test.name, test.val, limits.hasCgroupLimits())
+        }
+    }
+}
+
+func TestRunLimitsSetIonice(t *testing.T) {
+    tests := []struct {
+        className   string
+        level       string
+        expectErr   bool
+        expectClass int
+        expectLevel int
+    }{
+        {"best-effort", "", false, IONICE_CLASS_BEST_EFFORT, 4},
+        {"best-effort", "7", false, IONICE_CLASS_BEST_EFFORT, 7},
+        {"realtime", "0", false, IONICE_CLASS_REALTIME, 0},
+        {"idle", "", false, IONICE_CLASS_IDLE, 4},
+        {"idle", "3", true, 0, 0},
+        {"best-effort", "8", true, 0, 0},
+        {"best-effort", "high", true, 0, 0},
+    }
+    for _, test := range tests {
+        limits := newRunLimits()
+        err := limits.setIonice(test.className, test.level)
+        if (err != nil) != test.expectErr {
+            t.Errorf("setIonice(%q, %q) err=%v, expected err %t", test.className, test.level, err, test.expectErr)
+        } else if err == nil && (limits.IoniceClass != test.expectClass || limits.IoniceLevel != test.expectLevel) {
+            t.Errorf("setIonice(%q, %q) set class=%d level=%d, expected %d %d", test.className, test.level, limits.IoniceClass, limits.IoniceLevel, test.expectClass, test.expectLevel)
+        }
+    }
+}
+
+func TestLookupCredential(t *testing.T) {
+    nobody, err := user.Lookup("nobody")
+    if err != nil {
+        t.Skipf("user.Lookup err=%v", err)
+    }
+    root, err := user.LookupGroupId("0")
+    if err != nil {
+        t.Skipf("user.LookupGroupId err=%v", err)
+    }
+    tests := []struct {
+        name      string
+        userGroup string
+        expectErr bool
+        expectUid string
+        expectGid string
+    }{
+        {"user", "nobody", false, nobody.Uid, nobody.Gid},
+        {"user and group", "nobody:" + root.Name, false, nobody.Uid, "0"},
+        {"unknown user", "nosuchuser-gobashd", true, "", ""},
+        {"unknown group", "nobody:nosuchgroup-gobashd", true, "", ""},
+    }
+    for _, test := range tests {
+        credential, err := lookupCredential(test.userGroup)
+        if (err != nil) != test.expectErr {
+            t.Errorf("%s: lookupCredential err=%v, expected err %t", test.name, err, test.expectErr)
+        } else if err != nil {
+            continue
+        } else if strconv.Itoa(int(credential.Uid)) != test.expectUid || strconv.Itoa(int(credential.Gid)) != test.expectGid {
+            t.Errorf("%s: lookupCredential returned %d:%d, expected %s:%s", test.name, credential.Uid, credential.Gid, test.expectUid, test.expectGid)
+        }
+    }
+}
+
+func TestScriptRunAs(t *testing.T) {
+    if _, err := user.Lookup("nobody"); err != nil {
+        t.Skipf("user.Lookup err=%v", err)
+    }
+    tests := []struct {
+        name        string
+        source      string
+        expectErr   bool
+        expectRunAs string
+    }{
+        {"none", "echo hi\n", false, ""},
+        {"user", "# @run_as nobody\necho hi\n", false, "nobody"},
+        {"unknown user", "# @run_as nosuchuser-gobashd\necho hi\n", true, ""},
+        {"malformed", "# @run_as nobody:a:b\necho hi\n", false, ""},
+    }
+    for _, test := range tests {
+        script, err := newScript("/scripts/a.sh", []byte(test.source))
+        if (err != nil) != test.expectErr {
+            t.Errorf("%s: newScript err=%v, expected err %t", test.name, err, test.expectErr)
+        } else if err != nil {
+            continue
+        } else if script.RunAs != test.expectRunAs || (script.Credential != nil) != (test.expectRunAs != "") {
+            t.Errorf("%s: RunAs is %q with credential %v, expected %q", test.name, script.RunAs, script.Credential, test.expectRunAs)
+        }
+    }
+}
+
+func TestLoadScriptsRunAs(t *testing.T) {
+    if os.Getuid() != 0 {
+        t.Skip("Only root can make root-owned scripts")
+    } else if _, err := user.Lookup("nobody"); err != nil {
+        t.Skipf("user.Lookup err=%v", err)
+    }
+    scriptDir := t.TempDir()
+    scripts := []struct {
+        name         string
+        source       string
+        mode         os.FileMode
+        expectLoaded bool
+    }{
+        {"plain.sh", "echo hi\n", 0700, true},
+        {"readonly.sh", "# @run_as nobody\necho hi\n", 0555, true},
+        {"writable.sh", "# @run_as nobody\necho hi\n", 0755, false},
+    }
+    for _, script := range scripts {
+        path := filepath.Join(scriptDir, script.name)
+        if err := ioutil.WriteFile(path, []byte(script.source), script.mode); err != nil {
+            t.Fatalf("ioutil.WriteFile err=%v", err)
+        }
+    }
+    server := newServer()
+    server.LoadScripts(scriptDir)
+    for _, script := range scripts {
+        if _, loaded := server.Scripts[script.name]; loaded != script.expectLoaded {
+            t.Errorf("%s: loaded is %t, expected %t", script.name, loaded, script.expectLoaded)
+        }
+    }
+    if server.Metrics.ReloadOk {
+        t.Errorf("ReloadOk is true after refusing to load writable.sh")
+    }
+}
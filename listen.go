@@ -0,0 +1,137 @@
+package main
+
+import (
+    "crypto/tls"
+    "errors"
+    "fmt"
+    "net"
+    "os"
+    "os/user"
+    "strconv"
+    "strings"
+)
+
+// Credentials of the process on the other end of a unix socket
+type PeerCred struct {
+    Uid uint32
+    Gid uint32
+    Pid int32
+}
+
+// Return a string that represents this `PeerCred`
+func (self *PeerCred) String() string {
+    return fmt.Sprintf("uid=%d gid=%d pid=%d", self.Uid, self.Gid, self.Pid)
+}
+
+// Listen on `addr`. Addresses of the form `unix:<path>` listen on a unix
+// socket at `path`, replacing a stale socket if one exists, with the mode and
+// owner from `config`. Anything else is a TCP address.
+func listen(addr string) (net.Listener, error) {
+    if !strings.HasPrefix(addr, "unix:") {
+        return net.Listen("tcp", addr)
+    }
+    socketPath := strings.TrimPrefix(addr, "unix:")
+    if fileInfo, err := os.Lstat(socketPath); err == nil {
+        if fileInfo.Mode()&os.ModeSocket == 0 {
+            return nil, errors.New(fmt.Sprintf("%s exists and is not a socket", socketPath))
+        } else if err = os.Remove(socketPath); err != nil {
+            return nil, err
+        }
+    }
+    listener, err := net.Listen("unix", socketPath)
+    if err != nil {
+        return nil, err
+    }
+    if err = setupSocket(socketPath); err != nil {
+        listener.Close()
+        return nil, err
+    }
+    return listener, nil
+}
+
+// Apply `config.SocketMode` and `config.SocketOwner` to the socket at
+// `socketPath`
+func setupSocket(socketPath string) error {
+    mode, err := strconv.ParseUint(config.SocketMode, 8, 32)
+    if err != nil {
+        return errors.New(fmt.Sprintf("Invalid socket mode %s", config.SocketMode))
+    }
+    if err = os.Chmod(socketPath, os.FileMode(mode)); err != nil {
+        return err
+    }
+    if config.SocketOwner == "" {
+        return nil
+    }
+    uid, gid, err := lookupUserGroup(config.SocketOwner)
+    if err != nil {
+        return err
+    }
+    return os.Chown(socketPath, uid, gid)
+}
+
+// Look up the uid and gid of `userGroup`, formatted as `user[:group]`. If
+// `group` is omitted, the user's primary group is used.
+func lookupUserGroup(userGroup string) (int, int, error) {
+    userGroupParts := strings.SplitN(userGroup, ":", 2)
+    owner, err := user.Lookup(userGroupParts[0])
+    if err != nil {
+        return 0, 0, err
+    }
+    gidStr := owner.Gid
+    if len(userGroupParts) == 2 {
+        group, groupErr := user.LookupGroup(userGroupParts[1])
+        if groupErr != nil {
+            return 0, 0, groupErr
+        }
+        gidStr = group.Gid
+    }
+    uid, err := strconv.Atoi(owner.Uid)
+    if err != nil {
+        return 0, 0, err
+    }
+    gid, err := strconv.Atoi(gidStr)
+    if err != nil {
+        return 0, 0, err
+    }
+    return uid, gid, nil
+}
+
+// Return the `RemoteAddr` for a `Request` arriving on `conn`. Unix socket
+// peers usually have no address, so the socket path is used instead.
+func getRemoteAddr(conn net.Conn) string {
+    if tlsConn, isTls := conn.(*tls.Conn); isTls {
+        conn = tlsConn.NetConn()
+    }
+    if unixConn, isUnix := conn.(*net.UnixConn); isUnix {
+        return fmt.Sprintf("unix:%s", unixConn.LocalAddr().String())
+    }
+    return conn.RemoteAddr().String()
+}
+
+// Return the `Principal` for a unix socket peer. With an `Authenticator`, the
+// peer must match one of its entries. Without one, the peer is identified by
+// its local user name and groups.
+func getPeerCredPrincipal(authenticator Authenticator, peerCred *PeerCred) *Principal {
+    if peerCred == nil {
+        return nil
+    } else if authenticator != nil {
+        principal, err := authenticator.CheckPeerCred(peerCred)
+        if err != nil {
+            return nil
+        }
+        return principal
+    }
+    peerUser, err := user.LookupId(strconv.FormatUint(uint64(peerCred.Uid), 10))
+    if err != nil {
+        return nil
+    }
+    principal := &Principal{Name: peerUser.Username, Groups: make([]string, 0)}
+    if groupIds, groupErr := peerUser.GroupIds(); groupErr == nil {
+        for _, groupId := range groupIds {
+            if group, lookupErr := user.LookupGroupId(groupId); lookupErr == nil {
+                principal.Groups = append(principal.Groups, group.Name)
+            }
+        }
+    }
+    return principal
+}
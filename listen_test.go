@@ -0,0 +1,114 @@
+package main
+
+import (
+    "io/ioutil"
+    "net"
+    "os"
+    "os/user"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestListen(t *testing.T) {
+    defer func(mode string, owner string) { config.SocketMode, config.SocketOwner = mode, owner }(config.SocketMode, config.SocketOwner)
+    currentUser, err := user.Current()
+    if err != nil {
+        t.Fatalf("user.Current err=%v", err)
+    }
+    tests := []struct {
+        name       string
+        existing   string
+        mode       string
+        owner      string
+        expectErr  string
+        expectMode os.FileMode
+    }{
+        {"new socket", "", "0660", "", "", 0660},
+        {"stale socket", "socket", "0600", "", "", 0600},
+        {"owner", "", "0660", currentUser.Username, "", 0660},
+        {"not a socket", "file", "0660", "", "exists and is not a socket", 0},
+        {"bad mode", "", "rw", "", "Invalid socket mode", 0},
+        {"unknown owner", "", "0660", "nosuchuser-gobashd", "unknown user", 0},
+    }
+    for _, test := range tests {
+        config.SocketMode = test.mode
+        config.SocketOwner = test.owner
+        socketPath := filepath.Join(t.TempDir(), "gobashd.sock")
+        if test.existing == "socket" {
+            staleListener, listenErr := net.Listen("unix", socketPath)
+            if listenErr != nil {
+                t.Fatalf("%s: net.Listen err=%v", test.name, listenErr)
+            }
+            staleListener.(*net.UnixListener).SetUnlinkOnClose(false)
+            staleListener.Close()
+        } else if test.existing == "file" {
+            ioutil.WriteFile(socketPath, []byte("data"), 0600)
+        }
+        listener, err := listen("unix:" + socketPath)
+        if test.expectErr != "" {
+            if err == nil || !strings.Contains(err.Error(), test.expectErr) {
+                t.Errorf("%s: listen err=%v, expected %q", test.name, err, test.expectErr)
+            }
+            if listener != nil {
+                listener.Close()
+            }
+            continue
+        } else if err != nil {
+            t.Errorf("%s: listen err=%v", test.name, err)
+            continue
+        }
+        if fileInfo, statErr := os.Stat(socketPath); statErr != nil {
+            t.Errorf("%s: os.Stat err=%v", test.name, statErr)
+        } else if fileInfo.Mode().Perm() != test.expectMode {
+            t.Errorf("%s: socket mode is %o, expected %o", test.name, fileInfo.Mode().Perm(), test.expectMode)
+        }
+        conn, err := net.Dial("unix", socketPath)
+        if err != nil {
+            t.Errorf("%s: net.Dial err=%v", test.name, err)
+        } else {
+            conn.Close()
+        }
+        listener.Close()
+    }
+}
+
+func TestListenTcp(t *testing.T) {
+    listener, err := listen("127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("listen err=%v", err)
+    }
+    defer listener.Close()
+    if network := listener.Addr().Network(); network != "tcp" {
+        t.Errorf("listen on a TCP address listened on %s", network)
+    }
+}
+
+func TestLookupUserGroup(t *testing.T) {
+    currentUser, err := user.Current()
+    if err != nil {
+        t.Fatalf("user.Current err=%v", err)
+    }
+    group, err := user.LookupGroupId(currentUser.Gid)
+    if err != nil {
+        t.Fatalf("user.LookupGroupId err=%v", err)
+    }
+    tests := []struct {
+        name      string
+        userGroup string
+        expectErr bool
+    }{
+        {"user", currentUser.Username, false},
+        {"user and group", currentUser.Username + ":" + group.Name, false},
+        {"unknown user", "nosuchuser-gobashd", true},
+        {"unknown group", currentUser.Username + ":nosuchgroup-gobashd", true},
+    }
+    for _, test := range tests {
+        uid, gid, err := lookupUserGroup(test.userGroup)
+        if (err != nil) != test.expectErr {
+            t.Errorf("%s: lookupUserGroup err=%v, expected err %t", test.name, err, test.expectErr)
+        } else if err == nil && (uid != os.Getuid() || gid != os.Getgid()) {
+            t.Errorf("%s: lookupUserGroup returned %d:%d, expected %d:%d", test.name, uid, gid, os.Getuid(), os.Getgid())
+        }
+    }
+}
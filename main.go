@@ -1,10 +1,13 @@
 package main
 
 import (
+    "crypto/tls"
     "flag"
     "fmt"
     "log"
     "os"
+    "path/filepath"
+    "strings"
     "sync"
 )
 
@@ -26,6 +29,28 @@ type Config struct {
     TextprotoAddr string
     InfoLogPath   string
     ErrLogPath    string
+    StateDir      string
+    AuthPath      string
+    TlsCertPath   string
+    TlsKeyPath    string
+    TlsCaPath     string
+    TlsClientCert bool
+    SocketMode    string
+    SocketOwner   string
+    MaxRuns       int
+    CallbackKey   string
+    MetricsAddr   string
+    ShutdownWait  int
+    Admins        string
+    DetachRuns    bool
+    SuperviseDir  string
+    Interpreter   string
+    EnvClear      bool
+    EnvAllow      string
+    Cgroup        string
+    LaunchSpec    string
+    WorkdirRoot   string
+    CatArtifact   string
 }
 
 // A `HandlerFn` takes a `Request` and returns a `Response`
@@ -34,9 +59,11 @@ type HandlerFn func(*Request) *Response
 // A `ServerInterface` listens for connections at `addr`, forms a `Request`
 // based on client input, passes the `Request` to `handler` and writes the
 // resulting `Response` to the client. It should also signal `waitGroup` when
-// `Listen` exits.
+// `Listen` exits. `Shutdown` makes `Listen` stop accepting connections and
+// exit.
 type ServerInterface interface {
     Listen(addr string, handler HandlerFn, waitGroup *sync.WaitGroup)
+    Shutdown()
 }
 
 // Program entry point
@@ -45,20 +72,72 @@ func main() {
     var printVersion bool
 
     flag.StringVar(&config.ScriptDir, "d", "/etc/gobashd.d/", "Bash script directory")
-    flag.StringVar(&config.JsonAddr, "j", ":4488", "If not-empty, listen for JSON request at this address")
-    flag.StringVar(&config.TextprotoAddr, "t", ":4489", "If not-empty, listen for textproto request at this address")
+    flag.StringVar(&config.JsonAddr, "j", ":4488", "If not-empty, listen for JSON request at this address (or unix:<path>)")
+    flag.StringVar(&config.TextprotoAddr, "t", ":4489", "If not-empty, listen for textproto request at this address (or unix:<path>)")
+    flag.StringVar(&config.MetricsAddr, "m", "", "If not-empty, serve Prometheus metrics at /metrics on this address (or unix:<path>) without authentication")
     flag.StringVar(&config.InfoLogPath, "i", "", "If not-empty, write info log here instead of stdout")
     flag.StringVar(&config.ErrLogPath, "e", "", "If not-empty, write error log here instead of stderr")
+    flag.StringVar(&config.StateDir, "s", "", "If not-empty, persist run history in this state dir")
+    flag.StringVar(&config.AuthPath, "a", "", "If not-empty, require clients to authenticate with credentials in this file")
+    flag.StringVar(&config.TlsCertPath, "tls-cert", "", "If not-empty, serve TLS on both listeners with this PEM certificate")
+    flag.StringVar(&config.TlsKeyPath, "tls-key", "", "PEM private key for -tls-cert")
+    flag.StringVar(&config.TlsCaPath, "tls-ca", "", "If not-empty, verify TLS client certificates against these PEM CAs")
+    flag.BoolVar(&config.TlsClientCert, "tls-require-client-cert", false, "Reject TLS clients without a certificate verified by -tls-ca")
+    flag.StringVar(&config.SocketMode, "socket-mode", "0660", "Octal mode of unix sockets")
+    flag.StringVar(&config.SocketOwner, "socket-owner", "", "If not-empty, chown unix sockets to this user[:group]")
+    flag.StringVar(&config.Interpreter, "interpreter", "bash", "Command and args that run scripts without an @interpreter")
+    flag.BoolVar(&config.EnvClear, "env-clear", false, "Pass none of the daemon's environment vars to scripts, except those in -env-allow")
+    flag.StringVar(&config.EnvAllow, "env-allow", "", "If not-empty, pass only these comma-separated environment vars of the daemon to scripts")
+    flag.StringVar(&config.WorkdirRoot, "workdir-root", "", "Run each script in its own work dir under this dir (default: gobashd-work in the system temp dir)")
+    flag.StringVar(&config.Cgroup, "cgroup", "", "If not-empty, run each script in its own child cgroup of this delegated cgroup v2 dir, for @limit memory, cpu, and io_weight and for usage accounting")
+    flag.IntVar(&config.MaxRuns, "max-runs", 0, "If non-zero, queue runs beyond this many running at once")
+    flag.StringVar(&config.CallbackKey, "callback-key", "", "If not-empty, sign run callbacks with HMAC-SHA256 using the key in this file")
+    flag.IntVar(&config.ShutdownWait, "shutdown-wait", 0, "On SIGTERM or SIGINT, wait up to this many seconds for runs to finish before killing them")
+    flag.StringVar(&config.Admins, "admins", "", "Comma-separated principals or groups that may drain and undrain (if empty, anyone may unless -a is set, in which case no one may)")
+    flag.BoolVar(&config.DetachRuns, "detach-runs", false, "Run scripts under supervisors that outlive the daemon, and on SIGTERM or SIGINT, leave runs that are still running to them, to be reattached on restart, instead of killing them (requires -s)")
+    flag.StringVar(&config.SuperviseDir, "supervise", "", "Internal: supervise the command in the remaining args as a run with this run dir")
+    flag.StringVar(&config.LaunchSpec, "launch", "", "Internal: apply these JSON run limits, then exec the command in the remaining args")
+    flag.StringVar(&config.CatArtifact, "cat-artifact", "", "Internal: write this file, to be published as an artifact, to stdout")
     flag.BoolVar(&printVersion, "v", false, "Print version and exit")
     flag.Parse()
 
     if printVersion {
         fmt.Printf("gobashd version=%s\n", VERSION)
         return
+    } else if config.SuperviseDir != "" {
+        os.Exit(superviseRun(config.SuperviseDir, flag.Args()))
+    } else if config.LaunchSpec != "" {
+        os.Exit(launchScript(config.LaunchSpec, flag.Args()))
+    } else if config.CatArtifact != "" {
+        os.Exit(catArtifact(config.CatArtifact))
     }
 
     infoLog = log.New(os.Stdout, "[I] ", log.LstdFlags)
     errLog = log.New(os.Stderr, "[E] ", log.LstdFlags)
+    if config.DetachRuns && config.StateDir == "" {
+        errLog.Fatalf("-detach-runs requires -s\n")
+    }
+
+    // Resolve paths before chdir'ing to ScriptDir
+    for _, pathPtr := range []*string{&config.StateDir, &config.AuthPath, &config.TlsCertPath, &config.TlsKeyPath, &config.TlsCaPath, &config.CallbackKey, &config.Cgroup, &config.WorkdirRoot} {
+        if *pathPtr == "" {
+            continue
+        } else if absPath, err := filepath.Abs(*pathPtr); err != nil {
+            errLog.Fatalf("filepath.Abs failed; err=%v\n", err)
+        } else {
+            *pathPtr = absPath
+        }
+    }
+
+    for _, addrPtr := range []*string{&config.JsonAddr, &config.TextprotoAddr, &config.MetricsAddr} {
+        if !strings.HasPrefix(*addrPtr, "unix:") {
+            continue
+        } else if absPath, err := filepath.Abs(strings.TrimPrefix(*addrPtr, "unix:")); err != nil {
+            errLog.Fatalf("filepath.Abs failed; err=%v\n", err)
+        } else {
+            *addrPtr = fmt.Sprintf("unix:%s", absPath)
+        }
+    }
 
     if err := os.Chdir(config.ScriptDir); err != nil {
         errLog.Fatalf("os.Chdir failed; err=%v\n", err)
@@ -66,18 +145,71 @@ func main() {
 
     server := newServer()
     server.ReopenLogs()
+    if config.Cgroup != "" {
+        enableCgroupControllers()
+    }
+    // Restored runs may have callbacks to retry
+    if config.CallbackKey != "" {
+        server.Notifier.KeyPath = config.CallbackKey
+        if err := server.Notifier.Reload(); err != nil {
+            errLog.Fatalf("Notifier.Reload failed; err=%v\n", err)
+        }
+    }
+    if config.StateDir != "" {
+        store, err := openRunStore(config.StateDir)
+        if err != nil {
+            errLog.Fatalf("openRunStore failed; err=%v\n", err)
+        }
+        server.Store = store
+        if err = server.RestoreScriptRuns(); err != nil {
+            errLog.Fatalf("RestoreScriptRuns failed; err=%v\n", err)
+        }
+    }
     server.LoadScripts(".")
+    if config.AuthPath != "" {
+        authenticator, err := newFileAuthenticator(config.AuthPath)
+        if err != nil {
+            errLog.Fatalf("newFileAuthenticator failed; err=%v\n", err)
+        }
+        server.Authenticator = authenticator
+    }
+    var tlsConfig *tls.Config
+    if config.TlsCertPath != "" {
+        tlsLoader, err := newTlsLoader(config.TlsCertPath, config.TlsKeyPath, config.TlsCaPath, config.TlsClientCert)
+        if err != nil {
+            errLog.Fatalf("newTlsLoader failed; err=%v\n", err)
+        }
+        server.TlsLoader = tlsLoader
+        tlsConfig = tlsLoader.Config()
+    }
+
+    server.reattachRuns()
 
+    interfaces := make([]ServerInterface, 0)
     if config.JsonAddr != "" {
         waitGroup.Add(1)
-        go new(JsonServerInterface).Listen(config.JsonAddr, server.Handle, &waitGroup)
+        jsonInterface := &JsonServerInterface{authenticator: server.Authenticator, tlsConfig: tlsConfig, getStdinMaxSize: server.getStdinMaxSize}
+        interfaces = append(interfaces, jsonInterface)
+        go jsonInterface.Listen(config.JsonAddr, server.Handle, &waitGroup)
     }
     if config.TextprotoAddr != "" {
         waitGroup.Add(1)
-        go new(TextprotoServerInterface).Listen(config.TextprotoAddr, server.Handle, &waitGroup)
+        textprotoInterface := &TextprotoServerInterface{authenticator: server.Authenticator, tlsConfig: tlsConfig}
+        interfaces = append(interfaces, textprotoInterface)
+        go textprotoInterface.Listen(config.TextprotoAddr, server.Handle, &waitGroup)
+    }
+
+    if config.MetricsAddr != "" {
+        waitGroup.Add(1)
+        metricsInterface := &MetricsServerInterface{}
+        interfaces = append(interfaces, metricsInterface)
+        go metricsInterface.Listen(config.MetricsAddr, server.Handle, &waitGroup)
     }
 
     server.reloadOnHup()
+    server.shutdownOnSignal(interfaces)
+    server.runScheduler()
 
     waitGroup.Wait()
+    server.waitForShutdown()
 }
@@ -0,0 +1,14 @@
+package main
+
+import (
+    "io/ioutil"
+    "log"
+    "os"
+    "testing"
+)
+
+func TestMain(m *testing.M) {
+    infoLog = log.New(ioutil.Discard, "[I] ", log.LstdFlags)
+    errLog = log.New(ioutil.Discard, "[E] ", log.LstdFlags)
+    os.Exit(m.Run())
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+const (
+    METRICS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// Upper bounds, in seconds, of the run duration histogram buckets
+var metricsDurationBuckets = []float64{1, 5, 10, 30, 60, 300, 900, 1800, 3600, 14400}
+
+// A cumulative histogram of observed values
+type Histogram struct {
+    Counts []uint64
+    Sum    float64
+    Count  uint64
+}
+
+// `Metrics` holds counters and reload state exported by the `metrics`
+// command in the Prometheus text format. Gauges are read from the `Server`
+// when exported.
+type Metrics struct {
+    RunsStarted  map[string]uint64
+    RunsFinished map[string]uint64
+    RunsFailed   map[string]uint64
+    RunsKilled   map[string]uint64
+    RunsTimedOut map[string]uint64
+    Durations    map[string]*Histogram
+    ReloadTs     int64
+    ReloadOk     bool
+    lock         sync.Mutex
+}
+
+func newMetrics() *Metrics {
+    return &Metrics{
+        RunsStarted:  make(map[string]uint64),
+        RunsFinished: make(map[string]uint64),
+        RunsFailed:   make(map[string]uint64),
+        RunsKilled:   make(map[string]uint64),
+        RunsTimedOut: make(map[string]uint64),
+        Durations:    make(map[string]*Histogram),
+    }
+}
+
+// Count a run of `scriptName` starting
+func (self *Metrics) runStarted(scriptName string) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.RunsStarted[scriptName]++
+}
+
+// Count `scriptRun` finishing and observe its duration. A run is failed if
+// it exited non-zero. Runs that never started, e.g., ones cancelled while
+// queued, have no duration.
+func (self *Metrics) runFinished(scriptRun *ScriptRun) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    scriptName := scriptRun.Script.Name
+    self.RunsFinished[scriptName]++
+    if scriptRun.ExitCode != 0 {
+        self.RunsFailed[scriptName]++
+    }
+    if scriptRun.KillReason == KILL_REASON_KILL {
+        self.RunsKilled[scriptName]++
+    } else if scriptRun.KillReason == KILL_REASON_TIMEOUT {
+        self.RunsTimedOut[scriptName]++
+    }
+    if scriptRun.StartTs == 0 {
+        return
+    }
+    histogram := self.Durations[scriptName]
+    if histogram == nil {
+        histogram = &Histogram{Counts: make([]uint64, len(metricsDurationBuckets))}
+        self.Durations[scriptName] = histogram
+    }
+    duration := float64(scriptRun.FinishTs - scriptRun.StartTs)
+    for bucketIdx, upperBound := range metricsDurationBuckets {
+        if duration <= upperBound {
+            histogram.Counts[bucketIdx]++
+        }
+    }
+    histogram.Sum += duration
+    histogram.Count++
+}
+
+// Record the outcome of a `LoadScripts` at `ts`
+func (self *Metrics) scriptsLoaded(ts int64, ok bool) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.ReloadTs = ts
+    self.ReloadOk = ok
+}
+
+// Write per-script counter `name` with values `vals` to `metricsBuf`
+func writeMetricsCounter(metricsBuf *bytes.Buffer, name string, help string, vals map[string]uint64) {
+    metricsBuf.WriteString(fmt.Sprintf("# HELP %s %s\n# TYPE %s counter\n", name, help, name))
+    for _, scriptName := range sortedMetricsKeys(vals) {
+        metricsBuf.WriteString(fmt.Sprintf("%s{script=%s} %d\n", name, quoteMetricsLabel(scriptName), vals[scriptName]))
+    }
+}
+
+// Write gauge `name` with value `val` to `metricsBuf`
+func writeMetricsGauge(metricsBuf *bytes.Buffer, name string, help string, val int64) {
+    metricsBuf.WriteString(fmt.Sprintf("# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, val))
+}
+
+// Return the keys of `vals` in order
+func sortedMetricsKeys(vals map[string]uint64) []string {
+    keys := make([]string, 0, len(vals))
+    for key := range vals {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+// Quote `val` for use as a label value
+func quoteMetricsLabel(val string) string {
+    return fmt.Sprintf(`"%s"`, strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(val))
+}
+
+// Write counters, the duration histogram, and reload state to `metricsBuf`
+func (self *Metrics) write(metricsBuf *bytes.Buffer) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    writeMetricsCounter(metricsBuf, "gobashd_runs_started_total", "Runs started, by script.", self.RunsStarted)
+    writeMetricsCounter(metricsBuf, "gobashd_runs_finished_total", "Runs finished, by script.", self.RunsFinished)
+    writeMetricsCounter(metricsBuf, "gobashd_runs_failed_total", "Runs that exited non-zero, by script.", self.RunsFailed)
+    writeMetricsCounter(metricsBuf, "gobashd_runs_killed_total", "Runs killed by the kill command, by script.", self.RunsKilled)
+    writeMetricsCounter(metricsBuf, "gobashd_runs_timed_out_total", "Runs killed for timing out, by script.", self.RunsTimedOut)
+
+    name := "gobashd_run_duration_seconds"
+    metricsBuf.WriteString(fmt.Sprintf("# HELP %s Duration of finished runs, by script.\n# TYPE %s histogram\n", name, name))
+    scriptNames := make([]string, 0, len(self.Durations))
+    for scriptName := range self.Durations {
+        scriptNames = append(scriptNames, scriptName)
+    }
+    sort.Strings(scriptNames)
+    for _, scriptName := range scriptNames {
+        histogram := self.Durations[scriptName]
+        label := quoteMetricsLabel(scriptName)
+        for bucketIdx, upperBound := range metricsDurationBuckets {
+            metricsBuf.WriteString(fmt.Sprintf("%s_bucket{script=%s,le=\"%s\"} %d\n", name, label, strconv.FormatFloat(upperBound, 'g', -1, 64), histogram.Counts[bucketIdx]))
+        }
+        metricsBuf.WriteString(fmt.Sprintf("%s_bucket{script=%s,le=\"+Inf\"} %d\n", name, label, histogram.Count))
+        metricsBuf.WriteString(fmt.Sprintf("%s_sum{script=%s} %s\n", name, label, strconv.FormatFloat(histogram.Sum, 'g', -1, 64)))
+        metricsBuf.WriteString(fmt.Sprintf("%s_count{script=%s} %d\n", name, label, histogram.Count))
+    }
+
+    reloadOk := int64(0)
+    if self.ReloadOk {
+        reloadOk = 1
+    }
+    writeMetricsGauge(metricsBuf, "gobashd_scripts_last_reload_timestamp_seconds", "Time of the last script reload.", self.ReloadTs)
+    writeMetricsGauge(metricsBuf, "gobashd_scripts_last_reload_success", "Whether every script loaded on the last reload.", reloadOk)
+}
+
+// Return all metrics in the Prometheus text format
+func (self *Server) getMetrics() string {
+    var metricsBuf bytes.Buffer
+    self.Metrics.write(&metricsBuf)
+    var numRunning, numQueued, numRuns, numScripts int
+    draining := int64(0)
+    func() {
+        self.QueueLock.Lock()
+        defer self.QueueLock.Unlock()
+        numRunning = self.NumRunning
+        numQueued = len(self.RunQueue)
+        if self.Draining {
+            draining = 1
+        }
+    }()
+    func() {
+        self.ScriptRunsLock.Lock()
+        defer self.ScriptRunsLock.Unlock()
+        numRuns = len(self.ScriptRuns)
+    }()
+    func() {
+        self.ScriptsLock.Lock()
+        defer self.ScriptsLock.Unlock()
+        numScripts = len(self.Scripts)
+    }()
+    writeMetricsGauge(&metricsBuf, "gobashd_runs_running", "Runs currently running.", int64(numRunning))
+    writeMetricsGauge(&metricsBuf, "gobashd_runs_queued", "Runs currently queued.", int64(numQueued))
+    writeMetricsGauge(&metricsBuf, "gobashd_run_history_size", "Runs in status history.", int64(numRuns))
+    writeMetricsGauge(&metricsBuf, "gobashd_scripts_loaded", "Scripts currently loaded.", int64(numScripts))
+    writeMetricsGauge(&metricsBuf, "gobashd_draining", "Whether new runs are refused.", draining)
+    self.writeOutputMetrics(&metricsBuf)
+    return metricsBuf.String()
+}
+
+// Write the numeric outputs of unfinished runs to `metricsBuf`, gauges as
+// `gobashd_run_output` and counters as `gobashd_run_output_total`. Values are
+// summed over the runs of each script, so the metrics do not reveal run ids
+// or logids, which `-m` serves without authentication or `@allow` checks.
+func (self *Server) writeOutputMetrics(metricsBuf *bytes.Buffer) {
+    gauges := make(map[string]float64)
+    counters := make(map[string]float64)
+    func() {
+        self.ScriptRunsLock.Lock()
+        defer self.ScriptRunsLock.Unlock()
+        for _, scriptRun := range self.ScriptRuns {
+            if scriptRun.Finished {
+                continue
+            }
+            for outputIdx, outputDef := range scriptRun.Script.OutputDefs {
+                if !outputDef.isNumeric() {
+                    continue
+                }
+                var val string
+                func() {
+                    scriptRun.OutputLocks[outputIdx].Lock()
+                    defer scriptRun.OutputLocks[outputIdx].Unlock()
+                    val = scriptRun.Outputs[outputIdx].String()
+                }()
+                numVal, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+                if err != nil {
+                    continue
+                }
+                labels := fmt.Sprintf("script=%s,output=%s", quoteMetricsLabel(scriptRun.Script.Name), quoteMetricsLabel(outputDef.Name))
+                if outputDef.Type == "gauge" {
+                    gauges[labels] += numVal
+                } else {
+                    counters[labels] += numVal
+                }
+            }
+        }
+    }()
+    writeOutputMetricsFamily(metricsBuf, "gobashd_run_output", "Gauge outputs of unfinished runs, summed by script.", "gauge", gauges)
+    writeOutputMetricsFamily(metricsBuf, "gobashd_run_output_total", "Counter outputs of unfinished runs, summed by script.", "counter", counters)
+}
+
+// Write output metric `name` of type `metricType` with values `vals`, keyed
+// by labels, to `metricsBuf`
+func writeOutputMetricsFamily(metricsBuf *bytes.Buffer, name string, help string, metricType string, vals map[string]float64) {
+    metricsBuf.WriteString(fmt.Sprintf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType))
+    labelsList := make([]string, 0, len(vals))
+    for labels := range vals {
+        labelsList = append(labelsList, labels)
+    }
+    sort.Strings(labelsList)
+    for _, labels := range labelsList {
+        metricsBuf.WriteString(fmt.Sprintf("%s{%s} %s\n", name, labels, strconv.FormatFloat(vals[labels], 'g', -1, 64)))
+    }
+}
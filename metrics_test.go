@@ -0,0 +1,165 @@
+package main
+
+import (
+    "bytes"
+    "regexp"
+    "strings"
+    "sync"
+    "testing"
+)
+
+func TestMetricsRunFinished(t *testing.T) {
+    tests := []struct {
+        name         string
+        startTs      int64
+        finishTs     int64
+        exitCode     int
+        killReason   string
+        expectLines  []string
+        rejectPrefix string
+    }{
+        {"quick success", 1000, 1002, 0, "", []string{
+            `gobashd_runs_finished_total{script="a.sh"} 1`,
+            `gobashd_run_duration_seconds_bucket{script="a.sh",le="1"} 0`,
+            `gobashd_run_duration_seconds_bucket{script="a.sh",le="5"} 1`,
+            `gobashd_run_duration_seconds_sum{script="a.sh"} 2`,
+            `gobashd_run_duration_seconds_count{script="a.sh"} 1`,
+        }, `gobashd_runs_failed_total{`},
+        {"timed out", 1000, 1600, 1, KILL_REASON_TIMEOUT, []string{
+            `gobashd_runs_failed_total{script="a.sh"} 1`,
+            `gobashd_runs_timed_out_total{script="a.sh"} 1`,
+            `gobashd_run_duration_seconds_bucket{script="a.sh",le="300"} 0`,
+            `gobashd_run_duration_seconds_bucket{script="a.sh",le="900"} 1`,
+        }, `gobashd_runs_killed_total{`},
+        {"killed", 1000, 1000, -1, KILL_REASON_KILL, []string{
+            `gobashd_runs_killed_total{script="a.sh"} 1`,
+            `gobashd_run_duration_seconds_bucket{script="a.sh",le="1"} 1`,
+        }, `gobashd_runs_timed_out_total{`},
+        {"never started", 0, 1700000000, -1, "", []string{
+            `gobashd_runs_finished_total{script="a.sh"} 1`,
+            `gobashd_runs_failed_total{script="a.sh"} 1`,
+        }, `gobashd_run_duration_seconds_count{`},
+    }
+    for _, test := range tests {
+        metrics := newMetrics()
+        metrics.runFinished(&ScriptRun{
+            Script:     &Script{Name: "a.sh"},
+            StartTs:    test.startTs,
+            FinishTs:   test.finishTs,
+            ExitCode:   test.exitCode,
+            KillReason: test.killReason,
+        })
+        var metricsBuf bytes.Buffer
+        metrics.write(&metricsBuf)
+        for _, line := range test.expectLines {
+            if !strings.Contains(metricsBuf.String(), line+"\n") {
+                t.Errorf("%s: metrics lack %s", test.name, line)
+            }
+        }
+        if strings.Contains(metricsBuf.String(), test.rejectPrefix) {
+            t.Errorf("%s: metrics have %s", test.name, test.rejectPrefix)
+        }
+    }
+}
+
+func TestWriteOutputMetrics(t *testing.T) {
+    outputDefs := []ScriptDef{{Name: "rows", Type: "gauge"}, {Name: "bytes", Type: "counter"}, {Name: "msg", Type: "w"}}
+    newRun := func(id string, scriptName string, finished bool, outputs ...string) *ScriptRun {
+        scriptRun := &ScriptRun{
+            Script:      &Script{Name: scriptName, OutputDefs: outputDefs},
+            Id:          id,
+            LogId:       "logid-" + id,
+            Finished:    finished,
+            OutputLocks: make([]sync.Mutex, len(outputs)),
+        }
+        for _, output := range outputs {
+            scriptRun.Outputs = append(scriptRun.Outputs, bytes.NewBufferString(output))
+        }
+        return scriptRun
+    }
+    server := &Server{ScriptRuns: []*ScriptRun{
+        newRun("run1", "a.sh", false, "10\n", "100\n", "7"),
+        newRun("run2", "a.sh", false, "2.5\n", "", "8"),
+        newRun("run3", "a.sh", true, "1000\n", "1000\n", "9"),
+        newRun("run4", "b.sh", false, "", "5\n", ""),
+    }}
+    var metricsBuf bytes.Buffer
+    server.writeOutputMetrics(&metricsBuf)
+    expect := `# HELP gobashd_run_output Gauge outputs of unfinished runs, summed by script.
+# TYPE gobashd_run_output gauge
+gobashd_run_output{script="a.sh",output="rows"} 12.5
+# HELP gobashd_run_output_total Counter outputs of unfinished runs, summed by script.
+# TYPE gobashd_run_output_total counter
+gobashd_run_output_total{script="a.sh",output="bytes"} 100
+gobashd_run_output_total{script="b.sh",output="bytes"} 5
+`
+    if metricsBuf.String() != expect {
+        t.Errorf("Got output metrics:\n%s\nexpected:\n%s", metricsBuf.String(), expect)
+    }
+}
+
+func TestQuoteMetricsLabel(t *testing.T) {
+    tests := []struct {
+        val      string
+        expected string
+    }{
+        {"a.sh", `"a.sh"`},
+        {`say "hi".sh`, `"say \"hi\".sh"`},
+        {`back\slash`, `"back\\slash"`},
+        {"new\nline", `"new\nline"`},
+    }
+    for _, test := range tests {
+        if quoted := quoteMetricsLabel(test.val); quoted != test.expected {
+            t.Errorf("quoteMetricsLabel(%q) returned %s, expected %s", test.val, quoted, test.expected)
+        }
+    }
+}
+
+func TestGetMetrics(t *testing.T) {
+    server := newServer()
+    server.Scripts["a.sh"] = &Script{Name: "a.sh"}
+    server.Scripts["b.sh"] = &Script{Name: "b.sh"}
+    server.ScriptRuns = []*ScriptRun{{Script: server.Scripts["a.sh"], Id: "a", Finished: true}}
+    server.RunQueue = []*ScriptRun{{Script: server.Scripts["b.sh"], Id: "b"}}
+    server.NumRunning = 2
+    server.Draining = true
+    server.Metrics.runStarted("a.sh")
+    server.Metrics.runStarted("a.sh")
+    server.Metrics.runStarted(`say "hi".sh`)
+    server.Metrics.scriptsLoaded(1700000000, true)
+    metricsStr := server.getMetrics()
+    for _, line := range []string{
+        `gobashd_runs_started_total{script="a.sh"} 2`,
+        `gobashd_runs_started_total{script="say \"hi\".sh"} 1`,
+        "gobashd_runs_running 2",
+        "gobashd_runs_queued 1",
+        "gobashd_run_history_size 1",
+        "gobashd_scripts_loaded 2",
+        "gobashd_draining 1",
+        "gobashd_scripts_last_reload_timestamp_seconds 1700000000",
+        "gobashd_scripts_last_reload_success 1",
+    } {
+        if !strings.Contains(metricsStr, line+"\n") {
+            t.Errorf("metrics lack %s", line)
+        }
+    }
+
+    // Every family is declared once, before its samples
+    sampleRe := regexp.MustCompile(`^([a-z_]+?)(_bucket|_sum|_count)?(\{[^}]*\})? [0-9.e+-]+$`)
+    declared := make(map[string]bool)
+    for _, line := range strings.Split(strings.TrimSuffix(metricsStr, "\n"), "\n") {
+        if strings.HasPrefix(line, "# TYPE ") {
+            name := strings.Fields(line)[2]
+            if declared[name] {
+                t.Errorf("%s is declared twice", name)
+            }
+            declared[name] = true
+        } else if strings.HasPrefix(line, "# HELP ") {
+            continue
+        } else if matches := sampleRe.FindStringSubmatch(line); len(matches) == 0 {
+            t.Errorf("Malformed sample %q", line)
+        } else if !declared[matches[1]] && !declared[matches[1]+matches[2]] {
+            t.Errorf("Sample %q precedes its TYPE", line)
+        }
+    }
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "net/url"
+    "sync"
+    "time"
+)
+
+const (
+    CALLBACK_PENDING   = "pending"
+    CALLBACK_DELIVERED = "delivered"
+    CALLBACK_FAILED    = "failed"
+
+    NOTIFY_MAX_ATTEMPTS  = 5
+    NOTIFY_BACKOFF_SECS  = 2
+    NOTIFY_TIMEOUT_SECS  = 10
+    NOTIFY_SIGNATURE_HDR = "X-Gobashd-Signature"
+)
+
+// Delivery state of one completion callback of a `ScriptRun`
+type CallbackStatus struct {
+    Url         string
+    State       string
+    Attempts    int
+    LastError   string
+    DeliveredTs int64
+}
+
+// A `Notifier` POSTs `ScriptRunStatus`es of finished runs to callback URLs.
+// If `Key` is set, each body is signed with HMAC-SHA256 in the
+// `X-Gobashd-Signature` header as `sha256=<hex>`. Failed deliveries are
+// retried up to `MaxAttempts` times, doubling `Backoff` between attempts.
+type Notifier struct {
+    Client      *http.Client
+    KeyPath     string
+    Key         []byte
+    MaxAttempts int
+    Backoff     time.Duration
+    lock        sync.Mutex
+}
+
+// Make a `Notifier` with the default attempts, backoff, and timeout
+func newNotifier() *Notifier {
+    return &Notifier{
+        Client:      &http.Client{Timeout: NOTIFY_TIMEOUT_SECS * time.Second},
+        MaxAttempts: NOTIFY_MAX_ATTEMPTS,
+        Backoff:     NOTIFY_BACKOFF_SECS * time.Second,
+    }
+}
+
+// Return an error unless `callbackUrl` is an absolute http or https URL
+func validateCallbackUrl(callbackUrl string) error {
+    parsedUrl, err := url.Parse(callbackUrl)
+    if err != nil {
+        return errors.New(fmt.Sprintf("Invalid callback URL %s; err=%v", callbackUrl, err))
+    } else if (parsedUrl.Scheme != "http" && parsedUrl.Scheme != "https") || parsedUrl.Host == "" {
+        return errors.New(fmt.Sprintf("Invalid callback URL %s; expected http or https", callbackUrl))
+    }
+    return nil
+}
+
+// Re-read `Key` from `KeyPath`, if set. Surrounding whitespace is ignored.
+// On error, the previously loaded key remains in effect.
+func (self *Notifier) Reload() error {
+    if self.KeyPath == "" {
+        return nil
+    }
+    keyBytes, err := ioutil.ReadFile(self.KeyPath)
+    if err != nil {
+        return err
+    }
+    keyBytes = bytes.TrimSpace(keyBytes)
+    if len(keyBytes) < 1 {
+        return errors.New(fmt.Sprintf("No key found in %s", self.KeyPath))
+    }
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.Key = keyBytes
+    return nil
+}
+
+// Return the signature header value for `body`, or an empty string if there
+// is no `Key`
+func (self *Notifier) Sign(body []byte) string {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    if len(self.Key) < 1 {
+        return ""
+    }
+    mac := hmac.New(sha256.New, self.Key)
+    mac.Write(body)
+    return fmt.Sprintf("sha256=%s", hex.EncodeToString(mac.Sum(nil)))
+}
+
+// Make one attempt at POSTing `body` to `callbackUrl`. Anything but a 2xx
+// response is an error.
+func (self *Notifier) Post(callbackUrl string, body []byte) error {
+    httpReq, err := http.NewRequest("POST", callbackUrl, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    httpReq.Header.Set("Content-Type", "application/json")
+    httpReq.Header.Set("User-Agent", fmt.Sprintf("gobashd/%s", VERSION))
+    if signature := self.Sign(body); signature != "" {
+        httpReq.Header.Set(NOTIFY_SIGNATURE_HDR, signature)
+    }
+    httpResp, err := self.Client.Do(httpReq)
+    if err != nil {
+        return err
+    }
+    defer httpResp.Body.Close()
+    io.Copy(ioutil.Discard, httpResp.Body)
+    if httpResp.StatusCode < 200 || httpResp.StatusCode > 299 {
+        return errors.New(fmt.Sprintf("Callback returned status %d", httpResp.StatusCode))
+    }
+    return nil
+}
+
+// POST `body` to `callbackUrl` until it is delivered or `MaxAttempts` is
+// reached, counting `priorAttempts` already made, e.g., before a restart.
+// `onAttempt` is called after each attempt with its number and error, if any.
+func (self *Notifier) Deliver(callbackUrl string, body []byte, priorAttempts int, onAttempt func(int, error)) error {
+    err := errors.New(fmt.Sprintf("No attempts left after %d", priorAttempts))
+    backoff := self.Backoff
+    for attempt := priorAttempts + 1; attempt <= self.MaxAttempts; attempt++ {
+        err = self.Post(callbackUrl, body)
+        onAttempt(attempt, err)
+        if err == nil {
+            return nil
+        } else if attempt < self.MaxAttempts {
+            time.Sleep(backoff)
+            backoff *= 2
+        }
+    }
+    return err
+}
+
+// Deliver the final status of `scriptRun` to each of its callbacks that is
+// still pending in the background, recording delivery state in its status as
+// it goes. Callbacks restored from the `RunStore` pick up where they left off.
+func (self *Server) notifyRun(scriptRun *ScriptRun) {
+    if len(scriptRun.Callbacks) < 1 {
+        return
+    }
+    status := scriptRun.Status()
+    status.Callbacks = nil
+    body, err := json.Marshal(status)
+    if err != nil {
+        scriptRun.logErr("json.Marshal failed err=%v\n", err)
+        return
+    }
+    for callbackIdx, callback := range scriptRun.getCallbackStatii() {
+        if callback.State == CALLBACK_PENDING {
+            go self.deliverCallback(scriptRun, callbackIdx, callback.Attempts, body)
+        }
+    }
+}
+
+// Deliver `body` to the `callbackIdx`th callback of `scriptRun`, which has
+// already been attempted `priorAttempts` times
+func (self *Server) deliverCallback(scriptRun *ScriptRun, callbackIdx int, priorAttempts int, body []byte) {
+    callbackUrl := scriptRun.Callbacks[callbackIdx].Url
+    err := self.Notifier.Deliver(callbackUrl, body, priorAttempts, func(attempt int, attemptErr error) {
+        scriptRun.setCallbackState(callbackIdx, attempt, attemptErr, attempt >= self.Notifier.MaxAttempts)
+        self.saveRun(scriptRun)
+    })
+    if err != nil {
+        scriptRun.logErr("Callback to %s failed err=%v\n", callbackUrl, err)
+    } else {
+        scriptRun.logInfo("Callback to %s delivered\n", callbackUrl)
+    }
+}
+
+// Record the outcome of attempt `attempt` to deliver the `callbackIdx`th
+// callback. If `final`, a failed attempt marks the callback failed.
+func (self *ScriptRun) setCallbackState(callbackIdx int, attempt int, err error, final bool) {
+    self.callbackLock.Lock()
+    defer self.callbackLock.Unlock()
+    callback := self.Callbacks[callbackIdx]
+    callback.Attempts = attempt
+    if err == nil {
+        callback.State = CALLBACK_DELIVERED
+        callback.LastError = ""
+        callback.DeliveredTs = time.Now().Unix()
+    } else {
+        callback.LastError = err.Error()
+        if final {
+            callback.State = CALLBACK_FAILED
+        }
+    }
+}
+
+// Return a copy of the delivery state of this run's callbacks
+func (self *ScriptRun) getCallbackStatii() []*CallbackStatus {
+    self.callbackLock.Lock()
+    defer self.callbackLock.Unlock()
+    if len(self.Callbacks) < 1 {
+        return nil
+    }
+    statii := make([]*CallbackStatus, 0, len(self.Callbacks))
+    for _, callback := range self.Callbacks {
+        callbackCopy := *callback
+        statii = append(statii, &callbackCopy)
+    }
+    return statii
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "sync"
+    "testing"
+    "time"
+)
+
+// Make a `Notifier` that retries quickly
+func newTestNotifier(key string) *Notifier {
+    notifier := newNotifier()
+    notifier.Key = []byte(key)
+    notifier.Backoff = time.Millisecond
+    return notifier
+}
+
+func TestNotifierSign(t *testing.T) {
+    body := []byte(`{"Id":"abc"}`)
+    mac := hmac.New(sha256.New, []byte("s3cret"))
+    mac.Write(body)
+    expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+    if signature := newTestNotifier("s3cret").Sign(body); signature != expected {
+        t.Errorf("Sign returned %q, expected %q", signature, expected)
+    }
+    if signature := newTestNotifier("").Sign(body); signature != "" {
+        t.Errorf("Sign without a key returned %q, expected empty", signature)
+    }
+}
+
+func TestNotifierDeliver(t *testing.T) {
+    tests := []struct {
+        name          string
+        failures      int
+        priorAttempts int
+        expectErr     bool
+        expectPosts   int
+    }{
+        {"first attempt", 0, 0, false, 1},
+        {"retried", 2, 0, false, 3},
+        {"gives up", 10, 0, true, NOTIFY_MAX_ATTEMPTS},
+        {"resumed", 10, 3, true, NOTIFY_MAX_ATTEMPTS - 3},
+        {"no attempts left", 0, NOTIFY_MAX_ATTEMPTS, true, 0},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            notifier := newTestNotifier("s3cret")
+            body := []byte(`{"Id":"abc"}`)
+            var lock sync.Mutex
+            posts := 0
+            server := httptest.NewServer(http.HandlerFunc(func(httpResp http.ResponseWriter, httpReq *http.Request) {
+                lock.Lock()
+                defer lock.Unlock()
+                posts++
+                reqBody, _ := ioutil.ReadAll(httpReq.Body)
+                if string(reqBody) != string(body) {
+                    t.Errorf("Got body %q, expected %q", reqBody, body)
+                } else if signature := httpReq.Header.Get(NOTIFY_SIGNATURE_HDR); signature != notifier.Sign(body) {
+                    t.Errorf("Got signature %q, expected %q", signature, notifier.Sign(body))
+                }
+                if posts <= test.failures {
+                    httpResp.WriteHeader(500)
+                }
+            }))
+            defer server.Close()
+            attempts := make([]int, 0)
+            err := notifier.Deliver(server.URL, body, test.priorAttempts, func(attempt int, attemptErr error) {
+                attempts = append(attempts, attempt)
+            })
+            if (err != nil) != test.expectErr {
+                t.Errorf("Deliver returned err=%v, expected err %t", err, test.expectErr)
+            }
+            if posts != test.expectPosts {
+                t.Errorf("Got %d posts, expected %d", posts, test.expectPosts)
+            }
+            for idx, attempt := range attempts {
+                if attempt != test.priorAttempts+idx+1 {
+                    t.Errorf("Attempt %d numbered %d", idx, attempt)
+                }
+            }
+        })
+    }
+}
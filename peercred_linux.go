@@ -0,0 +1,35 @@
+//go:build linux
+
+package main
+
+import (
+    "crypto/tls"
+    "net"
+    "syscall"
+)
+
+// Return the `PeerCred` of a unix socket conn via SO_PEERCRED, or nil if
+// `conn` is not a unix socket
+func getPeerCred(conn net.Conn) *PeerCred {
+    if tlsConn, isTls := conn.(*tls.Conn); isTls {
+        conn = tlsConn.NetConn()
+    }
+    unixConn, isUnix := conn.(*net.UnixConn)
+    if !isUnix {
+        return nil
+    }
+    rawConn, err := unixConn.SyscallConn()
+    if err != nil {
+        errLog.Printf("unixConn.SyscallConn err=%v\n", err)
+        return nil
+    }
+    var ucred *syscall.Ucred
+    var credErr error
+    if err = rawConn.Control(func(fd uintptr) {
+        ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+    }); err != nil || credErr != nil {
+        errLog.Printf("syscall.GetsockoptUcred err=%v credErr=%v\n", err, credErr)
+        return nil
+    }
+    return &PeerCred{Uid: ucred.Uid, Gid: ucred.Gid, Pid: ucred.Pid}
+}
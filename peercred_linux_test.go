@@ -0,0 +1,61 @@
+//go:build linux
+
+package main
+
+import (
+    "net"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestGetPeerCred(t *testing.T) {
+    socketPath := filepath.Join(t.TempDir(), "gobashd.sock")
+    listener, err := net.Listen("unix", socketPath)
+    if err != nil {
+        t.Fatalf("net.Listen err=%v", err)
+    }
+    defer listener.Close()
+    accepted := make(chan net.Conn)
+    go func() {
+        conn, _ := listener.Accept()
+        accepted <- conn
+    }()
+    clientConn, err := net.Dial("unix", socketPath)
+    if err != nil {
+        t.Fatalf("net.Dial err=%v", err)
+    }
+    defer clientConn.Close()
+    serverConn := <-accepted
+    defer serverConn.Close()
+
+    peerCred := getPeerCred(serverConn)
+    if peerCred == nil {
+        t.Fatalf("getPeerCred returned nil for a unix socket")
+    } else if int(peerCred.Uid) != os.Getuid() || int(peerCred.Gid) != os.Getgid() || int(peerCred.Pid) != os.Getpid() {
+        t.Errorf("getPeerCred returned %s, expected uid=%d gid=%d pid=%d", peerCred, os.Getuid(), os.Getgid(), os.Getpid())
+    }
+    if remoteAddr := getRemoteAddr(serverConn); remoteAddr != "unix:"+socketPath {
+        t.Errorf("getRemoteAddr returned %q, expected %q", remoteAddr, "unix:"+socketPath)
+    }
+    if principal := getPeerCredPrincipal(nil, peerCred); principal == nil {
+        t.Errorf("getPeerCredPrincipal returned nil for uid %d", peerCred.Uid)
+    }
+
+    tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("net.Listen err=%v", err)
+    }
+    defer tcpListener.Close()
+    tcpConn, err := net.Dial("tcp", tcpListener.Addr().String())
+    if err != nil {
+        t.Fatalf("net.Dial err=%v", err)
+    }
+    defer tcpConn.Close()
+    if peerCred = getPeerCred(tcpConn); peerCred != nil {
+        t.Errorf("getPeerCred returned %s for a TCP conn, expected nil", peerCred)
+    } else if remoteAddr := getRemoteAddr(tcpConn); !strings.HasPrefix(remoteAddr, "127.0.0.1:") {
+        t.Errorf("getRemoteAddr returned %q for a TCP conn", remoteAddr)
+    }
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+    "net"
+)
+
+// SO_PEERCRED is Linux-only, so unix socket peers are not identified here
+func getPeerCred(conn net.Conn) *PeerCred {
+    return nil
+}
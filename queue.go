@@ -0,0 +1,138 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+)
+
+// Start `scriptRun` if the global and per-script concurrency limits and its
+// locks allow, otherwise queue it. Queued runs start in FIFO order as slots
+// and locks free up. If `scriptRun.IsSync`, wait for it to finish. If the
+// script's `LockMode` is reject and a lock is held, or wanted by a queued run,
+// mark the run rejected and return an error.
+func (self *Server) submitRun(scriptRun *ScriptRun) error {
+    var rejectErr error
+    func() {
+        self.QueueLock.Lock()
+        defer self.QueueLock.Unlock()
+        if scriptRun.Script.LockMode == "reject" {
+            for _, lockKey := range scriptRun.LockKeys {
+                if holder := self.LockHolders[lockKey]; holder != nil {
+                    rejectErr = errors.New(fmt.Sprintf("Lock %s held by ScriptRun %s", lockKey, holder.Id))
+                    return
+                } else if waiter := self.getLockWaiter(lockKey); waiter != nil {
+                    rejectErr = errors.New(fmt.Sprintf("Lock %s wanted by queued ScriptRun %s", lockKey, waiter.Id))
+                    return
+                }
+            }
+        }
+        scriptRun.State = STATE_QUEUED
+        self.RunQueue = append(self.RunQueue, scriptRun)
+        self.dispatchRuns()
+        if scriptRun.State == STATE_QUEUED {
+            scriptRun.logInfo("Queued behind %d other runs\n", len(self.RunQueue)-1)
+        }
+    }()
+    if rejectErr != nil {
+        scriptRun.ExitCode = -1
+        scriptRun.markFinished(STATE_REJECTED)
+        self.saveRun(scriptRun)
+        self.notifyRun(scriptRun)
+        return rejectErr
+    }
+    if scriptRun.IsSync {
+        <-scriptRun.Done
+    }
+    return nil
+}
+
+// Return the first queued `ScriptRun` that wants lock `lockKey`, or nil. This
+// function assumes the `QueueLock` lock is already acquired.
+func (self *Server) getLockWaiter(lockKey string) *ScriptRun {
+    for _, queuedRun := range self.RunQueue {
+        for _, queuedKey := range queuedRun.LockKeys {
+            if queuedKey == lockKey {
+                return queuedRun
+            }
+        }
+    }
+    return nil
+}
+
+// Start every queued `ScriptRun` that limits allow, in FIFO order. A run
+// that cannot start does not hold up runs of other scripts behind it. This
+// function assumes the `QueueLock` lock is already acquired.
+func (self *Server) dispatchRuns() {
+    newRunQueue := make([]*ScriptRun, 0, len(self.RunQueue))
+    for _, scriptRun := range self.RunQueue {
+        if !self.canStartRun(scriptRun) {
+            newRunQueue = append(newRunQueue, scriptRun)
+            continue
+        }
+        self.NumRunning++
+        self.NumRunningByScript[scriptRun.Script.Name]++
+        for _, lockKey := range scriptRun.LockKeys {
+            self.LockHolders[lockKey] = scriptRun
+        }
+        scriptRun.LockHolder = ""
+        scriptRun.State = STATE_PENDING
+        self.runners.Add(1)
+        go self.startRun(scriptRun)
+    }
+    self.RunQueue = newRunQueue
+}
+
+// Return whether `scriptRun` can start now. If one of its locks is held, note
+// the holder in `LockHolder`. This function assumes the `QueueLock` lock is
+// already acquired.
+func (self *Server) canStartRun(scriptRun *ScriptRun) bool {
+    for _, lockKey := range scriptRun.LockKeys {
+        if holder := self.LockHolders[lockKey]; holder != nil && holder != scriptRun {
+            scriptRun.LockHolder = holder.Id
+            return false
+        }
+    }
+    if config.MaxRuns > 0 && self.NumRunning >= config.MaxRuns {
+        return false
+    } else if scriptRun.Script.Concurrency > 0 && self.NumRunningByScript[scriptRun.Script.Name] >= scriptRun.Script.Concurrency {
+        return false
+    }
+    return true
+}
+
+// Release the slot and locks held by a finished `scriptRun` and start
+// whatever can start now
+func (self *Server) releaseRun(scriptRun *ScriptRun) {
+    self.QueueLock.Lock()
+    defer self.QueueLock.Unlock()
+    self.NumRunning--
+    self.NumRunningByScript[scriptRun.Script.Name]--
+    if self.NumRunningByScript[scriptRun.Script.Name] <= 0 {
+        delete(self.NumRunningByScript, scriptRun.Script.Name)
+    }
+    for _, lockKey := range scriptRun.LockKeys {
+        if self.LockHolders[lockKey] == scriptRun {
+            delete(self.LockHolders, lockKey)
+        }
+    }
+    self.dispatchRuns()
+}
+
+// Remove `scriptRun` from the queue and mark it cancelled. Return false if
+// it was not queued.
+func (self *Server) cancelQueuedRun(scriptRun *ScriptRun) bool {
+    self.QueueLock.Lock()
+    defer self.QueueLock.Unlock()
+    for idx, queuedRun := range self.RunQueue {
+        if queuedRun != scriptRun {
+            continue
+        }
+        self.RunQueue = append(self.RunQueue[:idx], self.RunQueue[idx+1:]...)
+        scriptRun.ExitCode = -1
+        scriptRun.markFinished(STATE_CANCELLED)
+        self.saveRun(scriptRun)
+        self.notifyRun(scriptRun)
+        return true
+    }
+    return false
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+// Make a `ScriptRun` of script `scriptName` that wants locks `lockKeys`
+func newTestQueuedRun(id string, scriptName string, lockMode string, lockKeys ...string) *ScriptRun {
+    return &ScriptRun{
+        Script:   &Script{Name: scriptName, LockMode: lockMode},
+        Id:       id,
+        LockKeys: lockKeys,
+        Done:     make(chan bool),
+    }
+}
+
+func TestCanStartRun(t *testing.T) {
+    defer func(maxRuns int) { config.MaxRuns = maxRuns }(config.MaxRuns)
+    holder := newTestQueuedRun("holder", "a.sh", "wait", "db")
+    tests := []struct {
+        name         string
+        maxRuns      int
+        concurrency  int
+        lockKeys     []string
+        expect       bool
+        expectHolder string
+    }{
+        {"free", 0, 0, nil, true, ""},
+        {"free lock", 0, 0, []string{"cache"}, true, ""},
+        {"held lock", 0, 0, []string{"cache", "db"}, false, "holder"},
+        {"max runs", 2, 0, nil, false, ""},
+        {"under max runs", 3, 0, nil, true, ""},
+        {"script concurrency", 0, 1, nil, false, ""},
+        {"under script concurrency", 0, 2, nil, true, ""},
+    }
+    for _, test := range tests {
+        server := &Server{
+            NumRunning:         2,
+            NumRunningByScript: map[string]int{"a.sh": 1, "b.sh": 1},
+            LockHolders:        map[string]*ScriptRun{"db": holder},
+        }
+        config.MaxRuns = test.maxRuns
+        scriptRun := newTestQueuedRun("run", "a.sh", "wait", test.lockKeys...)
+        scriptRun.Script.Concurrency = test.concurrency
+        if canStart := server.canStartRun(scriptRun); canStart != test.expect {
+            t.Errorf("%s: canStartRun returned %t, expected %t", test.name, canStart, test.expect)
+        } else if scriptRun.LockHolder != test.expectHolder {
+            t.Errorf("%s: LockHolder is %q, expected %q", test.name, scriptRun.LockHolder, test.expectHolder)
+        }
+    }
+
+    // A run is not blocked by locks it holds itself
+    config.MaxRuns = 0
+    server := &Server{NumRunningByScript: map[string]int{}, LockHolders: map[string]*ScriptRun{"db": holder}}
+    if !server.canStartRun(holder) {
+        t.Errorf("Holder blocked by its own lock")
+    }
+}
+
+func TestSubmitRunLocks(t *testing.T) {
+    defer func(maxRuns int) { config.MaxRuns = maxRuns }(config.MaxRuns)
+    config.MaxRuns = 1 // Keep everything queued
+    tests := []struct {
+        name        string
+        lockMode    string
+        lockKeys    []string
+        expectErr   string
+        expectState string
+    }{
+        {"reject held", "reject", []string{"db"}, "Lock db held by ScriptRun holder", STATE_REJECTED},
+        {"reject wanted", "reject", []string{"cache"}, "Lock cache wanted by queued ScriptRun waiter", STATE_REJECTED},
+        {"reject second lock", "reject", []string{"free", "cache"}, "Lock cache wanted by queued ScriptRun waiter", STATE_REJECTED},
+        {"reject free", "reject", []string{"free"}, "", STATE_QUEUED},
+        {"wait held", "wait", []string{"db"}, "", STATE_QUEUED},
+        {"wait wanted", "wait", []string{"cache"}, "", STATE_QUEUED},
+    }
+    for _, test := range tests {
+        holder := newTestQueuedRun("holder", "a.sh", "wait", "db")
+        waiter := newTestQueuedRun("waiter", "b.sh", "wait", "cache")
+        server := &Server{
+            RunQueue:           []*ScriptRun{waiter},
+            NumRunning:         1,
+            NumRunningByScript: map[string]int{"a.sh": 1},
+            LockHolders:        map[string]*ScriptRun{"db": holder},
+        }
+        scriptRun := newTestQueuedRun("run", "c.sh", test.lockMode, test.lockKeys...)
+        err := server.submitRun(scriptRun)
+        if test.expectErr == "" && err != nil {
+            t.Errorf("%s: submitRun err=%v", test.name, err)
+        } else if test.expectErr != "" && (err == nil || !strings.Contains(err.Error(), test.expectErr)) {
+            t.Errorf("%s: submitRun err=%v, expected %q", test.name, err, test.expectErr)
+        }
+        if scriptRun.State != test.expectState {
+            t.Errorf("%s: state is %s, expected %s", test.name, scriptRun.State, test.expectState)
+        }
+        inQueue := len(server.RunQueue) == 2 && server.RunQueue[1] == scriptRun
+        if inQueue != (test.expectState == STATE_QUEUED) {
+            t.Errorf("%s: queue has %d runs", test.name, len(server.RunQueue))
+        }
+    }
+}
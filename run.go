@@ -6,8 +6,10 @@ import (
     "errors"
     "fmt"
     "io"
+    "io/ioutil"
     "os"
     "os/exec"
+    "path/filepath"
     "strconv"
     "strings"
     "sync"
@@ -15,121 +17,386 @@ import (
     "time"
 )
 
+const (
+    STATE_QUEUED    = "queued"
+    STATE_PENDING   = "pending"
+    STATE_RUNNING   = "running"
+    STATE_PAUSED    = "paused"
+    STATE_FINISHED  = "finished"
+    STATE_CANCELLED = "cancelled"
+    STATE_REJECTED  = "rejected"
+    STATE_LOST      = "lost"
+
+    KILL_REASON_KILL     = "kill"
+    KILL_REASON_TIMEOUT  = "timeout"
+    KILL_REASON_SHUTDOWN = "shutdown"
+
+    READER_DRAIN_SECS = 5
+
+    // Fds of the script. Output vars follow `_timeout`, and `_artifact`
+    // follows the output vars (see `getArtifactFd`).
+    FD_STDOUT       = 1
+    FD_STDERR       = 2
+    FD_CLEAR        = 3
+    FD_TIMEOUT      = 4
+    FD_FIRST_OUTPUT = 5
+)
+
+// Signals that may be used to kill a `ScriptRun`
+var killSignalNames = map[syscall.Signal]string{
+    syscall.SIGHUP:  "HUP",
+    syscall.SIGINT:  "INT",
+    syscall.SIGQUIT: "QUIT",
+    syscall.SIGKILL: "KILL",
+    syscall.SIGUSR1: "USR1",
+    syscall.SIGUSR2: "USR2",
+    syscall.SIGTERM: "TERM",
+}
+
 type ScriptRun struct {
     *Script
     *Request
     Id           string
     LogId        string
+    ScheduleId   string
     Cmd          *exec.Cmd
+    scriptPath   string
+    Pgid         int
+    RunDir       string
+    Workdir      string
     ExitCode     int
+    CpuSecs      float64
+    PeakMemory   int64
     BashScript   string
     TimeoutSet   chan bool `json:"-"`
     TimeoutSetTs int64
     Timeout      uint64
+    PausedTs     int64
+    PausedSecs   int64
+    pausedAtSet  int64
+    pauseLock    sync.Mutex
+    KillReason   string
+    KillSignal   string
+    TermSignal   string
     Params       map[string]interface{}
+    ParamEnv     []string
     HostPort     *string
     Outputs      []*bytes.Buffer
     OutputLocks  []sync.Mutex
     ExtraPipes   []io.Closer `json:"-"`
+    writePipes   []*os.File
+    tailDone     chan bool
+    readers      sync.WaitGroup
+    followers    map[chan *RunEvent]int
+    followLock   sync.Mutex
+    Log          *RunLog `json:"-"`
     StartTs      int64
     FinishTs     int64
     Finished     bool
+    State        string
+    LockKeys     []string
+    LockHolder   string
+    Callbacks    []*CallbackStatus
+    callbackLock sync.Mutex
+    Done         chan bool `json:"-"`
     IsSync       bool
+    saveFn       func(*ScriptRun)
 }
 
 type ScriptRunStatus struct {
     ScriptName   string
     Id           string
+    LogId        string
+    ScheduleId   string
     ScriptTs     int64
     Params       map[string]string
     Outputs      map[string]string
     TimeoutSetTs int64
     StartTs      int64
     FinishTs     int64
+    PausedSecs   int64
     Finished     bool
+    State        string
     ExitCode     int
+    CpuSecs      float64
+    PeakMemory   int64
+    Workdir      string
+    KillSignal   string
+    TermSignal   string
+    Locks        []string
+    LockHolder   string
+    Callbacks    []*CallbackStatus
 }
 
 // Run a `ScriptRun`. This invokes the underlying bash script and launches
-// go routines to observe output and handle timeouts.
+// go routines to observe output and handle timeouts. If the run has a
+// `RunDir` (see `-detach-runs`), the script runs under a supervisor and its output goes through
+// files in the `RunDir` instead of pipes (see `supervise.go`).
 func (self *ScriptRun) run() {
     // Make command
-    self.makeCommand()
+    setupErr := self.makeCommand()
+    defer self.removeScriptFile()
 
-    // Make pipes
-    pipeErr := self.makePipes()
-    if pipeErr != nil {
-        // Failed to make pipes
-        errLog.Printf("makePipes failed pipeErr=%v\n", pipeErr)
+    // Make pipes, or run files if supervised
+    startAndWait := self.startAndWait
+    if setupErr == nil && self.RunDir != "" {
+        setupErr = self.makeRunFiles()
+        startAndWait = self.startAndWaitSupervised
+    } else if setupErr == nil {
+        setupErr = self.makePipes()
+    }
+    state := STATE_FINISHED
+    if setupErr != nil {
+        // Failed to make command or pipes
+        self.logErr("Failed to set up run; err=%v\n", setupErr)
+        self.ExitCode = -1
     } else {
         // Run and check exit code
-        runErr := self.runWithTimeout()
+        runErr := self.runWithTimeout(startAndWait)
         if exitErr, isExitErr := runErr.(*exec.ExitError); isExitErr {
             if status, isStatus := exitErr.Sys().(syscall.WaitStatus); isStatus {
-                self.ExitCode = status.ExitStatus()
+                self.setExitStatus(status)
             } else {
                 errLog.Printf("Unable to get ExitStatus\n")
                 self.ExitCode = 1
             }
+        } else if runErr == errRunLost {
+            self.logErr("Supervisor went away; err=%v\n", runErr)
+            self.killLostRun()
+            self.ExitCode = -1
+            state = STATE_LOST
+        } else if runErr != nil {
+            self.logErr("Run failed runErr=%v\n", runErr)
+            self.ExitCode = -1
         }
     }
+    self.finishCgroup()
+    self.cleanWorkdir(state)
 
     // Mark finished
+    self.markFinished(state)
+}
+
+// Record the exit code of the script, and the signal that terminated it if
+// any, from `status`
+func (self *ScriptRun) setExitStatus(status syscall.WaitStatus) {
+    self.ExitCode = status.ExitStatus()
+    if status.Signaled() {
+        self.TermSignal = getSignalName(status.Signal())
+    }
+}
+
+// Journal the current state of this run, if it has somewhere to go
+func (self *ScriptRun) save() {
+    if self.saveFn != nil {
+        self.saveFn(self)
+    }
+}
+
+// Mark finished with `state`, notify followers, and wake anything waiting on
+// `Done`. A stdin payload that was never fed to the script is dropped.
+func (self *ScriptRun) markFinished(state string) {
+    self.removeStdin()
+    self.pauseLock.Lock()
     self.FinishTs = time.Now().Unix()
+    if self.PausedTs > 0 {
+        self.PausedSecs += self.FinishTs - self.PausedTs
+        self.PausedTs = 0
+    }
     self.Finished = true
-    self.logInfo("Finished ExitCode=%d\n", self.ExitCode)
+    self.State = state
+    self.pauseLock.Unlock()
+    if state == STATE_FINISHED {
+        self.logInfo("Finished ExitCode=%d\n", self.ExitCode)
+    } else {
+        self.logInfo("Finished ExitCode=%d State=%s\n", self.ExitCode, state)
+    }
+    self.publishFinished()
+    close(self.Done)
+}
+
+// Make command. The script's interpreter gets the rendered script in a file,
+// as its last arg or on stdin (otherwise stdin is the request's stdin
+// payload, if any), and the environment from `getEnv`. It starts in
+// the run's work dir (see `makeWorkdir`). The command
+// is wrapped to apply the script's `RunLimits` (see `wrapLimits`).
+func (self *ScriptRun) makeCommand() error {
+    interpreter := self.Script.getInterpreter()
+    if len(interpreter) == 0 {
+        return errors.New("No interpreter")
+    } else if err := self.makeWorkdir(); err != nil {
+        return err
+    }
+    scriptFile, err := self.writeScriptFile()
+    if err != nil {
+        return err
+    }
+    args := append([]string{}, interpreter[1:]...)
+    if self.Script.InterpreterInput == "stdin" {
+        self.ExtraPipes = append(self.ExtraPipes, scriptFile)
+    } else {
+        scriptFile.Close()
+        args = append(args, scriptFile.Name())
+    }
+    self.Cmd = exec.Command(interpreter[0], args...)
+    if self.Script.InterpreterInput == "stdin" {
+        self.Cmd.Stdin = scriptFile
+    } else if stdinFile, stdinErr := self.openStdin(); stdinErr != nil {
+        return stdinErr
+    } else if stdinFile != nil {
+        self.ExtraPipes = append(self.ExtraPipes, stdinFile)
+        self.Cmd.Stdin = stdinFile
+    }
+    self.Cmd.Env = self.getEnv()
+    self.Cmd.Dir = self.Workdir
+    return self.wrapLimits()
+}
+
+// Return the environment of the script. In order, with later vars winning:
+// the daemon's environment (see `getDaemonEnv`); the script's `@env` vars;
+// `GOBASHD_PARAM_<name>` for each param; `GOBASHD_RUN_ID`, `GOBASHD_LOGID`,
+// `GOBASHD_SCRIPT`, and `GOBASHD_SCHEDULE_ID`; `GOBASHD_WORKDIR` if the run
+// has a work dir; and, unless the interpreter is a shell, the fds of
+// `_clear`, `_timeout`, `_artifact`, and output vars.
+func (self *ScriptRun) getEnv() []string {
+    env := getDaemonEnv()
+    env = append(env, self.Script.Env...)
+    env = append(env, self.ParamEnv...)
+    env = append(env, fmt.Sprintf("GOBASHD_RUN_ID=%s", self.Id))
+    env = append(env, fmt.Sprintf("GOBASHD_LOGID=%s", self.LogId))
+    env = append(env, fmt.Sprintf("GOBASHD_SCRIPT=%s", self.Script.Name))
+    env = append(env, fmt.Sprintf("GOBASHD_SCHEDULE_ID=%s", self.ScheduleId))
+    if self.Workdir != "" {
+        env = append(env, fmt.Sprintf("GOBASHD_WORKDIR=%s", self.Workdir))
+    }
+    if self.Script.hasShellInterpreter() {
+        // The fds are in shell vars (see `getFdPreamble`), which, unlike
+        // environment vars, the script's children do not inherit
+        return env
+    }
+    env = append(env, fmt.Sprintf("_clear=%d", FD_CLEAR), fmt.Sprintf("_timeout=%d", FD_TIMEOUT), fmt.Sprintf("_artifact=%d", self.getArtifactFd()))
+    for outputIdx, outputDef := range self.Script.OutputDefs {
+        env = append(env, fmt.Sprintf("%s=%d", outputDef.Name, FD_FIRST_OUTPUT+outputIdx))
+    }
+    return env
+}
+
+// Return the daemon's environment vars that scripts inherit: all of them by
+// default, or with `-env-clear` or `-env-allow`, only those named in
+// `-env-allow`
+func getDaemonEnv() []string {
+    if !config.EnvClear && config.EnvAllow == "" {
+        return os.Environ()
+    }
+    env := make([]string, 0)
+    for _, name := range strings.Split(config.EnvAllow, ",") {
+        name = strings.TrimSpace(name)
+        if val, exists := os.LookupEnv(name); name != "" && exists {
+            env = append(env, fmt.Sprintf("%s=%s", name, val))
+        }
+    }
+    return env
+}
+
+// Write the rendered script to a file, in the run dir if there is one and no
+// `@run_as`, and return it open for reading
+func (self *ScriptRun) writeScriptFile() (*os.File, error) {
+    var scriptFile *os.File
+    var err error
+    if self.RunDir != "" && self.Script.Credential == nil {
+        if err = os.MkdirAll(self.RunDir, 0700); err != nil {
+            return nil, err
+        }
+        scriptFile, err = os.OpenFile(filepath.Join(self.RunDir, "script"), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+    } else {
+        // The user of `@run_as` cannot get into the run dir
+        scriptFile, err = ioutil.TempFile("", "gobashd-script-")
+    }
+    if err != nil {
+        return nil, err
+    }
+    self.scriptPath = scriptFile.Name()
+    if self.Script.Credential != nil {
+        err = scriptFile.Chown(int(self.Script.Credential.Uid), int(self.Script.Credential.Gid))
+    }
+    if err == nil {
+        _, err = scriptFile.WriteString(self.BashScript)
+    }
+    if err == nil {
+        _, err = scriptFile.Seek(0, io.SeekStart)
+    }
+    if err != nil {
+        scriptFile.Close()
+        return nil, err
+    }
+    return scriptFile, nil
 }
 
-// Make command
-func (self *ScriptRun) makeCommand() {
-    self.Cmd = exec.Command("bash", "-c", self.BashScript) // TODO bash args
+// Remove the script file once the run is finished, unless it is in the run
+// dir, which goes away with the run dir
+func (self *ScriptRun) removeScriptFile() {
+    if self.scriptPath == "" || filepath.Dir(self.scriptPath) == self.RunDir {
+        return
+    }
+    if err := os.Remove(self.scriptPath); err != nil && !os.IsNotExist(err) {
+        self.logErr("os.Remove failed err=%v\n", err)
+    }
 }
 
 // Make and observe pipes
 func (self *ScriptRun) makePipes() error {
-    var pipeErr error
-    var readPipe io.ReadCloser
-    var writePipe io.WriteCloser
-
-    self.Cmd.ExtraFiles = make([]*os.File, 2+len(self.Outputs)) // _clear, _timeout (2) + output vars
-    for fd := 1; fd <= 4+len(self.Outputs); fd++ {              // stdout, stderr, _clear, _timeout (4) + output vars
-        if fd == 1 {
-            // stdout
-            readPipe, pipeErr = self.Cmd.StdoutPipe()
-            if pipeErr != nil {
-                return pipeErr
-            }
-        } else if fd == 2 {
-            // stderr
-            readPipe, pipeErr = self.Cmd.StderrPipe()
-            if pipeErr != nil {
-                return pipeErr
-            }
+    self.Cmd.ExtraFiles = make([]*os.File, self.getLastFd()-FD_CLEAR+1)
+    for fd := FD_STDOUT; fd <= self.getLastFd(); fd++ {
+        readPipe, writePipe, pipeErr := os.Pipe()
+        if pipeErr != nil {
+            return pipeErr
+        }
+        if fd == FD_STDOUT {
+            self.Cmd.Stdout = writePipe
+        } else if fd == FD_STDERR {
+            self.Cmd.Stderr = writePipe
         } else {
-            // _clear, _timeout, or output var
-            readPipe, writePipe, pipeErr = os.Pipe()
-            if pipeErr != nil {
-                return pipeErr
-            }
-            self.Cmd.ExtraFiles[fd-3] = writePipe.(*os.File)
-            self.ExtraPipes = append(self.ExtraPipes, readPipe)
-            self.ExtraPipes = append(self.ExtraPipes, writePipe)
+            // _clear, _timeout, _artifact, or output var
+            self.Cmd.ExtraFiles[fd-FD_CLEAR] = writePipe
         }
-        go self.readOutput(fd, readPipe) // Read pipe in go routine
+        self.ExtraPipes = append(self.ExtraPipes, readPipe)
+        self.writePipes = append(self.writePipes, writePipe)
+        self.readers.Add(1)
+        go func(fd int) { // Read pipe in go routine
+            defer self.readers.Done()
+            self.readOutput(fd, readPipe, 0)
+        }(fd)
     }
     return nil
 }
 
-// Run command until it finishes or times out
-func (self *ScriptRun) runWithTimeout() error {
+// Start command in its own process group, then wait for it to exit and for
+// its output to be read
+func (self *ScriptRun) startAndWait() error {
+    self.StartTs = time.Now().Unix()
+    self.State = STATE_RUNNING
+    self.Cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true} // Make separate process group
+    runErr := self.Cmd.Start()                                 // This runs the command
+    self.closeWritePipes()
+    if runErr == nil {
+        self.Pgid = self.Cmd.Process.Pid
+        runErr = self.Cmd.Wait()
+        if self.Cmd.ProcessState != nil {
+            self.setRusage(self.Cmd.ProcessState)
+        }
+        self.waitForReaders()
+    }
+    return runErr
+}
+
+// Run `startAndWait` until it returns or the run times out
+func (self *ScriptRun) runWithTimeout(startAndWait func() error) error {
     var runErr error
 
     // Signal `done` chan when finished
     done := make(chan bool)
     go func() {
-        self.StartTs = time.Now().Unix()
-        self.Cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true} // Make separate process group
-        runErr = self.Cmd.Run()                                    // This runs the command
+        runErr = startAndWait()
         done <- true
     }()
 
@@ -140,6 +407,10 @@ waitLoop:
         waitSecs := self.Timeout
         if waitSecs == 0 {
             waitSecs = 3600
+        } else if remainingSecs := int64(self.Timeout) - self.getTimeoutElapsed(); remainingSecs > 0 {
+            waitSecs = uint64(remainingSecs)
+        } else {
+            waitSecs = 1
         }
         select {
         case <-done:
@@ -151,10 +422,11 @@ waitLoop:
             continue waitLoop
         case <-time.After(time.Duration(waitSecs) * time.Second):
             // Maybe timed out
-            if !killed && self.Timeout > 0 && time.Now().Unix()-self.TimeoutSetTs >= int64(self.Timeout) {
+            if !killed && self.Timeout > 0 && self.getTimeoutElapsed() >= int64(self.Timeout) {
                 // Timed out!
-                self.logInfo("Timed out; sending kill signal\n")
-                self.kill()
+                self.logInfo("Timed out; terminating\n")
+                self.KillReason = KILL_REASON_TIMEOUT
+                self.kill(self.Script.getKillSignal(self.Script.KillGrace), self.Script.KillGrace)
                 killed = true
             }
         }
@@ -171,67 +443,257 @@ waitLoop:
     return runErr
 }
 
-// Kill a script run and all child processes
-func (self *ScriptRun) kill() error {
-    if self.Cmd == nil {
-        return errors.New("Cmd is nil")
-    } else if self.Cmd.Process == nil {
-        return errors.New("Cmd.Process is nil")
+// Close our copies of the write ends of the pipes. The child has its own, so
+// readers see EOF once it (and anything it forked) exits.
+func (self *ScriptRun) closeWritePipes() {
+    for _, writePipe := range self.writePipes {
+        if pipeErr := writePipe.Close(); pipeErr != nil {
+            self.logErr("writePipe.Close failed pipeErr=%v\n", pipeErr)
+        }
     }
-    pgid, err := syscall.Getpgid(self.Cmd.Process.Pid)
-    if err != nil {
+}
+
+// Wait for readers to drain the pipes. Background processes left behind by
+// the script may hold the pipes open indefinitely, so give up after
+// `READER_DRAIN_SECS`.
+func (self *ScriptRun) waitForReaders() {
+    drained := make(chan bool)
+    go func() {
+        self.readers.Wait()
+        close(drained)
+    }()
+    select {
+    case <-drained:
+    case <-time.After(READER_DRAIN_SECS * time.Second):
+        self.logErr("Gave up waiting for output pipes to drain\n")
+    }
+}
+
+// Send `sig` to a script run and all child processes. If `sig` is not
+// SIGKILL and `grace` is non-zero, send SIGKILL if the run has not finished
+// `grace` seconds later. A finished run is not signalled, since its pgid may
+// have been reused.
+func (self *ScriptRun) kill(sig syscall.Signal, grace uint64) error {
+    if self.Pgid == 0 {
+        return errors.New(fmt.Sprintf("ScriptRun %s has not started", self.Id))
+    }
+    // The script leads its own process group (see `startAndWait`), so the
+    // pgid is its pid even after it exits and leaves children behind
+    pgid := self.Pgid
+    self.pauseLock.Lock()
+    if self.Finished {
+        self.pauseLock.Unlock()
+        return errors.New(fmt.Sprintf("ScriptRun %s is %s", self.Id, self.State))
+    }
+    self.logInfo("Sending %s to process group %d\n", getSignalName(sig), pgid)
+    if err := syscall.Kill(-pgid, sig); err != nil {
+        self.pauseLock.Unlock()
+        return err
+    }
+    self.KillSignal = getSignalName(sig)
+    isPaused := self.State == STATE_PAUSED
+    self.pauseLock.Unlock()
+    if isPaused {
+        // Stopped processes only act on the signal once continued
+        if err := self.resume(); err != nil {
+            self.logErr("resume failed err=%v\n", err)
+        }
+    }
+    if sig == syscall.SIGKILL || grace == 0 {
+        return nil
+    }
+    go func() {
+        select {
+        case <-self.Done:
+        case <-time.After(time.Duration(grace) * time.Second):
+            self.pauseLock.Lock()
+            defer self.pauseLock.Unlock()
+            if self.Finished {
+                return
+            }
+            self.logInfo("Still running %d seconds after %s; sending KILL\n", grace, getSignalName(sig))
+            if err := syscall.Kill(-pgid, syscall.SIGKILL); err != nil {
+                self.logErr("syscall.Kill failed err=%v\n", err)
+            } else {
+                self.KillSignal = getSignalName(syscall.SIGKILL)
+            }
+        }
+    }()
+    return nil
+}
+
+// Stop a running script run and all child processes with SIGSTOP
+func (self *ScriptRun) pause() error {
+    self.pauseLock.Lock()
+    defer self.pauseLock.Unlock()
+    if self.State != STATE_RUNNING || self.Pgid == 0 {
+        return errors.New(fmt.Sprintf("ScriptRun %s is %s, not running", self.Id, self.State))
+    } else if err := syscall.Kill(-self.Pgid, syscall.SIGSTOP); err != nil {
         return err
     }
-    return syscall.Kill(-pgid, syscall.SIGKILL)
+    self.PausedTs = time.Now().Unix()
+    self.State = STATE_PAUSED
+    self.logInfo("Paused\n")
+    return nil
+}
+
+// Continue a paused script run and all child processes with SIGCONT
+func (self *ScriptRun) resume() error {
+    self.pauseLock.Lock()
+    defer self.pauseLock.Unlock()
+    if self.State != STATE_PAUSED {
+        return errors.New(fmt.Sprintf("ScriptRun %s is %s, not paused", self.Id, self.State))
+    } else if err := syscall.Kill(-self.Pgid, syscall.SIGCONT); err != nil {
+        return err
+    }
+    pausedSecs := time.Now().Unix() - self.PausedTs
+    self.PausedSecs += pausedSecs
+    self.PausedTs = 0
+    self.State = STATE_RUNNING
+    self.logInfo("Resumed after %d seconds\n", pausedSecs)
+    return nil
+}
+
+// Return the total seconds this run has been paused, including the current
+// pause
+func (self *ScriptRun) getPausedSecs() int64 {
+    self.pauseLock.Lock()
+    defer self.pauseLock.Unlock()
+    if self.PausedTs > 0 {
+        return self.PausedSecs + time.Now().Unix() - self.PausedTs
+    }
+    return self.PausedSecs
+}
+
+// Return the seconds counted against the timeout since it was set. Paused
+// time is left out if the script's `TimeoutPaused` is `exclude`.
+func (self *ScriptRun) getTimeoutElapsed() int64 {
+    elapsed := time.Now().Unix() - self.TimeoutSetTs
+    if self.Script.TimeoutPaused == "exclude" {
+        elapsed -= self.getPausedSecs() - self.pausedAtSet
+    }
+    return elapsed
 }
 
-// Read output from readPipe. This can be stdout, stderr, _clear or _timeout
-// input, or setting an output var.
-func (self *ScriptRun) readOutput(fd int, readPipe io.ReadCloser) {
+// Return the `syscall.Signal` named `name`, with or without a `SIG` prefix
+func parseKillSignal(name string) (syscall.Signal, error) {
+    name = strings.TrimPrefix(strings.ToUpper(name), "SIG")
+    for sig, sigName := range killSignalNames {
+        if sigName == name {
+            return sig, nil
+        }
+    }
+    return 0, errors.New(fmt.Sprintf("Unsupported signal %s", name))
+}
+
+// Return the name of `sig` without a `SIG` prefix
+func getSignalName(sig syscall.Signal) string {
+    if name, exists := killSignalNames[sig]; exists {
+        return name
+    }
+    return strconv.Itoa(int(sig))
+}
+
+// Return the fd of `_artifact`. It comes after the output vars so that their
+// fds are the same as before `_artifact` was added.
+func (self *ScriptRun) getArtifactFd() int {
+    return FD_FIRST_OUTPUT + len(self.Outputs)
+}
+
+// Return the last fd of the script, that of `_artifact`
+func (self *ScriptRun) getLastFd() int {
+    return self.getArtifactFd()
+}
+
+// Read output from readPipe. This can be stdout, stderr, _clear, _timeout, or
+// _artifact input, or setting an output var. The first `replayBytes` bytes were already
+// read before a daemon restart; they rebuild the `RunLog` and outputs, but are
+// not logged again and do not touch the timeout. A last line without a
+// trailing newline is read like any other.
+func (self *ScriptRun) readOutput(fd int, readPipe io.ReadCloser, replayBytes int64) {
     reader := bufio.NewReader(readPipe)
+    readBytes := int64(0)
     for {
         line, err := reader.ReadString('\n')
-        if err != nil {
+        if err != nil && line == "" {
             break
         }
-        if fd == 1 {
-            // stdout
-            self.logInfo("%s", line)
-        } else if fd == 2 {
-            // stderr
-            self.logErr("%s", line)
-        } else if fd == 3 {
-            // _clear
+        readBytes += int64(len(line))
+        replaying := readBytes <= replayBytes
+        if fd == FD_STDOUT {
+            if !replaying {
+                self.logInfo("%s", line)
+                self.publish(&RunEvent{Type: "stdout", Text: strings.TrimRight(line, "\n")})
+            }
+            if logErr := self.Log.Append("stdout", line); logErr != nil {
+                self.logErr("Log.Append failed logErr=%v\n", logErr)
+            }
+        } else if fd == FD_STDERR {
+            if !replaying {
+                self.logErr("%s", line)
+                self.publish(&RunEvent{Type: "stderr", Text: strings.TrimRight(line, "\n")})
+            }
+            if logErr := self.Log.Append("stderr", line); logErr != nil {
+                self.logErr("Log.Append failed logErr=%v\n", logErr)
+            }
+        } else if fd == FD_CLEAR {
             if outputIdx := self.Script.getOutputIdxByName(strings.TrimSpace(line)); outputIdx > 0 {
                 self.Outputs[outputIdx].Reset()
+                self.publish(&RunEvent{Type: "clear", Name: strings.TrimSpace(line)})
             } else {
                 self.logErr("Failed to _clear %s; no such output\n", strings.TrimSpace(line))
             }
-        } else if fd == 4 {
-            // _timeout
-            if timeoutVal, tErr := strconv.ParseUint(strings.TrimSpace(line), 10, 64); tErr == nil {
+        } else if fd == FD_TIMEOUT {
+            if replaying {
+                continue
+            } else if timeoutVal, tErr := strconv.ParseUint(strings.TrimSpace(line), 10, 64); tErr == nil {
                 self.Timeout = timeoutVal
                 self.TimeoutSetTs = time.Now().Unix()
+                self.pausedAtSet = self.getPausedSecs()
+                self.save()
                 self.TimeoutSet <- true
             } else {
                 self.logErr("Failed to set _timeout to %s\n", strings.TrimSpace(line))
             }
+        } else if fd == self.getArtifactFd() {
+            if replaying {
+                // Already published before the restart
+                continue
+            } else if artifactErr := self.addArtifact(strings.TrimSpace(line)); artifactErr != nil {
+                self.logErr("Failed to publish _artifact %s; err=%v\n", strings.TrimSpace(line), artifactErr)
+            } else {
+                self.logInfo("Published _artifact %s\n", strings.TrimSpace(line))
+                self.publish(&RunEvent{Type: "artifact", Name: filepath.Base(strings.TrimSpace(line))})
+            }
         } else {
             // output vars
-            outputIdx := fd - 5
+            outputIdx := fd - FD_FIRST_OUTPUT
             outputDef := self.Script.OutputDefs[outputIdx]
             trimLine := strings.TrimSpace(line)
+            var outputErr error
             func() {
                 self.OutputLocks[outputIdx].Lock()
                 defer self.OutputLocks[outputIdx].Unlock()
                 outputBuf := self.Outputs[outputIdx]
-                if outputDef.Type == "w" {
+                if outputDef.isNumeric() {
+                    if outputErr = outputDef.checkNumericOutput(outputBuf.String(), trimLine); outputErr != nil {
+                        return
+                    }
+                }
+                if outputDef.Type != "a" {
                     outputBuf.Reset()
                     line = trimLine
                 }
                 outputBuf.WriteString(line)
             }()
+            if outputErr != nil {
+                self.logErr("Failed to set %s to %s; err=%v\n", outputDef.Name, trimLine, outputErr)
+                continue
+            } else if replaying {
+                continue
+            }
             self.logInfo("%s: %s\n", outputDef.Name, trimLine)
+            self.publish(&RunEvent{Type: "output", Name: outputDef.Name, Text: trimLine})
         }
     }
 }
@@ -275,6 +737,9 @@ func (self *ScriptRun) getLogIdForLog() string {
 
 // Get status as string
 func (self *ScriptRun) Status() *ScriptRunStatus {
+    self.pauseLock.Lock()
+    state, finished, killSignal := self.State, self.Finished, self.KillSignal
+    self.pauseLock.Unlock()
     effectiveParams := make(map[string]string)
     for k, v := range self.Params {
         effectiveParams[k] = fmt.Sprintf("%v", v)
@@ -283,12 +748,24 @@ func (self *ScriptRun) Status() *ScriptRunStatus {
         ScriptName:   self.Script.Name,
         ScriptTs:     self.Script.ParsedTs,
         Id:           self.Id,
+        LogId:        self.LogId,
+        ScheduleId:   self.ScheduleId,
         Params:       effectiveParams,
         TimeoutSetTs: self.TimeoutSetTs,
         StartTs:      self.StartTs,
         FinishTs:     self.FinishTs,
-        Finished:     self.Finished,
+        PausedSecs:   self.getPausedSecs(),
+        Finished:     finished,
+        State:        state,
         ExitCode:     self.ExitCode,
+        CpuSecs:      self.CpuSecs,
+        PeakMemory:   self.PeakMemory,
+        Workdir:      self.Workdir,
+        KillSignal:   killSignal,
+        TermSignal:   self.TermSignal,
+        Locks:        self.LockKeys,
+        LockHolder:   self.LockHolder,
+        Callbacks:    self.getCallbackStatii(),
     }
     status.Outputs = make(map[string]string)
     for outputIdx, output := range self.Outputs {
@@ -301,21 +778,71 @@ func (self *ScriptRun) Status() *ScriptRunStatus {
     return status
 }
 
+// Get status along with what is needed to restore this `ScriptRun` from the
+// `RunStore`
+func (self *ScriptRun) Record() *RunRecord {
+    return &RunRecord{
+        ScriptRunStatus: *self.Status(),
+        BashScript:      self.BashScript,
+        Allows:          self.Script.Allows,
+        OutputDefs:      self.Script.OutputDefs,
+        KillGrace:       self.Script.KillGrace,
+        TimeoutPaused:   self.Script.TimeoutPaused,
+        Timeout:         self.Timeout,
+        PausedTs:        self.PausedTs,
+        PausedAtSet:     self.pausedAtSet,
+        ScriptPath:      self.scriptPath,
+        KeepWorkdir:     self.Script.KeepWorkdir,
+    }
+}
+
 // Return a string that represents this `ScriptRunStatus`
 func (self *ScriptRunStatus) String() string {
     var statBuf bytes.Buffer
     statBuf.WriteString(fmt.Sprintf("%s name %s\n", self.Id, self.ScriptName))
     statBuf.WriteString(fmt.Sprintf("%s id %s\n", self.Id, self.Id))
+    if self.LogId != "" {
+        statBuf.WriteString(fmt.Sprintf("%s logid %s\n", self.Id, self.LogId))
+    }
+    if self.ScheduleId != "" {
+        statBuf.WriteString(fmt.Sprintf("%s schedule_id %s\n", self.Id, self.ScheduleId))
+    }
     for key, val := range self.Params {
         statBuf.WriteString(fmt.Sprintf("%s param %s %s\n", self.Id, key, val))
     }
     for key, val := range self.Outputs {
         statBuf.WriteString(fmt.Sprintf("%s output %s %s\n", self.Id, key, val))
     }
+    for _, lockKey := range self.Locks {
+        statBuf.WriteString(fmt.Sprintf("%s lock %s\n", self.Id, lockKey))
+    }
+    if self.LockHolder != "" {
+        statBuf.WriteString(fmt.Sprintf("%s lock_holder %s\n", self.Id, self.LockHolder))
+    }
+    for _, callback := range self.Callbacks {
+        statBuf.WriteString(fmt.Sprintf("%s callback %s %s %d\n", self.Id, callback.Url, callback.State, callback.Attempts))
+    }
     statBuf.WriteString(fmt.Sprintf("%s timeout_set_ts %d\n", self.Id, self.TimeoutSetTs))
     statBuf.WriteString(fmt.Sprintf("%s start_ts %d\n", self.Id, self.StartTs))
     statBuf.WriteString(fmt.Sprintf("%s finish_ts %d\n", self.Id, self.FinishTs))
+    if self.PausedSecs > 0 || self.State == STATE_PAUSED {
+        statBuf.WriteString(fmt.Sprintf("%s paused_secs %d\n", self.Id, self.PausedSecs))
+    }
     statBuf.WriteString(fmt.Sprintf("%s finished %t\n", self.Id, self.Finished))
+    statBuf.WriteString(fmt.Sprintf("%s state %s\n", self.Id, self.State))
     statBuf.WriteString(fmt.Sprintf("%s exit_code %d\n", self.Id, self.ExitCode))
+    if self.CpuSecs > 0 || self.PeakMemory > 0 {
+        statBuf.WriteString(fmt.Sprintf("%s cpu_secs %.3f\n", self.Id, self.CpuSecs))
+        statBuf.WriteString(fmt.Sprintf("%s peak_memory_bytes %d\n", self.Id, self.PeakMemory))
+    }
+    if self.KillSignal != "" {
+        statBuf.WriteString(fmt.Sprintf("%s kill_signal %s\n", self.Id, self.KillSignal))
+    }
+    if self.TermSignal != "" {
+        statBuf.WriteString(fmt.Sprintf("%s term_signal %s\n", self.Id, self.TermSignal))
+    }
+    if self.Workdir != "" {
+        statBuf.WriteString(fmt.Sprintf("%s workdir %s\n", self.Id, self.Workdir))
+    }
     return statBuf.String()
 }
@@ -0,0 +1,334 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "os/exec"
+    "strings"
+    "sync"
+    "syscall"
+    "testing"
+    "time"
+)
+
+func TestParseKillSignal(t *testing.T) {
+    tests := []struct {
+        name      string
+        expect    syscall.Signal
+        expectErr bool
+    }{
+        {"TERM", syscall.SIGTERM, false},
+        {"SIGTERM", syscall.SIGTERM, false},
+        {"sigkill", syscall.SIGKILL, false},
+        {"int", syscall.SIGINT, false},
+        {"HUP", syscall.SIGHUP, false},
+        {"USR1", syscall.SIGUSR1, false},
+        {"SIGUSR2", syscall.SIGUSR2, false},
+        {"QUIT", syscall.SIGQUIT, false},
+        {"STOP", 0, true},
+        {"9", 0, true},
+        {"", 0, true},
+        {"SIG", 0, true},
+    }
+    for _, test := range tests {
+        sig, err := parseKillSignal(test.name)
+        if (err != nil) != test.expectErr {
+            t.Errorf("parseKillSignal(%q) err=%v, expected err %t", test.name, err, test.expectErr)
+        } else if sig != test.expect {
+            t.Errorf("parseKillSignal(%q) returned %v, expected %v", test.name, sig, test.expect)
+        }
+    }
+}
+
+func TestGetSignalName(t *testing.T) {
+    tests := []struct {
+        sig    syscall.Signal
+        expect string
+    }{
+        {syscall.SIGTERM, "TERM"},
+        {syscall.SIGKILL, "KILL"},
+        {syscall.SIGSEGV, "11"},
+    }
+    for _, test := range tests {
+        if name := getSignalName(test.sig); name != test.expect {
+            t.Errorf("getSignalName(%d) returned %q, expected %q", int(test.sig), name, test.expect)
+        }
+        if sig, err := parseKillSignal(getSignalName(test.sig)); err == nil && sig != test.sig {
+            t.Errorf("parseKillSignal(getSignalName(%d)) returned %d", int(test.sig), int(sig))
+        }
+    }
+}
+
+// Start `script` in its own process group and return its command
+func startTestProcessGroup(t *testing.T, script string) *exec.Cmd {
+    cmd := exec.Command("sh", "-c", script)
+    cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+    if err := cmd.Start(); err != nil {
+        t.Fatalf("cmd.Start err=%v", err)
+    }
+    return cmd
+}
+
+func TestScriptRunKill(t *testing.T) {
+    tests := []struct {
+        name         string
+        script       string
+        finished     bool
+        sig          syscall.Signal
+        grace        uint64
+        expectErr    bool
+        expectSignal string
+    }{
+        {"term", "sleep 10", false, syscall.SIGTERM, 0, false, "TERM"},
+        {"kill", "sleep 10", false, syscall.SIGKILL, 5, false, "KILL"},
+        {"kill after grace", "trap '' TERM; sleep 10", false, syscall.SIGTERM, 1, false, "KILL"},
+        {"finished", "sleep 10", true, syscall.SIGKILL, 0, true, ""},
+    }
+    for _, test := range tests {
+        cmd := startTestProcessGroup(t, test.script)
+        exited := make(chan bool)
+        go func() {
+            cmd.Wait()
+            close(exited)
+        }()
+        time.Sleep(100 * time.Millisecond) // Let `trap` run
+        scriptRun := &ScriptRun{
+            Script:   &Script{Name: "a.sh"},
+            Id:       "abc",
+            Pgid:     cmd.Process.Pid,
+            Finished: test.finished,
+            State:    STATE_RUNNING,
+            Done:     make(chan bool),
+        }
+        err := scriptRun.kill(test.sig, test.grace)
+        if (err != nil) != test.expectErr {
+            t.Errorf("%s: kill err=%v, expected err %t", test.name, err, test.expectErr)
+        }
+        select {
+        case <-exited:
+            if test.expectErr {
+                t.Errorf("%s: process group of a finished run was killed", test.name)
+            }
+        case <-time.After(time.Duration(test.grace)*time.Second + 500*time.Millisecond):
+            if !test.expectErr {
+                t.Errorf("%s: process group still running", test.name)
+            }
+            syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+            <-exited
+        }
+        if status := scriptRun.Status(); status.KillSignal != test.expectSignal {
+            t.Errorf("%s: KillSignal is %q, expected %q", test.name, status.KillSignal, test.expectSignal)
+        }
+        close(scriptRun.Done)
+    }
+}
+
+func TestReadOutput(t *testing.T) {
+    tests := []struct {
+        name       string
+        outputType string
+        written    string
+        expected   string
+    }{
+        {"append", "a", "x\ny\n", "x\ny\n"},
+        {"overwrite", "w", "x\n y \n", "y"},
+        {"gauge", "gauge", "5\n2.5\n", "2.5"},
+        {"gauge rejects text", "gauge", "5\nlots\n", "5"},
+        {"counter", "counter", "1\n3\n", "3"},
+        {"counter rejects decrease", "counter", "3\n1\n4\n", "4"},
+        {"counter rejects negative", "counter", "-1\n", ""},
+    }
+    for _, test := range tests {
+        scriptRun := &ScriptRun{
+            Script:      &Script{Name: "a.sh", OutputDefs: []ScriptDef{{Name: "v", Type: test.outputType}}},
+            Id:          "abc",
+            Outputs:     []*bytes.Buffer{new(bytes.Buffer)},
+            OutputLocks: make([]sync.Mutex, 1),
+        }
+        scriptRun.readOutput(FD_FIRST_OUTPUT, ioutil.NopCloser(strings.NewReader(test.written)), 0)
+        if val := scriptRun.Outputs[0].String(); val != test.expected {
+            t.Errorf("%s: output is %q, expected %q", test.name, val, test.expected)
+        }
+    }
+}
+
+// Return the state letter of process `pid` from /proc, e.g., T if stopped
+func getTestProcState(t *testing.T, pid int) string {
+    statBytes, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+    if err != nil {
+        t.Fatalf("ioutil.ReadFile err=%v", err)
+    }
+    fields := strings.Fields(string(statBytes[bytes.LastIndexByte(statBytes, ')')+1:]))
+    return fields[0]
+}
+
+func TestScriptRunPause(t *testing.T) {
+    cmd := startTestProcessGroup(t, "sleep 10")
+    defer func() {
+        syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+        cmd.Wait()
+    }()
+    scriptRun := &ScriptRun{
+        Script: &Script{Name: "a.sh"},
+        Id:     "abc",
+        Pgid:   cmd.Process.Pid,
+        State:  STATE_RUNNING,
+    }
+    tests := []struct {
+        name        string
+        pause       bool
+        expectErr   bool
+        expectState string
+        expectProc  string
+    }{
+        {"resume running", false, true, STATE_RUNNING, "S"},
+        {"pause", true, false, STATE_PAUSED, "T"},
+        {"pause paused", true, true, STATE_PAUSED, "T"},
+        {"resume", false, false, STATE_RUNNING, "S"},
+        {"pause again", true, false, STATE_PAUSED, "T"},
+        {"resume again", false, false, STATE_RUNNING, "S"},
+    }
+    for _, test := range tests {
+        var err error
+        if test.pause {
+            err = scriptRun.pause()
+        } else {
+            err = scriptRun.resume()
+        }
+        if (err != nil) != test.expectErr {
+            t.Errorf("%s: err=%v, expected err %t", test.name, err, test.expectErr)
+        } else if scriptRun.State != test.expectState {
+            t.Errorf("%s: State is %s, expected %s", test.name, scriptRun.State, test.expectState)
+        }
+        time.Sleep(50 * time.Millisecond) // Let the signal land
+        if procState := getTestProcState(t, cmd.Process.Pid); procState != test.expectProc {
+            t.Errorf("%s: process state is %s, expected %s", test.name, procState, test.expectProc)
+        }
+    }
+    if scriptRun.PausedTs != 0 {
+        t.Errorf("PausedTs is %d after resuming, expected 0", scriptRun.PausedTs)
+    }
+
+    for _, state := range []string{STATE_PENDING, STATE_FINISHED} {
+        otherRun := &ScriptRun{Id: "def", Pgid: cmd.Process.Pid, State: state}
+        if err := otherRun.pause(); err == nil {
+            t.Errorf("Pausing a %s run succeeded", state)
+        }
+    }
+}
+
+func TestGetTimeoutElapsed(t *testing.T) {
+    now := time.Now().Unix()
+    tests := []struct {
+        name          string
+        timeoutPaused string
+        pausedSecs    int64
+        pausedTs      int64
+        pausedAtSet   int64
+        expected      int64
+    }{
+        {"never paused", "include", 0, 0, 0, 100},
+        {"include", "include", 20, now - 30, 0, 100},
+        {"exclude", "exclude", 20, 0, 0, 80},
+        {"exclude while paused", "exclude", 20, now - 30, 0, 50},
+        {"exclude paused before set", "exclude", 20, 0, 15, 95},
+    }
+    for _, test := range tests {
+        scriptRun := &ScriptRun{
+            Script:       &Script{Name: "a.sh", TimeoutPaused: test.timeoutPaused},
+            TimeoutSetTs: now - 100,
+            PausedSecs:   test.pausedSecs,
+            PausedTs:     test.pausedTs,
+            pausedAtSet:  test.pausedAtSet,
+        }
+        if elapsed := scriptRun.getTimeoutElapsed(); elapsed < test.expected || elapsed > test.expected+1 {
+            t.Errorf("%s: getTimeoutElapsed returned %d, expected %d", test.name, elapsed, test.expected)
+        }
+    }
+}
+
+func TestGetDaemonEnv(t *testing.T) {
+    defer func(clear bool, allow string) { config.EnvClear, config.EnvAllow = clear, allow }(config.EnvClear, config.EnvAllow)
+    t.Setenv("GOBASHD_TEST_A", "1")
+    t.Setenv("GOBASHD_TEST_B", "two words")
+    t.Setenv("GOBASHD_TEST_EMPTY", "")
+    tests := []struct {
+        name      string
+        envClear  bool
+        envAllow  string
+        expectAll bool
+        expectEnv string
+    }{
+        {"inherit all", false, "", true, ""},
+        {"clear", true, "", false, ""},
+        {"allow", false, "GOBASHD_TEST_A", false, "GOBASHD_TEST_A=1"},
+        {"clear and allow", true, " GOBASHD_TEST_B , GOBASHD_TEST_A", false, "GOBASHD_TEST_B=two words|GOBASHD_TEST_A=1"},
+        {"allow empty and unset", false, "GOBASHD_TEST_EMPTY,GOBASHD_TEST_UNSET,,", false, "GOBASHD_TEST_EMPTY="},
+    }
+    for _, test := range tests {
+        config.EnvClear = test.envClear
+        config.EnvAllow = test.envAllow
+        env := getDaemonEnv()
+        if test.expectAll {
+            if len(env) != len(os.Environ()) {
+                t.Errorf("%s: getDaemonEnv returned %d vars, expected %d", test.name, len(env), len(os.Environ()))
+            }
+        } else if joined := strings.Join(env, "|"); joined != test.expectEnv {
+            t.Errorf("%s: getDaemonEnv returned %q, expected %q", test.name, joined, test.expectEnv)
+        }
+    }
+}
+
+func TestScriptRunGetEnv(t *testing.T) {
+    defer func(clear bool, allow string) { config.EnvClear, config.EnvAllow = clear, allow }(config.EnvClear, config.EnvAllow)
+    config.EnvClear = true
+    config.EnvAllow = "GOBASHD_TEST_A"
+    t.Setenv("GOBASHD_TEST_A", "daemon")
+    source := "# @interpreter /usr/bin/python3\n# @param n int `1` n\n# @output rows w\n# @env GOBASHD_TEST_A=script\n# @env MODE=fast lane\nprint(1)\n"
+    script, err := newScript("/scripts/a.py", []byte(source))
+    if err != nil {
+        t.Fatalf("newScript err=%v", err)
+    }
+    paramEnv, err := script.getParamEnv(map[string]string{"n": "5"})
+    if err != nil {
+        t.Fatalf("getParamEnv err=%v", err)
+    }
+    scriptRun := &ScriptRun{
+        Script:     script,
+        Id:         "abc",
+        LogId:      "log1",
+        ScheduleId: "nightly",
+        Workdir:    "/tmp/work",
+        ParamEnv:   paramEnv,
+        Outputs:    make([]*bytes.Buffer, 1),
+    }
+    expected := []string{
+        "GOBASHD_TEST_A=daemon",
+        "GOBASHD_TEST_A=script",
+        "MODE=fast lane",
+        "GOBASHD_PARAM_n=5",
+        "GOBASHD_RUN_ID=abc",
+        "GOBASHD_LOGID=log1",
+        "GOBASHD_SCRIPT=a.py",
+        "GOBASHD_SCHEDULE_ID=nightly",
+        "GOBASHD_WORKDIR=/tmp/work",
+        "_clear=3",
+        "_timeout=4",
+        "_artifact=6",
+        "rows=5",
+    }
+    if env := strings.Join(scriptRun.getEnv(), "|"); env != strings.Join(expected, "|") {
+        t.Errorf("getEnv returned %q, expected %q", env, strings.Join(expected, "|"))
+    }
+
+    // The last of duplicate vars wins, so @env overrides the daemon's
+    cmd := exec.Command("sh", "-c", "printf %s \"$GOBASHD_TEST_A\"")
+    cmd.Env = scriptRun.getEnv()
+    if out, cmdErr := cmd.Output(); cmdErr != nil {
+        t.Errorf("cmd.Output err=%v", cmdErr)
+    } else if string(out) != "script" {
+        t.Errorf("GOBASHD_TEST_A is %q in the script, expected %q", out, "script")
+    }
+}
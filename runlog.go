@@ -0,0 +1,187 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+)
+
+const (
+    RUN_LOG_MAX_MEM = 64 * 1024
+)
+
+// A `RunLog` captures the stdout and stderr lines of a `ScriptRun`. Lines are
+// kept in memory until they exceed `RUN_LOG_MAX_MEM` bytes, after which they
+// are spilled to a per-run file and all further lines are appended there.
+type RunLog struct {
+    Path     string
+    lines    []RunLogLine
+    memBytes int
+    spilled  bool
+    file     *os.File
+    lock     sync.Mutex
+}
+
+type RunLogLine struct {
+    Stream string
+    Text   string
+}
+
+// Return the dir in which `RunLog` files are spilled. This is under the state
+// dir if there is one so that logs survive restarts.
+func runLogDir() string {
+    if config.StateDir != "" {
+        return filepath.Join(config.StateDir, "logs")
+    }
+    return filepath.Join(os.TempDir(), "gobashd-logs")
+}
+
+// Make an empty `RunLog` for the run with id `id`. If a spill file already
+// exists for `id` (e.g., for a run restored from the `RunStore`), it is used.
+func newRunLog(id string) *RunLog {
+    runLog := &RunLog{
+        Path:  filepath.Join(runLogDir(), fmt.Sprintf("%s.log", id)),
+        lines: make([]RunLogLine, 0),
+    }
+    if _, err := os.Stat(runLog.Path); err == nil {
+        runLog.spilled = true
+    }
+    return runLog
+}
+
+// Append a line of output from `stream`
+func (self *RunLog) Append(stream string, text string) error {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    text = strings.TrimRight(text, "\n")
+    if self.spilled {
+        return self.writeLine(RunLogLine{Stream: stream, Text: text})
+    }
+    self.lines = append(self.lines, RunLogLine{Stream: stream, Text: text})
+    self.memBytes += len(text)
+    if self.memBytes > RUN_LOG_MAX_MEM {
+        return self.spill()
+    }
+    return nil
+}
+
+// Write all in-memory lines to the spill file. Further lines go straight to
+// the file.
+func (self *RunLog) Spill() error {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    return self.spill()
+}
+
+// Close the spill file if it is open
+func (self *RunLog) Close() error {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    if self.file == nil {
+        return nil
+    }
+    err := self.file.Close()
+    self.file = nil
+    return err
+}
+
+// Close and delete the spill file
+func (self *RunLog) Remove() error {
+    self.Close()
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    if !self.spilled {
+        return nil
+    }
+    if err := os.Remove(self.Path); err != nil && !os.IsNotExist(err) {
+        return err
+    }
+    return nil
+}
+
+// Return up to `limit` lines from `stream` ("stdout", "stderr", or "both")
+// after skipping the first `offset` of them. A `limit` of 0 means no limit.
+func (self *RunLog) Read(stream string, offset uint64, limit uint64) ([]RunLogLine, error) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    matched := uint64(0)
+    lines := make([]RunLogLine, 0)
+    addLine := func(line RunLogLine) bool {
+        if stream != "both" && line.Stream != stream {
+            return true
+        }
+        matched++
+        if matched <= offset {
+            return true
+        }
+        lines = append(lines, line)
+        return limit == 0 || uint64(len(lines)) < limit
+    }
+    if !self.spilled {
+        for _, line := range self.lines {
+            if !addLine(line) {
+                break
+            }
+        }
+        return lines, nil
+    }
+    file, err := os.Open(self.Path)
+    if os.IsNotExist(err) {
+        // Spilled before any lines were written
+        return lines, nil
+    } else if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+    reader := bufio.NewReader(file)
+    for {
+        rawLine, readErr := reader.ReadString('\n')
+        if readErr == io.EOF {
+            break
+        } else if readErr != nil {
+            return nil, readErr
+        }
+        streamText := strings.SplitN(strings.TrimRight(rawLine, "\n"), " ", 2)
+        if len(streamText) != 2 {
+            continue
+        }
+        if !addLine(RunLogLine{Stream: streamText[0], Text: streamText[1]}) {
+            break
+        }
+    }
+    return lines, nil
+}
+
+// Spill lines to file. This function assumes `lock` is already acquired.
+func (self *RunLog) spill() error {
+    self.spilled = true
+    for _, line := range self.lines {
+        if err := self.writeLine(line); err != nil {
+            return err
+        }
+    }
+    self.lines = self.lines[:0]
+    self.memBytes = 0
+    return nil
+}
+
+// Write `line` to the spill file, opening it first if needed. This function
+// assumes `lock` is already acquired.
+func (self *RunLog) writeLine(line RunLogLine) error {
+    if self.file == nil {
+        if err := os.MkdirAll(filepath.Dir(self.Path), 0700); err != nil {
+            return err
+        }
+        file, err := os.OpenFile(self.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+        if err != nil {
+            return err
+        }
+        self.file = file
+    }
+    _, err := fmt.Fprintf(self.file, "%s %s\n", line.Stream, line.Text)
+    return err
+}
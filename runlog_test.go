@@ -0,0 +1,105 @@
+package main
+
+import (
+    "os"
+    "strings"
+    "testing"
+)
+
+func TestRunLogSpill(t *testing.T) {
+    defer func(stateDir string) { config.StateDir = stateDir }(config.StateDir)
+    big := strings.Repeat("x", RUN_LOG_MAX_MEM/2)
+    tests := []struct {
+        name          string
+        texts         []string
+        expectSpilled bool
+    }{
+        {"empty", nil, false},
+        {"small", []string{"a", "b\n", "c"}, false},
+        {"at limit", []string{big, big}, false},
+        {"over limit", []string{big, big, "c"}, true},
+        {"after spill", []string{big, big + "x", "c", "d"}, true},
+    }
+    for _, test := range tests {
+        config.StateDir = t.TempDir()
+        runLog := newRunLog("abc")
+        streams := []string{"stdout", "stderr"}
+        for idx, text := range test.texts {
+            if err := runLog.Append(streams[idx%2], text); err != nil {
+                t.Fatalf("%s: Append err=%v", test.name, err)
+            }
+        }
+        _, statErr := os.Stat(runLog.Path)
+        if runLog.spilled != test.expectSpilled || (statErr == nil) != test.expectSpilled {
+            t.Errorf("%s: spilled is %t (stat err=%v), expected %t", test.name, runLog.spilled, statErr, test.expectSpilled)
+        }
+        if !test.expectSpilled && runLog.memBytes > RUN_LOG_MAX_MEM {
+            t.Errorf("%s: %d bytes in memory, more than %d", test.name, runLog.memBytes, RUN_LOG_MAX_MEM)
+        }
+        lines, err := runLog.Read("both", 0, 0)
+        if err != nil {
+            t.Fatalf("%s: Read err=%v", test.name, err)
+        } else if len(lines) != len(test.texts) {
+            t.Errorf("%s: Read returned %d lines, expected %d", test.name, len(lines), len(test.texts))
+        }
+        for idx, line := range lines {
+            if expected := strings.TrimRight(test.texts[idx], "\n"); line.Text != expected || line.Stream != streams[idx%2] {
+                t.Errorf("%s: line %d is %s %.10q, expected %s %.10q", test.name, idx, line.Stream, line.Text, streams[idx%2], expected)
+            }
+        }
+        if err = runLog.Remove(); err != nil {
+            t.Errorf("%s: Remove err=%v", test.name, err)
+        } else if _, err = os.Stat(runLog.Path); !os.IsNotExist(err) {
+            t.Errorf("%s: spill file left after Remove", test.name)
+        }
+    }
+}
+
+func TestRunLogRead(t *testing.T) {
+    defer func(stateDir string) { config.StateDir = stateDir }(config.StateDir)
+    config.StateDir = t.TempDir()
+    tests := []struct {
+        name       string
+        stream     string
+        offset     uint64
+        limit      uint64
+        expectText string
+    }{
+        {"both", "both", 0, 0, "o1 e1 o2 e2 o3"},
+        {"stdout", "stdout", 0, 0, "o1 o2 o3"},
+        {"stderr", "stderr", 0, 0, "e1 e2"},
+        {"offset", "stdout", 1, 0, "o2 o3"},
+        {"limit", "both", 0, 2, "o1 e1"},
+        {"offset and limit", "both", 2, 2, "o2 e2"},
+        {"offset past end", "stderr", 5, 0, ""},
+    }
+    for _, spilled := range []bool{false, true} {
+        runLog := newRunLog("abc")
+        for _, text := range []string{"o1", "e1", "o2", "e2", "o3"} {
+            stream := "stdout"
+            if text[0] == 'e' {
+                stream = "stderr"
+            }
+            runLog.Append(stream, text)
+        }
+        if spilled {
+            if err := runLog.Spill(); err != nil {
+                t.Fatalf("Spill err=%v", err)
+            }
+        }
+        for _, test := range tests {
+            lines, err := runLog.Read(test.stream, test.offset, test.limit)
+            if err != nil {
+                t.Fatalf("%s: Read err=%v", test.name, err)
+            }
+            texts := make([]string, 0, len(lines))
+            for _, line := range lines {
+                texts = append(texts, line.Text)
+            }
+            if text := strings.Join(texts, " "); text != test.expectText {
+                t.Errorf("%s (spilled %t): Read returned %q, expected %q", test.name, spilled, text, test.expectText)
+            }
+        }
+        runLog.Remove()
+    }
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "sort"
+    "strings"
+    "time"
+)
+
+// A `ScriptSchedule` runs a `Script` with fixed params whenever its
+// `CronSpec` matches. `Overlap` decides what happens when the previous run
+// from the same schedule is still going: `skip` (the default) skips the new
+// run, `queue` queues it until the previous run finishes.
+type ScriptSchedule struct {
+    Id      string
+    Spec    *CronSpec
+    Params  map[string]string
+    Overlap string
+}
+
+type ScheduleStatus struct {
+    Id         string
+    ScriptName string
+    Expr       string
+    Params     map[string]string
+    Overlap    string
+    NextTs     int64
+}
+
+// Make the `idx`th `ScriptSchedule` of script `scriptName` out of cron
+// expression `expr` and `key=val` args `paramStr`. The special param
+// `_overlap` sets `Overlap`.
+func newScriptSchedule(scriptName string, idx int, expr string, paramStr string) (*ScriptSchedule, error) {
+    spec, err := parseCronSpec(expr)
+    if err != nil {
+        return nil, err
+    }
+    schedule := &ScriptSchedule{
+        Id:      fmt.Sprintf("%s:%d", scriptName, idx),
+        Spec:    spec,
+        Params:  make(map[string]string),
+        Overlap: "skip",
+    }
+    for _, paramArg := range strings.Fields(paramStr) {
+        keyVal := strings.SplitN(paramArg, "=", 2)
+        if len(keyVal) != 2 {
+            return nil, errors.New(fmt.Sprintf("Invalid schedule param %s; expected key=val", paramArg))
+        }
+        schedule.Params[keyVal[0]] = keyVal[1]
+    }
+    if overlap, exists := schedule.Params["_overlap"]; exists {
+        if overlap != "skip" && overlap != "queue" {
+            return nil, errors.New(fmt.Sprintf("Invalid _overlap %s; expected skip or queue", overlap))
+        }
+        schedule.Overlap = overlap
+        delete(schedule.Params, "_overlap")
+    }
+    // A scheduled run must not block the scheduler
+    delete(schedule.Params, "_sync")
+    return schedule, nil
+}
+
+// Return a string that represents this `ScheduleStatus`
+func (self *ScheduleStatus) String() string {
+    var statBuf bytes.Buffer
+    statBuf.WriteString(fmt.Sprintf("%s script %s\n", self.Id, self.ScriptName))
+    statBuf.WriteString(fmt.Sprintf("%s expr %s\n", self.Id, self.Expr))
+    for key, val := range self.Params {
+        statBuf.WriteString(fmt.Sprintf("%s param %s %s\n", self.Id, key, val))
+    }
+    statBuf.WriteString(fmt.Sprintf("%s overlap %s\n", self.Id, self.Overlap))
+    statBuf.WriteString(fmt.Sprintf("%s next_ts %d\n", self.Id, self.NextTs))
+    return statBuf.String()
+}
+
+// Fire `ScriptSchedule`s at the start of every minute, in local time
+func (self *Server) runScheduler() {
+    go func() {
+        for {
+            now := time.Now()
+            nextMinute := now.Truncate(time.Minute).Add(time.Minute)
+            time.Sleep(nextMinute.Sub(now))
+            self.fireSchedules(nextMinute)
+        }
+    }()
+}
+
+// Fire every `ScriptSchedule` that matches the minute of `ts`
+func (self *Server) fireSchedules(ts time.Time) {
+    scripts := make([]*Script, 0)
+    func() {
+        self.ScriptsLock.Lock()
+        defer self.ScriptsLock.Unlock()
+        for _, script := range self.Scripts {
+            if len(script.Schedules) > 0 {
+                scripts = append(scripts, script)
+            }
+        }
+    }()
+    for _, script := range scripts {
+        for _, schedule := range script.Schedules {
+            if schedule.Spec.Match(ts) {
+                self.fireSchedule(script, schedule, ts)
+            }
+        }
+    }
+}
+
+// Make and submit a `ScriptRun` for `schedule`, unless it overlaps a
+// previous run and `schedule.Overlap` is `skip`. With `queue`, the run waits
+// on a lock named after the schedule.
+func (self *Server) fireSchedule(script *Script, schedule *ScriptSchedule, ts time.Time) {
+    if self.isDraining() {
+        infoLog.Printf("Skipped schedule %s; draining\n", schedule.Id)
+        return
+    } else if schedule.Overlap == "skip" && self.isScheduleRunning(schedule.Id) {
+        infoLog.Printf("Skipped schedule %s; previous run has not finished\n", schedule.Id)
+        return
+    }
+    params := make(map[string]string)
+    for key, val := range schedule.Params {
+        params[key] = val
+    }
+    req := &Request{
+        ScriptName: script.Name,
+        Params:     params,
+        Ts:         ts.Unix(),
+        ScheduleId: schedule.Id,
+    }
+    lockKeys := make([]string, 0, 1)
+    if schedule.Overlap == "queue" {
+        lockKeys = append(lockKeys, fmt.Sprintf("schedule:%s", schedule.Id))
+    }
+    scriptRun, err := self.makeScriptRun(script, req, lockKeys...)
+    if err != nil {
+        errLog.Printf("makeScriptRun failed for schedule %s; err=%v\n", schedule.Id, err)
+        return
+    }
+    scriptRun.logInfo("Requested by %s\n", req.describeClient())
+    if err = self.submitRun(scriptRun); err != nil {
+        scriptRun.logErr("Rejected; err=%v\n", err)
+    }
+}
+
+// Return whether a run from schedule `scheduleId` has not finished
+func (self *Server) isScheduleRunning(scheduleId string) bool {
+    self.ScriptRunsLock.Lock()
+    defer self.ScriptRunsLock.Unlock()
+    for _, scriptRun := range self.ScriptRuns {
+        if scriptRun.ScheduleId == scheduleId && !scriptRun.Finished {
+            return true
+        }
+    }
+    return false
+}
+
+// Return the `ScheduleStatus` of every `ScriptSchedule` of scripts whose
+// runs `principal` may see, ordered by id
+func (self *Server) getScheduleStatii(principal *Principal) []*ScheduleStatus {
+    self.ScriptsLock.Lock()
+    defer self.ScriptsLock.Unlock()
+    now := time.Now()
+    statii := make([]*ScheduleStatus, 0)
+    for _, script := range self.Scripts {
+        if !script.isAllowed(principal, "status") {
+            continue
+        }
+        for _, schedule := range script.Schedules {
+            status := &ScheduleStatus{
+                Id:         schedule.Id,
+                ScriptName: script.Name,
+                Expr:       schedule.Spec.Expr,
+                Params:     schedule.Params,
+                Overlap:    schedule.Overlap,
+            }
+            if nextTs := schedule.Spec.Next(now); !nextTs.IsZero() {
+                status.NextTs = nextTs.Unix()
+            }
+            statii = append(statii, status)
+        }
+    }
+    sort.Slice(statii, func(i, j int) bool {
+        return statii[i].Id < statii[j].Id
+    })
+    return statii
+}
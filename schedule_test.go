@@ -0,0 +1,57 @@
+package main
+
+import (
+    "fmt"
+    "testing"
+    "time"
+)
+
+func TestFireScheduleLockKeys(t *testing.T) {
+    defer func(maxRuns int, interpreter string) {
+        config.MaxRuns = maxRuns
+        config.Interpreter = interpreter
+    }(config.MaxRuns, config.Interpreter)
+    config.MaxRuns = 1 // Keep the fired run queued
+    config.Interpreter = "bash"
+    tests := []struct {
+        name       string
+        paramStr   string
+        expectKeys string
+    }{
+        {"skip", "", "job:1"},
+        {"queue", "_overlap=queue", "job:1 schedule:a.sh:0"},
+    }
+    for _, test := range tests {
+        script, err := newScript("/scripts/a.sh", []byte("# @param n int `1` n\n# @lock job:{{ .n }}\necho hi\n"))
+        if err != nil {
+            t.Fatalf("newScript err=%v", err)
+        }
+        schedule, err := newScriptSchedule(script.Name, 0, "* * * * *", test.paramStr)
+        if err != nil {
+            t.Fatalf("newScriptSchedule err=%v", err)
+        }
+        store, err := openRunStore(t.TempDir())
+        if err != nil {
+            t.Fatalf("openRunStore err=%v", err)
+        }
+        server := &Server{
+            Scripts:            map[string]*Script{script.Name: script},
+            NumRunning:         1,
+            NumRunningByScript: make(map[string]int),
+            LockHolders:        make(map[string]*ScriptRun),
+            Store:              store,
+        }
+        server.fireSchedule(script, schedule, time.Now())
+        records, err := store.Load()
+        store.file.Close()
+        if err != nil || len(records) != 1 {
+            t.Errorf("%s: journal has %d records, err=%v", test.name, len(records), err)
+            continue
+        }
+        if lockKeys := fmt.Sprint(records[0].Locks); lockKeys != "["+test.expectKeys+"]" {
+            t.Errorf("%s: first journaled locks are %s, expected [%s]", test.name, lockKeys, test.expectKeys)
+        } else if lockKeys = fmt.Sprint(server.RunQueue[0].LockKeys); lockKeys != "["+test.expectKeys+"]" {
+            t.Errorf("%s: queued run locks are %s, expected [%s]", test.name, lockKeys, test.expectKeys)
+        }
+    }
+}
@@ -7,9 +7,12 @@ import (
     "errors"
     "fmt"
     "io"
+    "math"
     "path"
     "regexp"
+    "strconv"
     "strings"
+    "syscall"
     "text/template"
     "time"
 )
@@ -21,6 +24,23 @@ type Script struct {
     ParamDefs          []ScriptDef `json:"-"`
     OutputDefs         []ScriptDef `json:"-"`
     Path               string
+    Allows             []ScriptAllow `json:"-"`
+    Concurrency        int
+    KillGrace          uint64
+    TimeoutPaused      string
+    LockDefs           []*template.Template `json:"-"`
+    LockMode           string
+    Schedules          []*ScriptSchedule `json:"-"`
+    NotifyUrls         []string          `json:"-"`
+    Interpreter        []string
+    Env                []string
+    InterpreterInput   string
+    Limits             *RunLimits
+    RunAs              string
+    KeepWorkdir        string
+    Stdin              string
+    StdinMaxSize       int64
+    Credential         *syscall.Credential `json:"-"`
     *template.Template `json:"-"`
     ParsedTs           int64
 }
@@ -33,15 +53,37 @@ type ScriptDef struct {
     Desc       string
 }
 
+type ScriptAllow struct {
+    Who    string
+    Action string
+}
+
 // Make a `Script` out of the bash script at `scriptPath` with contents
-// `source`. The script should be a regular bash script formatted as a
-// `text/template.Template`. Optionally, a description, params, and outputs
-// may be defined in the leading comments of the script. The format for these
-// are as follows:
+// `source`. The script should be a regular bash script (or a script for
+// another `@interpreter`) formatted as a `text/template.Template`.
+// Optionally, a description, params, and outputs may be defined in the
+// leading comments of the script. The format for these are as follows:
 //
 //     # @desc <text>
 //     # @param <pname> (int|float|string|unsafe|bool) `<default>` <pdesc>
-//     # @output <vname> (a|w)
+//     # @output <vname> (a|w|gauge|counter)
+//     # @allow <principal|group|*> (run|view|kill|status)
+//     # @concurrency <n>
+//     # @kill_grace <secs>
+//     # @timeout_paused (count|exclude)
+//     # @lock <name template>
+//     # @lock_mode (wait|reject)
+//     # @schedule "<cron expr>" [key=val ...]
+//     # @notify <url>
+//     # @interpreter <path> [args ...]
+//     # @interpreter_input (file|stdin)
+//     # @env <name>=<value>
+//     # @limit <name> <value>
+//     # @nice <n>
+//     # @ionice (idle|best-effort|realtime)[:<level>]
+//     # @run_as <user>[:<group>]
+//     # @keep_workdir (on_failure|always|never)
+//     # @stdin (none|optional|required) [<max size>]
 //
 // @desc
 //     desc entries get appended to `Script.Desc`.
@@ -57,24 +99,135 @@ type ScriptDef struct {
 //         echo 'hi' >&$vname
 //     Clear an append var like so:
 //         echo 'vname' >&$_clear
+//     Use `gauge` or `counter` for numeric overwrite vars. Their values are
+//     exported by `metrics` while the run is going. Non-numeric values, and
+//     counter values that decrease, are rejected.
+// @allow
+//     allow entries restrict an action to the named principals and groups
+//     (or `*` for any authenticated client). An action with no allow entries
+//     is unrestricted. `run` covers invoking the script, `status` covers
+//     seeing its runs in `status`, `view` covers `view`, `logs`, and
+//     `follow`, and `kill` covers `kill` and `purge`.
+// @concurrency
+//     concurrency sets how many runs of the script may run at once. Excess
+//     runs are queued and started in order as runs finish. 0 (the default)
+//     means no limit.
+// @kill_grace
+//     kill_grace sets how long a run killed with SIGTERM (the default when
+//     kill_grace is set) or another signal has to exit before it is sent
+//     SIGKILL. Timeouts use the same policy. 0 (the default) means runs are
+//     sent SIGKILL right away.
+// @timeout_paused
+//     timeout_paused decides whether time spent paused counts toward the
+//     timeout: `count` (the default) or `exclude`.
+// @lock
+//     lock entries name mutual exclusion locks held for the duration of a
+//     run. Names are `text/template`s rendered with the run's normalized
+//     params, e.g., `mysql-{{ .mysqld_port }}`. Runs of any script whose
+//     rendered lock names collide do not run at the same time.
+// @lock_mode
+//     lock_mode decides what happens to a run whose lock is held: `wait`
+//     (the default) queues it until the lock is free, `reject` refuses it,
+//     as it does when a queued run is already waiting for the lock.
+// @schedule
+//     schedule entries run the script with the given params whenever the
+//     cron expression matches, in local time. `_overlap=skip` (the default)
+//     skips a run while the schedule's previous run is going, and
+//     `_overlap=queue` queues it instead.
+// @notify
+//     notify entries name http(s) URLs that the final status of every run is
+//     POSTed to as JSON, like the `_callback` param.
+// @interpreter
+//     interpreter sets the command that runs the rendered script instead of
+//     the daemon-wide `-interpreter` (bash by default), e.g.,
+//     `/bin/bash -euo pipefail` or `/usr/bin/python3`.
+// @interpreter_input
+//     interpreter_input decides how the interpreter gets the rendered script:
+//     `file` (the default) passes the path of a file holding it as the last
+//     arg, `stdin` feeds it on stdin.
+// @env
+//     env entries set environment vars for the script, over those passed on
+//     from the daemon. See `ScriptRun.getEnv` for what else is set.
+// @limit
+//     limit entries limit the resources of each run. `memory` (bytes),
+//     `cpu` (percent of one CPU, e.g., `50%`), and `io_weight` (1-10000)
+//     apply to the run's cgroup and need `-cgroup`. `nofile`, `nproc`,
+//     `core`, `cputime` (secs), `data`, `fsize`, `stack`, and `as` are
+//     rlimits of the script's process. Sizes take a K, M, G, or T suffix, and
+//     any limit may be `unlimited`.
+// @nice
+//     nice sets the nice value of the script's process.
+// @ionice
+//     ionice sets the IO scheduling class and level (0-7) of the script's
+//     process, e.g., `idle` or `best-effort:7`. Linux only.
+// @run_as
+//     run_as runs the script as another user, in the user's primary group (or
+//     `group`) and supplementary groups. The daemon must be able to switch
+//     users, e.g., by running as root, and the script must be owned by root
+//     and not writable (see `Server.LoadScripts`).
+// @keep_workdir
+//     keep_workdir decides whether a run's work dir is kept once the run
+//     finishes: `on_failure` (the default) keeps it if the run failed,
+//     `always` keeps it, `never` removes it. Kept work dirs are removed when
+//     the run is purged.
+// @stdin
+//     stdin decides whether requests may send a payload for the script's
+//     stdin: `none` (the default) refuses one, `optional` takes one, and
+//     `required` refuses requests without one. Payloads over max size
+//     (16M by default; K, M, G, and T suffixes are understood) are refused.
+//     Scripts without a payload get an empty stdin. This cannot be combined
+//     with `@interpreter_input stdin`.
 //
+// If the interpreter is a shell, the fds of `_clear`, `_timeout`, output vars,
+// and `_artifact` are set in shell vars of the same names at the end of the
+// leading comments. Other interpreters get them in environment vars instead.
 // Scripts may also set a timeout at any time like so:
 //     echo 100 >&$_timeout   # timeout 100 seconds from now
 //     echo 0 >&$_timeout     # disable timeout (default)
-// If a script times out, it is sent a kill signal.
+// If a script times out, it is sent a kill signal. Scripts publish files for
+// clients to download (see `ScriptRun.addArtifact`) like so:
+//     echo report.txt >&$_artifact
 func newScript(scriptPath string, source []byte) (*Script, error) {
     script := &Script{
-        Name:       path.Base(scriptPath),
-        Path:       scriptPath,
-        ParamDefs:  make([]ScriptDef, 0),
-        OutputDefs: make([]ScriptDef, 0),
+        Name:             path.Base(scriptPath),
+        Path:             scriptPath,
+        ParamDefs:        make([]ScriptDef, 0),
+        OutputDefs:       make([]ScriptDef, 0),
+        Allows:           make([]ScriptAllow, 0),
+        LockDefs:         make([]*template.Template, 0),
+        LockMode:         "wait",
+        TimeoutPaused:    "count",
+        Schedules:        make([]*ScriptSchedule, 0),
+        NotifyUrls:       make([]string, 0),
+        Env:              make([]string, 0),
+        InterpreterInput: "file",
+        KeepWorkdir:      "on_failure",
+        Stdin:            "none",
+        StdinMaxSize:     STDIN_MAX_SIZE_DEFAULT,
     }
 
     // Define regexes
     descRe := regexp.MustCompile(`(?m)^#\s+@desc\s*(.*)$`)
     paramRe := regexp.MustCompile(fmt.Sprintf(
         `(?m)^#\s+@param\s+([^\s]+)\s+(int|float|string|bool|unsafe)\s+%s([^%s]*)%s\s+(.*)$`, "`", "`", "`"))
-    outputRe := regexp.MustCompile(`(?m)^#\s+@output\s+([^\s]+)\s+(a|w)$`)
+    outputRe := regexp.MustCompile(`(?m)^#\s+@output\s+([^\s]+)\s+(a|w|gauge|counter)$`)
+    concurrencyRe := regexp.MustCompile(`(?m)^#\s+@concurrency\s+(\d+)$`)
+    killGraceRe := regexp.MustCompile(`(?m)^#\s+@kill_grace\s+(\d+)$`)
+    timeoutPausedRe := regexp.MustCompile(`(?m)^#\s+@timeout_paused\s+(count|exclude)$`)
+    lockRe := regexp.MustCompile(`(?m)^#\s+@lock\s+(.+)$`)
+    lockModeRe := regexp.MustCompile(`(?m)^#\s+@lock_mode\s+(wait|reject)$`)
+    scheduleRe := regexp.MustCompile(`(?m)^#\s+@schedule\s+"([^"]+)"(.*)$`)
+    notifyRe := regexp.MustCompile(`(?m)^#\s+@notify\s+([^\s]+)$`)
+    interpreterRe := regexp.MustCompile(`(?m)^#\s+@interpreter\s+(.+)$`)
+    interpreterInputRe := regexp.MustCompile(`(?m)^#\s+@interpreter_input\s+(file|stdin)$`)
+    envRe := regexp.MustCompile(`(?m)^#\s+@env\s+([A-Za-z_][A-Za-z0-9_]*=.*)$`)
+    limitRe := regexp.MustCompile(`(?m)^#\s+@limit\s+([a-z_]+)\s+([^\s]+)$`)
+    niceRe := regexp.MustCompile(`(?m)^#\s+@nice\s+(-?\d+)$`)
+    ioniceRe := regexp.MustCompile(`(?m)^#\s+@ionice\s+(idle|best-effort|realtime)(?::(\d+))?$`)
+    runAsRe := regexp.MustCompile(`(?m)^#\s+@run_as\s+([^\s:]+(?::[^\s:]+)?)$`)
+    keepWorkdirRe := regexp.MustCompile(`(?m)^#\s+@keep_workdir\s+(on_failure|always|never)$`)
+    stdinRe := regexp.MustCompile(`(?m)^#\s+@stdin\s+(none|optional|required)(?:\s+([^\s]+))?$`)
+    allowRe := regexp.MustCompile(`(?m)^#\s+@allow\s+([^\s]+)\s+(run|view|kill|status)$`)
 
     // Read source line by line
     reader := bufio.NewReader(bytes.NewBuffer(source))
@@ -88,12 +241,9 @@ func newScript(scriptPath string, source []byte) (*Script, error) {
             break
         } else if !afterLeadingComments && !strings.HasPrefix(line, "#") {
             // End of leading comments
-            // Insert _clear, _timeout, and output var fds
-            if _, writeErr := templateBuf.WriteString("_clear=3\n_timeout=4\n"); writeErr != nil {
-                return nil, writeErr
-            }
-            for outputDefIdx, outputDef := range script.OutputDefs {
-                if _, writeErr := templateBuf.WriteString(fmt.Sprintf("%s=%d\n", outputDef.Name, 5+outputDefIdx)); writeErr != nil {
+            // Insert _clear, _timeout, output var, and _artifact fds
+            if script.hasShellInterpreter() {
+                if _, writeErr := templateBuf.WriteString(script.getFdPreamble()); writeErr != nil {
                     return nil, writeErr
                 }
             }
@@ -132,6 +282,102 @@ func newScript(scriptPath string, source []byte) (*Script, error) {
                 Name: matches[1],
                 Type: matches[2],
             })
+        } else if matches := concurrencyRe.FindStringSubmatch(line); len(matches) > 0 {
+            // Matched a @concurrency entry
+            concurrency, convErr := strconv.Atoi(matches[1])
+            if convErr != nil {
+                return nil, convErr
+            }
+            script.Concurrency = concurrency
+        } else if matches := killGraceRe.FindStringSubmatch(line); len(matches) > 0 {
+            // Matched a @kill_grace entry
+            killGrace, convErr := strconv.ParseUint(matches[1], 10, 64)
+            if convErr != nil {
+                return nil, convErr
+            }
+            script.KillGrace = killGrace
+        } else if matches := timeoutPausedRe.FindStringSubmatch(line); len(matches) > 0 {
+            // Matched a @timeout_paused entry
+            script.TimeoutPaused = matches[1]
+        } else if matches := lockRe.FindStringSubmatch(line); len(matches) > 0 {
+            // Matched a @lock entry
+            lockDef, tplErr := template.New(script.Name).Parse(strings.TrimSpace(matches[1]))
+            if tplErr != nil {
+                return nil, tplErr
+            }
+            script.LockDefs = append(script.LockDefs, lockDef)
+        } else if matches := lockModeRe.FindStringSubmatch(line); len(matches) > 0 {
+            // Matched a @lock_mode entry
+            script.LockMode = matches[1]
+        } else if matches := scheduleRe.FindStringSubmatch(line); len(matches) > 0 {
+            // Matched a @schedule entry
+            schedule, scheduleErr := newScriptSchedule(script.Name, len(script.Schedules)+1, matches[1], matches[2])
+            if scheduleErr != nil {
+                return nil, scheduleErr
+            }
+            script.Schedules = append(script.Schedules, schedule)
+        } else if matches := notifyRe.FindStringSubmatch(line); len(matches) > 0 {
+            // Matched a @notify entry
+            if urlErr := validateCallbackUrl(matches[1]); urlErr != nil {
+                return nil, urlErr
+            }
+            script.NotifyUrls = append(script.NotifyUrls, matches[1])
+        } else if matches := interpreterRe.FindStringSubmatch(line); len(matches) > 0 {
+            // Matched an @interpreter entry
+            script.Interpreter = strings.Fields(matches[1])
+        } else if matches := interpreterInputRe.FindStringSubmatch(line); len(matches) > 0 {
+            // Matched an @interpreter_input entry
+            script.InterpreterInput = matches[1]
+        } else if matches := envRe.FindStringSubmatch(line); len(matches) > 0 {
+            // Matched an @env entry
+            script.Env = append(script.Env, matches[1])
+        } else if matches := limitRe.FindStringSubmatch(line); len(matches) > 0 {
+            // Matched a @limit entry
+            if limitErr := script.getLimits().setLimit(matches[1], matches[2]); limitErr != nil {
+                return nil, limitErr
+            }
+        } else if matches := niceRe.FindStringSubmatch(line); len(matches) > 0 {
+            // Matched a @nice entry
+            nice, convErr := strconv.Atoi(matches[1])
+            if convErr != nil {
+                return nil, convErr
+            }
+            script.getLimits().Nice = &nice
+        } else if matches := ioniceRe.FindStringSubmatch(line); len(matches) > 0 {
+            // Matched an @ionice entry
+            if ioniceErr := script.getLimits().setIonice(matches[1], matches[2]); ioniceErr != nil {
+                return nil, ioniceErr
+            }
+        } else if matches := runAsRe.FindStringSubmatch(line); len(matches) > 0 {
+            // Matched a @run_as entry
+            credential, lookupErr := lookupCredential(matches[1])
+            if lookupErr != nil {
+                return nil, lookupErr
+            }
+            script.RunAs = matches[1]
+            script.Credential = credential
+        } else if matches := keepWorkdirRe.FindStringSubmatch(line); len(matches) > 0 {
+            // Matched a @keep_workdir entry
+            script.KeepWorkdir = matches[1]
+        } else if matches := stdinRe.FindStringSubmatch(line); len(matches) > 0 {
+            // Matched a @stdin entry
+            script.Stdin = matches[1]
+            if matches[2] != "" {
+                maxSize, sizeErr := parseLimitSize(matches[2])
+                if sizeErr != nil {
+                    return nil, sizeErr
+                }
+                if maxSize > math.MaxInt64 {
+                    maxSize = math.MaxInt64 // unlimited
+                }
+                script.StdinMaxSize = int64(maxSize)
+            }
+        } else if matches := allowRe.FindStringSubmatch(line); len(matches) > 0 {
+            // Matched an @allow entry
+            script.Allows = append(script.Allows, ScriptAllow{
+                Who:    matches[1],
+                Action: matches[2],
+            })
         } else {
             matchedEntry = false
         }
@@ -140,6 +386,11 @@ func newScript(scriptPath string, source []byte) (*Script, error) {
         }
     }
 
+    // Both would feed stdin
+    if script.Stdin != "none" && script.InterpreterInput == "stdin" {
+        return nil, errors.New(fmt.Sprintf("@stdin %s cannot be combined with @interpreter_input stdin", script.Stdin))
+    }
+
     // Make help
     script.Help = helpBuf.String()
 
@@ -174,6 +425,44 @@ func (self *Script) normalizeParams(iparams map[string]string) (map[string]inter
     return oparams, nil
 }
 
+// Return whether `principal` may perform `action` (run, view, kill, or
+// status). If the script has no @allow entries for `action`, anyone may.
+// Otherwise `principal` must be authenticated and match one of them by name
+// or group.
+func (self *Script) isAllowed(principal *Principal, action string) bool {
+    restricted := false
+    for _, allow := range self.Allows {
+        if allow.Action != action {
+            continue
+        }
+        restricted = true
+        if principal == nil {
+            continue
+        } else if allow.Who == "*" || allow.Who == principal.Name {
+            return true
+        }
+        for _, group := range principal.Groups {
+            if allow.Who == group {
+                return true
+            }
+        }
+    }
+    return !restricted
+}
+
+// Render the script's lock names with normalized `params`
+func (self *Script) renderLockKeys(params map[string]interface{}) ([]string, error) {
+    lockKeys := make([]string, 0, len(self.LockDefs))
+    for _, lockDef := range self.LockDefs {
+        var lockBuf bytes.Buffer
+        if err := lockDef.Execute(&lockBuf, params); err != nil {
+            return nil, err
+        }
+        lockKeys = append(lockKeys, lockBuf.String())
+    }
+    return lockKeys, nil
+}
+
 // Return the index of the output with name `name`. Return -1 if no such
 // output exists.
 func (self *Script) getOutputIdxByName(name string) int {
@@ -185,6 +474,93 @@ func (self *Script) getOutputIdxByName(name string) int {
     return -1
 }
 
+// Return the signal to kill runs of this script with when the kill grace
+// period is `grace`: SIGTERM if there is one, otherwise SIGKILL
+func (self *Script) getKillSignal(grace uint64) syscall.Signal {
+    if grace > 0 {
+        return syscall.SIGTERM
+    }
+    return syscall.SIGKILL
+}
+
+// Return `GOBASHD_PARAM_<name>=<value>` environment vars for the params in
+// `iparams`, with defaults filled in. Unlike template vars, `string` values
+// are not shell-escaped.
+func (self *Script) getParamEnv(iparams map[string]string) ([]string, error) {
+    env := make([]string, 0, len(self.ParamDefs))
+    for _, def := range self.ParamDefs {
+        ival, exists := iparams[def.Name]
+        if !exists {
+            ival = def.DefaultStr
+        }
+        val, err := def.decodeVal(ival)
+        if err != nil {
+            return nil, err
+        }
+        env = append(env, fmt.Sprintf("GOBASHD_PARAM_%s=%v", def.Name, val))
+    }
+    return env, nil
+}
+
+// Return the command and args that run this script: its `@interpreter`, or
+// the daemon-wide `-interpreter`
+func (self *Script) getInterpreter() []string {
+    if len(self.Interpreter) > 0 {
+        return self.Interpreter
+    }
+    return strings.Fields(config.Interpreter)
+}
+
+// Return whether this script's interpreter is a shell, e.g., `bash` or
+// `/usr/bin/env sh`
+func (self *Script) hasShellInterpreter() bool {
+    interpreter := self.getInterpreter()
+    if len(interpreter) > 1 && path.Base(interpreter[0]) == "env" {
+        interpreter = interpreter[1:]
+    }
+    if len(interpreter) == 0 {
+        return false
+    }
+    switch path.Base(interpreter[0]) {
+    case "bash", "sh", "dash", "ash", "ksh", "mksh", "zsh":
+        return true
+    }
+    return false
+}
+
+// Return shell var assignments of the fds of `_clear`, `_timeout`, output
+// vars, and `_artifact`
+func (self *Script) getFdPreamble() string {
+    var preambleBuf bytes.Buffer
+    preambleBuf.WriteString(fmt.Sprintf("_clear=%d\n_timeout=%d\n", FD_CLEAR, FD_TIMEOUT))
+    for outputDefIdx, outputDef := range self.OutputDefs {
+        preambleBuf.WriteString(fmt.Sprintf("%s=%d\n", outputDef.Name, FD_FIRST_OUTPUT+outputDefIdx))
+    }
+    preambleBuf.WriteString(fmt.Sprintf("_artifact=%d\n", FD_FIRST_OUTPUT+len(self.OutputDefs)))
+    return preambleBuf.String()
+}
+
+// Return whether this is a numeric (gauge or counter) output
+func (self *ScriptDef) isNumeric() bool {
+    return self.Type == "gauge" || self.Type == "counter"
+}
+
+// Return an error unless `val` is a valid value for this numeric output,
+// whose current value is `curVal`. Counters may not be negative or decrease.
+func (self *ScriptDef) checkNumericOutput(curVal string, val string) error {
+    num, err := strconv.ParseFloat(val, 64)
+    if err != nil || math.IsNaN(num) || math.IsInf(num, 0) {
+        return errors.New(fmt.Sprintf("%s is not a number", val))
+    } else if self.Type != "counter" {
+        return nil
+    } else if num < 0 {
+        return errors.New(fmt.Sprintf("Counter %s may not be negative", self.Name))
+    } else if curNum, curErr := strconv.ParseFloat(curVal, 64); curErr == nil && num < curNum {
+        return errors.New(fmt.Sprintf("Counter %s may not decrease from %s", self.Name, curVal))
+    }
+    return nil
+}
+
 // Set `ScriptDef.Default` to the JSON-decoded version of
 // `ScriptDef.DefaultStr`
 func (self *ScriptDef) makeDefault() error {
@@ -196,12 +572,21 @@ func (self *ScriptDef) makeDefault() error {
     return nil
 }
 
-// Return the JSON-decoded form of `in`. For `unsafe` and `string` types,
-// double quotes are added if `in` does not begin with a double quote. For
-// `string` the value is passed through `escapeShellArg`. `int` and `float`
-// types are both JSON-decoded as floats, but `int` is casted to an integer
-// afterwards. `bool` is JSON-decoded as a bool.
+// Return the JSON-decoded form of `in` (see `decodeVal`). For `string` the
+// value is passed through `escapeShellArg`.
 func (self *ScriptDef) toInterfaceVal(in string) (interface{}, error) {
+    v, err := self.decodeVal(in)
+    if err == nil && self.Type == "string" {
+        return escapeShellArg(v.(string)), nil
+    }
+    return v, err
+}
+
+// Return the JSON-decoded form of `in`. For `unsafe` and `string` types,
+// double quotes are added if `in` does not begin with a double quote. `int`
+// and `float` types are both JSON-decoded as floats, but `int` is casted to an
+// integer afterwards. `bool` is JSON-decoded as a bool.
+func (self *ScriptDef) decodeVal(in string) (interface{}, error) {
     var v interface{}
     if self.Type == "int" || self.Type == "float" {
         v = float64(0)
@@ -221,8 +606,14 @@ func (self *ScriptDef) toInterfaceVal(in string) (interface{}, error) {
     }
     if self.Type == "int" {
         return int(v.(float64)), nil
-    } else if self.Type == "string" {
-        return escapeShellArg(v.(string)), nil
     }
     return v, nil
 }
+
+// Return the `RunLimits` of this script, making them on first use
+func (self *Script) getLimits() *RunLimits {
+    if self.Limits == nil {
+        self.Limits = newRunLimits()
+    }
+    return self.Limits
+}
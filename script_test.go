@@ -0,0 +1,160 @@
+package main
+
+import (
+    "bytes"
+    "strings"
+    "testing"
+)
+
+func TestScriptFdPreamble(t *testing.T) {
+    defer func(interpreter string) { config.Interpreter = interpreter }(config.Interpreter)
+    config.Interpreter = "bash"
+    tests := []struct {
+        name           string
+        source         string
+        expectPreamble string
+    }{
+        {"default bash", "# @output rows w\necho hi\n", "_clear=3\n_timeout=4\nrows=5\n_artifact=6\n"},
+        {"no outputs", "# @desc x\necho hi\n", "_clear=3\n_timeout=4\n_artifact=5\n"},
+        {"sh", "# @interpreter /bin/sh -e\n# @output a w\n# @output b gauge\necho hi\n", "_clear=3\n_timeout=4\na=5\nb=6\n_artifact=7\n"},
+        {"env bash", "# @interpreter /usr/bin/env bash\necho hi\n", "_clear=3\n_timeout=4\n_artifact=5\n"},
+        {"python", "# @interpreter /usr/bin/python3 -u\n# @output rows w\nprint(1)\n", ""},
+        {"env python", "# @interpreter /usr/bin/env python3\nprint(1)\n", ""},
+    }
+    for _, test := range tests {
+        script, err := newScript("/scripts/a.sh", []byte(test.source))
+        if err != nil {
+            t.Errorf("%s: newScript err=%v", test.name, err)
+            continue
+        }
+        leadingComments := test.source[:strings.LastIndex(test.source[:len(test.source)-1], "\n")+1]
+        body := test.source[len(leadingComments):]
+        expect := leadingComments + test.expectPreamble + body
+        if script.Template.Root.String() != expect {
+            t.Errorf("%s: template is %q, expected %q", test.name, script.Template.Root.String(), expect)
+        }
+        scriptRun := &ScriptRun{Script: script, Id: "abc", Outputs: make([]*bytes.Buffer, len(script.OutputDefs))}
+        hasFdEnv := false
+        for _, envVar := range scriptRun.getEnv() {
+            if strings.HasPrefix(envVar, "_clear=") {
+                hasFdEnv = true
+            }
+        }
+        if hasFdEnv != (test.expectPreamble == "") {
+            t.Errorf("%s: fds in environment is %t, expected %t", test.name, hasFdEnv, test.expectPreamble == "")
+        }
+    }
+}
+
+func TestScriptIsAllowed(t *testing.T) {
+    source := "# @allow alice run\n# @allow ops run\n# @allow * status\n# @allow ops kill\n# @allow bogus nope\necho hi\n"
+    script, err := newScript("/scripts/a.sh", []byte(source))
+    if err != nil {
+        t.Fatalf("newScript err=%v", err)
+    } else if len(script.Allows) != 4 {
+        t.Fatalf("newScript parsed %d @allow entries, expected 4", len(script.Allows))
+    }
+    alice := &Principal{Name: "alice"}
+    bob := &Principal{Name: "bob", Groups: []string{"ops"}}
+    carol := &Principal{Name: "carol", Groups: []string{"dev"}}
+    tests := []struct {
+        name      string
+        principal *Principal
+        action    string
+        expected  bool
+    }{
+        {"run by name", alice, "run", true},
+        {"run by group", bob, "run", true},
+        {"run denied", carol, "run", false},
+        {"run without principal", nil, "run", false},
+        {"status by anyone", carol, "status", true},
+        {"status without principal", nil, "status", false},
+        {"kill by group", bob, "kill", true},
+        {"kill denied", alice, "kill", false},
+        {"view unrestricted", carol, "view", true},
+        {"view unrestricted without principal", nil, "view", true},
+    }
+    for _, test := range tests {
+        if allowed := script.isAllowed(test.principal, test.action); allowed != test.expected {
+            t.Errorf("%s: isAllowed returned %t, expected %t", test.name, allowed, test.expected)
+        }
+    }
+}
+
+func TestCheckNumericOutput(t *testing.T) {
+    gauge := &ScriptDef{Name: "rows", Type: "gauge"}
+    counter := &ScriptDef{Name: "bytes", Type: "counter"}
+    tests := []struct {
+        name      string
+        def       *ScriptDef
+        curVal    string
+        val       string
+        expectErr string
+    }{
+        {"gauge", gauge, "", "12.5", ""},
+        {"gauge negative", gauge, "3", "-1e3", ""},
+        {"gauge decreasing", gauge, "3", "2", ""},
+        {"gauge not a number", gauge, "", "lots", "not a number"},
+        {"gauge empty", gauge, "", "", "not a number"},
+        {"gauge NaN", gauge, "", "NaN", "not a number"},
+        {"gauge Inf", gauge, "", "+Inf", "not a number"},
+        {"counter first", counter, "", "0", ""},
+        {"counter increasing", counter, "10", "10.5", ""},
+        {"counter unchanged", counter, "10", "10", ""},
+        {"counter decreasing", counter, "10", "9", "may not decrease from 10"},
+        {"counter negative", counter, "", "-1", "may not be negative"},
+        {"counter not a number", counter, "10", "x", "not a number"},
+    }
+    for _, test := range tests {
+        err := test.def.checkNumericOutput(test.curVal, test.val)
+        if test.expectErr == "" && err != nil {
+            t.Errorf("%s: checkNumericOutput err=%v", test.name, err)
+        } else if test.expectErr != "" && (err == nil || !strings.Contains(err.Error(), test.expectErr)) {
+            t.Errorf("%s: checkNumericOutput err=%v, expected %q", test.name, err, test.expectErr)
+        }
+    }
+}
+
+func TestScriptNumericOutputs(t *testing.T) {
+    source := "# @output rows gauge\n# @output bytes counter\n# @output msg w\n# @output log a\necho hi\n"
+    script, err := newScript("/scripts/a.sh", []byte(source))
+    if err != nil {
+        t.Fatalf("newScript err=%v", err)
+    }
+    expected := []bool{true, true, false, false}
+    if len(script.OutputDefs) != len(expected) {
+        t.Fatalf("newScript parsed %d outputs, expected %d", len(script.OutputDefs), len(expected))
+    }
+    for idx, def := range script.OutputDefs {
+        if def.isNumeric() != expected[idx] {
+            t.Errorf("Output %s isNumeric returned %t, expected %t", def.Name, def.isNumeric(), expected[idx])
+        }
+    }
+}
+
+func TestScriptHasShellInterpreter(t *testing.T) {
+    defer func(interpreter string) { config.Interpreter = interpreter }(config.Interpreter)
+    tests := []struct {
+        name        string
+        daemon      string
+        interpreter []string
+        expected    bool
+    }{
+        {"daemon bash", "bash", nil, true},
+        {"daemon python", "python3 -u", nil, false},
+        {"script sh overrides daemon", "python3", []string{"/bin/sh", "-e"}, true},
+        {"script python overrides daemon", "bash", []string{"/usr/bin/python3"}, false},
+        {"env zsh", "bash", []string{"/usr/bin/env", "zsh"}, true},
+        {"env perl", "bash", []string{"/usr/bin/env", "perl"}, false},
+        {"env alone", "bash", []string{"env"}, false},
+        {"bash-like name", "bash", []string{"/opt/bashful"}, false},
+        {"empty daemon", "", nil, false},
+    }
+    for _, test := range tests {
+        config.Interpreter = test.daemon
+        script := &Script{Name: "a.sh", Interpreter: test.interpreter}
+        if isShell := script.hasShellInterpreter(); isShell != test.expected {
+            t.Errorf("%s: hasShellInterpreter returned %t, expected %t", test.name, isShell, test.expected)
+        }
+    }
+}
@@ -4,6 +4,7 @@ import (
     "bytes"
     "errors"
     "fmt"
+    "io"
     "io/ioutil"
     "os"
     "os/signal"
@@ -14,63 +15,139 @@ import (
 )
 
 type Server struct {
-    Scripts        map[string]*Script
-    ScriptRuns     []*ScriptRun
-    ScriptsLock    sync.Mutex
-    ScriptRunsLock sync.Mutex
+    Scripts            map[string]*Script
+    ScriptRuns         []*ScriptRun
+    RunQueue           []*ScriptRun
+    NumRunning         int
+    NumRunningByScript map[string]int
+    LockHolders        map[string]*ScriptRun
+    Store              *RunStore
+    Authenticator      Authenticator
+    TlsLoader          *TlsLoader
+    Notifier           *Notifier
+    Metrics            *Metrics
+    Draining           bool
+    ShuttingDown       bool
+    shutdownDone       chan bool
+    shutdownForced     chan bool
+    runners            sync.WaitGroup
+    ScriptsLock        sync.Mutex
+    ScriptRunsLock     sync.Mutex
+    QueueLock          sync.Mutex
 }
 
 type Request struct {
     ScriptName string
     Params     map[string]string
     ServerInterface
-    Ts         int64
-    RemoteAddr string
+    Ts                int64
+    RemoteAddr        string
+    Principal         *Principal
+    ClientCertSubject string
+    PeerCred          *PeerCred
+    ScheduleId        string
+    Stdin             io.Reader `json:"-"`
 }
 
 type Response struct {
-    StatusCode int
-    Body       string
-    Error      error
-    ErrorStr   string
-    RunStatii  []*ScriptRunStatus
+    StatusCode  int
+    Body        string
+    ContentType string `json:"-"`
+    Error       error
+    ErrorStr    string
+    RunStatii   []*ScriptRunStatus
+    LogLines    []RunLogLine
+    Schedules   []*ScheduleStatus
+    Artifacts   []*ArtifactStatus
+    Events      <-chan *RunEvent `json:"-"`
+    StopEvents  func()           `json:"-"`
+    File        *os.File         `json:"-"`
+}
+
+// Describe who sent a request, for logging
+func (self *Request) describeClient() string {
+    if self.ScheduleId != "" {
+        return fmt.Sprintf("schedule=%s", self.ScheduleId)
+    }
+    desc := fmt.Sprintf("remote_addr=%s", self.RemoteAddr)
+    if self.Principal != nil {
+        desc += fmt.Sprintf(" principal=%s", self.Principal.Name)
+    }
+    if self.ClientCertSubject != "" {
+        desc += fmt.Sprintf(" client_cert=%q", self.ClientCertSubject)
+    }
+    if self.PeerCred != nil {
+        desc += fmt.Sprintf(" peer_uid=%d peer_gid=%d peer_pid=%d", self.PeerCred.Uid, self.PeerCred.Gid, self.PeerCred.Pid)
+    }
+    return desc
 }
 
 func newServer() *Server {
     server := new(Server)
     server.Scripts = make(map[string]*Script)
     server.ScriptRuns = make([]*ScriptRun, 0)
+    server.RunQueue = make([]*ScriptRun, 0)
+    server.NumRunningByScript = make(map[string]int)
+    server.LockHolders = make(map[string]*ScriptRun)
+    server.Notifier = newNotifier()
+    server.Metrics = newMetrics()
+    server.shutdownDone = make(chan bool)
+    server.shutdownForced = make(chan bool)
     return server
 }
 
-// Load bash scripts at `ScriptDir`
+// Load bash scripts at `ScriptDir`. Scripts must be owned by the daemon's
+// user, or by root and not writable. Only the latter may use `@run_as`.
 func (self *Server) LoadScripts(scriptDir string) {
     self.ScriptsLock.Lock()
     defer self.ScriptsLock.Unlock()
     self.Scripts = make(map[string]*Script) // Reset Scripts map
+    loadOk := true
+    defer func() {
+        self.Metrics.scriptsLoaded(time.Now().Unix(), loadOk)
+    }()
     fileInfos, err := ioutil.ReadDir(scriptDir)
     if err != nil {
         errLog.Printf("ioutil.ReadDir err=%v\n", err)
+        loadOk = false
         return
     }
     for _, fileInfo := range fileInfos {
+        ownerUid := fileInfo.Sys().(*syscall.Stat_t).Uid
+        isOwned := uint32(os.Getuid()) == ownerUid
+        isRootOwned := ownerUid == 0 && fileInfo.Mode().Perm()&0222 == 0
         if !fileInfo.Mode().IsRegular() ||
             fileInfo.Mode().Perm()&0500 != 0500 ||
-            uint32(os.Getuid()) != fileInfo.Sys().(*syscall.Stat_t).Uid {
+            (!isOwned && !isRootOwned) {
             // Not a regular file
             // or not r-x by user
-            // or not owned by user
+            // or not owned by user, nor owned by root and not writable
             continue
         }
         scriptPath := fmt.Sprintf("%s/%s", scriptDir, fileInfo.Name())
         fileBytes, readErr := ioutil.ReadFile(scriptPath)
         if readErr != nil {
             errLog.Printf("ioutil.ReadFile err=%v\n", readErr)
+            loadOk = false
             continue
         }
         script, scriptErr := newScript(scriptPath, fileBytes)
         if scriptErr != nil {
             errLog.Printf("newScript err=%v\n", scriptErr)
+            loadOk = false
+            continue
+        } else if script.RunAs != "" && !isRootOwned {
+            // Only root can make a script run as someone else
+            errLog.Printf("Refusing to load %s; @run_as requires a script owned by root and not writable\n", script.Name)
+            loadOk = false
+            continue
+        } else if !isOwned && script.RunAs == "" {
+            // Not running as root, only load root's scripts with @run_as
+            continue
+        } else if script.Limits != nil && script.Limits.hasCgroupLimits() && config.Cgroup == "" {
+            // It would run unlimited
+            errLog.Printf("Refusing to load %s; @limit memory, cpu, and io_weight require -cgroup\n", script.Name)
+            loadOk = false
             continue
         }
         self.Scripts[script.Name] = script
@@ -89,8 +166,8 @@ func (self *Server) Handle(req *Request) *Response {
         resp.Body = self.getScriptHelp()
         return resp
     } else if req.ScriptName == "status" {
-        if statii, statusErr := self.getRunStatii(req.Params["id"]); statusErr != nil {
-            resp.StatusCode = 400
+        if statii, statusErr := self.getRunStatii(req.Params, req.Principal); statusErr != nil {
+            resp.StatusCode = getErrStatusCode(statusErr)
             resp.Error = statusErr
             resp.ErrorStr = statusErr.Error()
         } else {
@@ -99,8 +176,8 @@ func (self *Server) Handle(req *Request) *Response {
         }
         return resp
     } else if req.ScriptName == "view" {
-        if bashScript, viewErr := self.getBashScript(req.Params["id"]); viewErr != nil {
-            resp.StatusCode = 400
+        if bashScript, viewErr := self.getBashScript(req.Params["id"], req.Principal); viewErr != nil {
+            resp.StatusCode = getErrStatusCode(viewErr)
             resp.Error = viewErr
             resp.ErrorStr = viewErr.Error()
         } else {
@@ -109,8 +186,8 @@ func (self *Server) Handle(req *Request) *Response {
         }
         return resp
     } else if req.ScriptName == "kill" {
-        if killErr := self.killRun(req.Params["id"]); killErr != nil {
-            resp.StatusCode = 400
+        if killErr := self.killRun(req.Params, req.Principal); killErr != nil {
+            resp.StatusCode = getErrStatusCode(killErr)
             resp.Error = killErr
             resp.ErrorStr = killErr.Error()
         } else {
@@ -118,13 +195,89 @@ func (self *Server) Handle(req *Request) *Response {
             resp.Body = fmt.Sprintf("Sent kill to ScriptRun %s", req.Params["id"])
         }
         return resp
+    } else if req.ScriptName == "pause" || req.ScriptName == "resume" {
+        if pauseErr := self.pauseRun(req.Params["id"], req.ScriptName == "pause", req.Principal); pauseErr != nil {
+            resp.StatusCode = getErrStatusCode(pauseErr)
+            resp.Error = pauseErr
+            resp.ErrorStr = pauseErr.Error()
+        } else {
+            resp.StatusCode = 200
+            resp.Body = fmt.Sprintf("Sent %s to ScriptRun %s", req.ScriptName, req.Params["id"])
+        }
+        return resp
+    } else if req.ScriptName == "logs" {
+        if logLines, logsErr := self.getRunLogs(req.Params, req.Principal); logsErr != nil {
+            resp.StatusCode = getErrStatusCode(logsErr)
+            resp.Error = logsErr
+            resp.ErrorStr = logsErr.Error()
+        } else {
+            resp.StatusCode = 200
+            resp.LogLines = logLines
+        }
+        return resp
+    } else if req.ScriptName == "follow" {
+        if events, stopEvents, followErr := self.followRun(req.Params["id"], req.Principal); followErr != nil {
+            resp.StatusCode = getErrStatusCode(followErr)
+            resp.Error = followErr
+            resp.ErrorStr = followErr.Error()
+        } else {
+            resp.StatusCode = 200
+            resp.Events = events
+            resp.StopEvents = stopEvents
+        }
+        return resp
+    } else if req.ScriptName == "artifacts" {
+        if artifacts, artifactsErr := self.getRunArtifacts(req.Params["id"], req.Principal); artifactsErr != nil {
+            resp.StatusCode = getErrStatusCode(artifactsErr)
+            resp.Error = artifactsErr
+            resp.ErrorStr = artifactsErr.Error()
+        } else {
+            resp.StatusCode = 200
+            resp.Artifacts = artifacts
+        }
+        return resp
+    } else if req.ScriptName == "artifact" {
+        if file, artifactErr := self.openRunArtifact(req.Params["id"], req.Params["name"], req.Principal); artifactErr != nil {
+            resp.StatusCode = getErrStatusCode(artifactErr)
+            resp.Error = artifactErr
+            resp.ErrorStr = artifactErr.Error()
+        } else {
+            resp.StatusCode = 200
+            resp.File = file
+        }
+        return resp
+    } else if req.ScriptName == "schedules" {
+        resp.StatusCode = 200
+        resp.Schedules = self.getScheduleStatii(req.Principal)
+        return resp
+    } else if req.ScriptName == "metrics" {
+        resp.StatusCode = 200
+        resp.Body = self.getMetrics()
+        resp.ContentType = METRICS_CONTENT_TYPE
+        return resp
+    } else if req.ScriptName == "drain" || req.ScriptName == "undrain" {
+        if body, drainErr := self.setDraining(req.ScriptName == "drain", req.Principal); drainErr != nil {
+            resp.StatusCode = getErrStatusCode(drainErr)
+            resp.Error = drainErr
+            resp.ErrorStr = drainErr.Error()
+        } else {
+            resp.StatusCode = 200
+            resp.Body = body
+        }
+        return resp
     } else if req.ScriptName == "version" {
         resp.StatusCode = 200
         resp.Body = VERSION
         return resp
     } else if req.ScriptName == "purge" {
-        resp.StatusCode = 200
-        resp.Body = fmt.Sprintf("Purged %d ScriptRuns from status history", self.purgeScriptRuns(0))
+        if numPurged, purgeErr := self.purgeScriptRuns(0, req.Principal); purgeErr != nil {
+            resp.StatusCode = getErrStatusCode(purgeErr)
+            resp.Error = purgeErr
+            resp.ErrorStr = purgeErr.Error()
+        } else {
+            resp.StatusCode = 200
+            resp.Body = fmt.Sprintf("Purged %d ScriptRuns from status history", numPurged)
+        }
         return resp
     }
 
@@ -139,27 +292,47 @@ func (self *Server) Handle(req *Request) *Response {
         resp.Error = errors.New("Script or command does not exist")
         resp.ErrorStr = "Script or command does not exist"
         return resp
+    } else if !script.isAllowed(req.Principal, "run") {
+        resp.StatusCode = 403
+        resp.Error = errPermissionDenied
+        resp.ErrorStr = errPermissionDenied.Error()
+        return resp
+    } else if self.isDraining() {
+        resp.StatusCode = 503
+        resp.Error = errDraining
+        resp.ErrorStr = errDraining.Error()
+        return resp
     }
     scriptRun, err := self.makeScriptRun(script, req)
     if err != nil {
-        resp.StatusCode = 400
+        resp.StatusCode = getErrStatusCode(err)
         resp.Error = err
         resp.ErrorStr = err.Error()
         return resp
     }
-    if scriptRun.IsSync {
-        scriptRun.run()
-    } else {
-        go scriptRun.run()
+    scriptRun.logInfo("Requested by %s\n", req.describeClient())
+    if submitErr := self.submitRun(scriptRun); submitErr != nil {
+        resp.StatusCode = 409
+        resp.Error = submitErr
+        resp.ErrorStr = submitErr.Error()
+        resp.RunStatii = []*ScriptRunStatus{scriptRun.Status()}
+        return resp
     }
     resp.StatusCode = 200
     resp.RunStatii = []*ScriptRunStatus{scriptRun.Status()}
     return resp
 }
 
-// Given a `Script` and a `Request`, return a `ScriptRun`.
-func (self *Server) makeScriptRun(script *Script, req *Request) (*ScriptRun, error) {
+// Given a `Script` and a `Request`, return a `ScriptRun`. Besides the
+// script's `@lock`s, the run takes `extraLockKeys`.
+func (self *Server) makeScriptRun(script *Script, req *Request, extraLockKeys ...string) (*ScriptRun, error) {
     params, err := script.normalizeParams(req.Params)
+    if err != nil {
+        return nil, err
+    } else if err = script.checkStdin(req.Stdin != nil); err != nil {
+        return nil, err
+    }
+    paramEnv, err := script.getParamEnv(req.Params)
     if err != nil {
         return nil, err
     }
@@ -173,11 +346,20 @@ func (self *Server) makeScriptRun(script *Script, req *Request) (*ScriptRun, err
         Request:      req,
         Id:           uuid,
         LogId:        req.Params["logid"],
+        ScheduleId:   req.ScheduleId,
         Params:       params,
+        ParamEnv:     paramEnv,
         OutputLocks:  make([]sync.Mutex, len(script.OutputDefs)),
         TimeoutSetTs: time.Now().Unix(),
         TimeoutSet:   make(chan bool),
+        Log:          newRunLog(uuid),
+        Done:         make(chan bool),
+        State:        STATE_PENDING,
         IsSync:       isSync,
+        saveFn:       self.saveRun,
+    }
+    if config.StateDir != "" && config.DetachRuns {
+        scriptRun.RunDir = getRunDir(uuid)
     }
     for _ = range scriptRun.OutputLocks {
         scriptRun.Outputs = append(scriptRun.Outputs, &bytes.Buffer{})
@@ -188,28 +370,168 @@ func (self *Server) makeScriptRun(script *Script, req *Request) (*ScriptRun, err
     } else {
         scriptRun.BashScript = scriptBuf.String()
     }
+    if scriptRun.LockKeys, err = script.renderLockKeys(scriptRun.Params); err != nil {
+        return nil, err
+    }
+    scriptRun.LockKeys = append(scriptRun.LockKeys, extraLockKeys...)
+    callbackUrls := append([]string{}, script.NotifyUrls...)
+    if callbackUrl, exists := req.Params["_callback"]; exists {
+        callbackUrls = append(callbackUrls, callbackUrl)
+    }
+    for _, callbackUrl := range callbackUrls {
+        if err = validateCallbackUrl(callbackUrl); err != nil {
+            return nil, err
+        }
+        scriptRun.Callbacks = append(scriptRun.Callbacks, &CallbackStatus{Url: callbackUrl, State: CALLBACK_PENDING})
+    }
+    if req.Stdin != nil {
+        if err = scriptRun.spoolStdin(req.Stdin); err != nil {
+            return nil, err
+        }
+    }
     func() {
         self.ScriptRunsLock.Lock()
         defer self.ScriptRunsLock.Unlock()
         self.ScriptRuns = append(self.ScriptRuns, scriptRun)
     }()
+    self.saveRun(scriptRun)
     return scriptRun, nil
 }
 
-// Remove items from `ScriptRuns` older than `maxAge` seconds old.
-func (self *Server) purgeScriptRuns(maxAge uint64) int {
+// Run `scriptRun` to completion, record the outcome, and release its slot.
+// Use `submitRun` rather than calling this directly.
+func (self *Server) startRun(scriptRun *ScriptRun) {
+    defer self.runners.Done()
+    self.Metrics.runStarted(scriptRun.Script.Name)
+    scriptRun.run()
+    self.finishRun(scriptRun)
+}
+
+// Take back the slot and locks of every run restored from the `RunStore`
+// that is still supervised, and reattach to it
+func (self *Server) reattachRuns() {
+    self.ScriptRunsLock.Lock()
+    defer self.ScriptRunsLock.Unlock()
+    self.QueueLock.Lock()
+    defer self.QueueLock.Unlock()
+    for _, scriptRun := range self.ScriptRuns {
+        if scriptRun.Finished {
+            continue
+        }
+        self.NumRunning++
+        self.NumRunningByScript[scriptRun.Script.Name]++
+        for _, lockKey := range scriptRun.LockKeys {
+            self.LockHolders[lockKey] = scriptRun
+        }
+        self.runners.Add(1)
+        go func(scriptRun *ScriptRun) {
+            defer self.runners.Done()
+            scriptRun.reattach()
+            self.finishRun(scriptRun)
+        }(scriptRun)
+    }
+}
+
+// Record the outcome of a run that `run` or `reattach` has finished, and
+// release its slot
+func (self *Server) finishRun(scriptRun *ScriptRun) {
+    self.Metrics.runFinished(scriptRun)
+    if self.Store != nil {
+        // Keep output around for restarts
+        if err := scriptRun.Log.Spill(); err != nil {
+            scriptRun.logErr("Log.Spill failed err=%v\n", err)
+        }
+    }
+    if err := scriptRun.Log.Close(); err != nil {
+        scriptRun.logErr("Log.Close failed err=%v\n", err)
+    }
+    self.saveRun(scriptRun)
+    scriptRun.removeRunDir()
+    self.releaseRun(scriptRun)
+    self.notifyRun(scriptRun)
+}
+
+// Journal `scriptRun` to the `RunStore`, if there is one
+func (self *Server) saveRun(scriptRun *ScriptRun) {
+    if self.Store == nil {
+        return
+    }
+    if err := self.Store.Save(scriptRun); err != nil {
+        scriptRun.logErr("Store.Save failed err=%v\n", err)
+    }
+}
+
+// Load run history from the `RunStore` into `ScriptRuns`. Runs that were in
+// flight when the daemon last went away are marked lost, unless they can be
+// reattached to with `reattachRuns`. Finished runs with callbacks that were
+// still pending are notified again. The journal is then compacted.
+func (self *Server) RestoreScriptRuns() error {
+    records, err := self.Store.Load()
+    if err != nil {
+        return err
+    }
+    self.ScriptRunsLock.Lock()
+    defer self.ScriptRunsLock.Unlock()
+    for _, record := range records {
+        scriptRun := newScriptRunFromRecord(record)
+        scriptRun.saveFn = self.saveRun
+        if scriptRun.State == STATE_LOST && !record.Finished {
+            scriptRun.logErr("Marked lost; was in flight at last shutdown\n")
+            os.RemoveAll(getRunDir(scriptRun.Id))
+            scriptRun.removeScriptFile()
+            scriptRun.cleanWorkdir(STATE_LOST)
+            scriptRun.removeStdin()
+        }
+        self.ScriptRuns = append(self.ScriptRuns, scriptRun)
+    }
+    infoLog.Printf("Restored %d ScriptRuns from %s\n", len(records), self.Store.Path)
+    if err = self.Store.Compact(self.ScriptRuns); err != nil {
+        return err
+    }
+    // Only now, so delivery state is not journaled to the old journal
+    for _, scriptRun := range self.ScriptRuns {
+        if scriptRun.Finished {
+            self.notifyRun(scriptRun)
+        }
+    }
+    return nil
+}
+
+// Remove items from `ScriptRuns` older than `maxAge` seconds old. If
+// `principal` may not kill one of them, nothing is removed and
+// `errPermissionDenied` is returned.
+func (self *Server) purgeScriptRuns(maxAge uint64, principal *Principal) (int, error) {
     self.ScriptRunsLock.Lock()
     defer self.ScriptRunsLock.Unlock()
     newScriptRuns := make([]*ScriptRun, 0, len(self.ScriptRuns))
     now := time.Now().Unix()
+    isPurged := func(scriptRun *ScriptRun) bool {
+        return scriptRun.Finished && now-scriptRun.FinishTs > int64(maxAge)
+    }
+    for _, scriptRun := range self.ScriptRuns {
+        if isPurged(scriptRun) && !self.isRunAllowed(scriptRun, principal, "kill") {
+            return 0, errPermissionDenied
+        }
+    }
     for _, scriptRun := range self.ScriptRuns {
-        if !scriptRun.Finished || now-scriptRun.FinishTs <= int64(maxAge) {
+        if !isPurged(scriptRun) {
             newScriptRuns = append(newScriptRuns, scriptRun)
+        } else {
+            if err := scriptRun.Log.Remove(); err != nil {
+                scriptRun.logErr("Log.Remove failed err=%v\n", err)
+            }
+            scriptRun.removeArtifacts()
+            scriptRun.removeWorkdir()
         }
     }
     numPurged := len(self.ScriptRuns) - len(newScriptRuns)
     self.ScriptRuns = newScriptRuns
-    return numPurged
+    if self.Store != nil && numPurged > 0 {
+        if err := self.Store.Compact(self.ScriptRuns); err != nil {
+            errLog.Printf("Store.Compact failed err=%v\n", err)
+        }
+    }
+    return numPurged, nil
 }
 
 // Get script help
@@ -229,45 +551,147 @@ func (self *Server) getScriptHelp() string {
     return helpBuf.String()
 }
 
-// Return the `ScriptRunStatus` of one or more `ScriptRun`
-func (self *Server) getRunStatii(id string) ([]*ScriptRunStatus, error) {
+// Return the `ScriptRunStatus` of one or more `ScriptRun`. If `params`
+// contains an `id`, only that `ScriptRun` is considered. Otherwise all
+// `ScriptRun`s matching the `RunFilter` made from `params` are returned,
+// except those `principal` may not see.
+func (self *Server) getRunStatii(params map[string]string, principal *Principal) ([]*ScriptRunStatus, error) {
+    filter, filterErr := newRunFilter(params)
+    if filterErr != nil {
+        return nil, filterErr
+    }
     self.ScriptRunsLock.Lock()
     defer self.ScriptRunsLock.Unlock()
     statii := make([]*ScriptRunStatus, 0)
-    if id != "" {
-        scriptRun := self.getRunById(id)
-        if scriptRun == nil {
-            return nil, errors.New(fmt.Sprintf("ScriptRun with id %s does not exist", id))
+    if id := params["id"]; id != "" {
+        scriptRun, err := self.getAllowedRunById(id, principal, "status")
+        if err != nil {
+            return nil, err
         }
         statii = append(statii, scriptRun.Status())
     } else {
         for _, scriptRun := range self.ScriptRuns {
-            statii = append(statii, scriptRun.Status())
+            if !self.isRunAllowed(scriptRun, principal, "status") {
+                continue
+            } else if status := scriptRun.Status(); filter.Match(status) {
+                statii = append(statii, status)
+            }
         }
     }
-    return statii, nil
+    return filter.Apply(statii), nil
 }
 
 // Return the BashScript property of a `ScriptRun`
-func (self *Server) getBashScript(id string) (string, error) {
+func (self *Server) getBashScript(id string, principal *Principal) (string, error) {
     self.ScriptRunsLock.Lock()
     defer self.ScriptRunsLock.Unlock()
-    scriptRun := self.getRunById(id)
-    if scriptRun == nil {
-        return "", errors.New(fmt.Sprintf("ScriptRun with id %s does not exist", id))
+    scriptRun, err := self.getAllowedRunById(id, principal, "view")
+    if err != nil {
+        return "", err
     }
     return scriptRun.BashScript, nil
 }
 
-// Kill a script
-func (self *Server) killRun(id string) error {
+// Return captured stdout/stderr lines of a `ScriptRun`. `params` may contain
+// `id` (required), `stream` (stdout, stderr, or both), `offset`, and `limit`.
+// Reading logs requires the `view` permission.
+func (self *Server) getRunLogs(params map[string]string, principal *Principal) ([]RunLogLine, error) {
+    var offset, limit uint64
+    var err error
+    stream := params["stream"]
+    if stream == "" {
+        stream = "both"
+    } else if stream != "stdout" && stream != "stderr" && stream != "both" {
+        return nil, errors.New(fmt.Sprintf("Invalid stream %s; expected stdout, stderr, or both", stream))
+    }
+    if offsetStr, exists := params["offset"]; exists {
+        if offset, err = strconv.ParseUint(offsetStr, 10, 64); err != nil {
+            return nil, errors.New(fmt.Sprintf("Invalid offset %s", offsetStr))
+        }
+    }
+    if limitStr, exists := params["limit"]; exists {
+        if limit, err = strconv.ParseUint(limitStr, 10, 64); err != nil {
+            return nil, errors.New(fmt.Sprintf("Invalid limit %s", limitStr))
+        }
+    }
+    var runLog *RunLog
+    func() {
+        self.ScriptRunsLock.Lock()
+        defer self.ScriptRunsLock.Unlock()
+        var scriptRun *ScriptRun
+        if scriptRun, err = self.getAllowedRunById(params["id"], principal, "view"); err == nil {
+            runLog = scriptRun.Log
+        }
+    }()
+    if err != nil {
+        return nil, err
+    }
+    return runLog.Read(stream, offset, limit)
+}
+
+// Subscribe to `RunEvent`s of a `ScriptRun`. Following a run requires the
+// `view` permission.
+func (self *Server) followRun(id string, principal *Principal) (<-chan *RunEvent, func(), error) {
     self.ScriptRunsLock.Lock()
     defer self.ScriptRunsLock.Unlock()
-    scriptRun := self.getRunById(id)
-    if scriptRun == nil {
-        return errors.New(fmt.Sprintf("ScriptRun with id %s does not exist", id))
+    scriptRun, err := self.getAllowedRunById(id, principal, "view")
+    if err != nil {
+        return nil, nil, err
+    }
+    events, stopEvents := scriptRun.Subscribe()
+    return events, stopEvents, nil
+}
+
+// Kill a script. `params` may contain `id` (required), `signal` (a signal
+// name like TERM), and `grace` (seconds to wait before sending SIGKILL). They
+// default to the script's @kill_grace policy. A queued run is cancelled
+// instead.
+func (self *Server) killRun(params map[string]string, principal *Principal) error {
+    self.ScriptRunsLock.Lock()
+    defer self.ScriptRunsLock.Unlock()
+    scriptRun, err := self.getAllowedRunById(params["id"], principal, "kill")
+    if err != nil {
+        return err
+    }
+    grace := scriptRun.Script.KillGrace
+    if graceStr, exists := params["grace"]; exists {
+        if grace, err = strconv.ParseUint(graceStr, 10, 64); err != nil {
+            return errors.New(fmt.Sprintf("Invalid grace %s", graceStr))
+        }
+    }
+    sig := scriptRun.Script.getKillSignal(grace)
+    if signalName, exists := params["signal"]; exists {
+        if sig, err = parseKillSignal(signalName); err != nil {
+            return err
+        }
+    }
+    if self.cancelQueuedRun(scriptRun) {
+        return nil
+    }
+    scriptRun.KillReason = KILL_REASON_KILL
+    if err = scriptRun.kill(sig, grace); err != nil {
+        scriptRun.KillReason = ""
+    }
+    return err
+}
+
+// Pause a running script if `pause`, otherwise resume a paused one. Pausing
+// and resuming require the `kill` permission.
+func (self *Server) pauseRun(id string, pause bool, principal *Principal) error {
+    self.ScriptRunsLock.Lock()
+    defer self.ScriptRunsLock.Unlock()
+    scriptRun, err := self.getAllowedRunById(id, principal, "kill")
+    if err != nil {
+        return err
+    } else if pause {
+        err = scriptRun.pause()
+    } else {
+        err = scriptRun.resume()
+    }
+    if err == nil {
+        self.saveRun(scriptRun)
     }
-    return scriptRun.kill()
+    return err
 }
 
 // Reload on SIGHUP
@@ -276,9 +700,22 @@ func (self *Server) reloadOnHup() {
     signal.Notify(c, syscall.SIGHUP)
     go func() {
         for _ = range c {
-            infoLog.Printf("Caught SIGHUP, reopening logs and reloading scripts...")
+            infoLog.Printf("Caught SIGHUP, reopening logs and reloading scripts, credentials, certs, and callback key...")
             self.ReopenLogs()
             self.LoadScripts(".")
+            if self.Authenticator != nil {
+                if err := self.Authenticator.Reload(); err != nil {
+                    errLog.Printf("Authenticator.Reload failed; err=%v\n", err)
+                }
+            }
+            if self.TlsLoader != nil {
+                if err := self.TlsLoader.Reload(); err != nil {
+                    errLog.Printf("TlsLoader.Reload failed; err=%v\n", err)
+                }
+            }
+            if err := self.Notifier.Reload(); err != nil {
+                errLog.Printf("Notifier.Reload failed; err=%v\n", err)
+            }
         }
     }()
 }
@@ -295,6 +732,43 @@ func (self *Server) getRunById(id string) *ScriptRun {
     return nil
 }
 
+// Like `getRunById`, but return an error if no such `ScriptRun` exists or if
+// `principal` may not perform `action` on it. This function assumes the
+// `ScriptRunsLock` lock is already acquired.
+func (self *Server) getAllowedRunById(id string, principal *Principal, action string) (*ScriptRun, error) {
+    scriptRun := self.getRunById(id)
+    if scriptRun == nil {
+        return nil, errors.New(fmt.Sprintf("ScriptRun with id %s does not exist", id))
+    } else if !self.isRunAllowed(scriptRun, principal, action) {
+        return nil, errPermissionDenied
+    }
+    return scriptRun, nil
+}
+
+// Return whether `principal` may perform `action` on `scriptRun`. The policy
+// of the currently loaded `Script` of the same name applies, so runs restored
+// from the `RunStore` are covered too.
+func (self *Server) isRunAllowed(scriptRun *ScriptRun, principal *Principal, action string) bool {
+    self.ScriptsLock.Lock()
+    defer self.ScriptsLock.Unlock()
+    if script, exists := self.Scripts[scriptRun.Script.Name]; exists {
+        return script.isAllowed(principal, action)
+    }
+    return scriptRun.Script.isAllowed(principal, action)
+}
+
+// Return the status code for a built-in command that failed with `err`
+func getErrStatusCode(err error) int {
+    if err == errPermissionDenied {
+        return 403
+    } else if err == errArtifactNotFound {
+        return 404
+    } else if err == errStdinTooLarge {
+        return 413
+    }
+    return 400
+}
+
 // Reopen infoLog and errLog. Useful for logrotation.
 func (self *Server) ReopenLogs() {
     if config.InfoLogPath != "" {
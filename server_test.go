@@ -0,0 +1,122 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestPurgeScriptRuns(t *testing.T) {
+    dbaOnly := []ScriptAllow{{Who: "dba", Action: "kill"}}
+    tests := []struct {
+        name        string
+        principal   *Principal
+        allows      []ScriptAllow
+        expectErr   error
+        expectCount int
+        expectLeft  int
+    }{
+        {"unrestricted", &Principal{Name: "alice"}, nil, nil, 2, 1},
+        {"allowed", &Principal{Name: "bob", Groups: []string{"dba"}}, dbaOnly, nil, 2, 1},
+        {"denied", &Principal{Name: "alice"}, dbaOnly, errPermissionDenied, 0, 3},
+        {"denied without principal", nil, dbaOnly, errPermissionDenied, 0, 3},
+    }
+    for _, test := range tests {
+        open := &Script{Name: "open.sh"}
+        restricted := &Script{Name: "restricted.sh", Allows: test.allows}
+        server := &Server{
+            Scripts: map[string]*Script{"open.sh": open, "restricted.sh": restricted},
+            ScriptRuns: []*ScriptRun{
+                {Script: open, Id: "a", Finished: true, Log: newRunLog("a")},
+                {Script: restricted, Id: "b", Finished: true, Log: newRunLog("b")},
+                {Script: restricted, Id: "c", Finished: false, Log: newRunLog("c")},
+            },
+        }
+        numPurged, err := server.purgeScriptRuns(0, test.principal)
+        if err != test.expectErr {
+            t.Errorf("%s: purgeScriptRuns err=%v, expected %v", test.name, err, test.expectErr)
+        } else if numPurged != test.expectCount || len(server.ScriptRuns) != test.expectLeft {
+            t.Errorf("%s: purged %d, left %d, expected %d and %d", test.name, numPurged, len(server.ScriptRuns), test.expectCount, test.expectLeft)
+        }
+    }
+}
+
+func TestHandleDenied(t *testing.T) {
+    alice := &Principal{Name: "alice"}
+    bob := &Principal{Name: "bob", Groups: []string{"dba"}}
+    tests := []struct {
+        name         string
+        command      string
+        principal    *Principal
+        expectStatus int
+    }{
+        {"run", "restricted.sh", alice, 403},
+        {"run without principal", "restricted.sh", nil, 403},
+        {"status", "status", alice, 403},
+        {"view", "view", alice, 403},
+        {"logs", "logs", alice, 403},
+        {"follow", "follow", alice, 403},
+        {"artifacts", "artifacts", alice, 403},
+        {"kill", "kill", alice, 403},
+        {"pause", "pause", alice, 403},
+        {"allowed view", "view", bob, 200},
+        {"allowed status", "status", bob, 200},
+    }
+    for _, test := range tests {
+        // The loaded script's policy applies even though the run's own
+        // `Script` has none
+        restricted := &Script{Name: "restricted.sh", Allows: []ScriptAllow{
+            {Who: "dba", Action: "run"},
+            {Who: "dba", Action: "status"},
+            {Who: "dba", Action: "view"},
+            {Who: "dba", Action: "kill"},
+        }}
+        server := newServer()
+        server.Scripts["restricted.sh"] = restricted
+        server.ScriptRuns = append(server.ScriptRuns, &ScriptRun{
+            Script:   &Script{Name: "restricted.sh"},
+            Id:       "a",
+            Finished: true,
+            State:    STATE_FINISHED,
+            Log:      newRunLog("a"),
+        })
+        resp := server.Handle(&Request{ScriptName: test.command, Params: map[string]string{"id": "a"}, Principal: test.principal})
+        if resp.StatusCode != test.expectStatus {
+            t.Errorf("%s: Handle returned status %d (err=%v), expected %d", test.name, resp.StatusCode, resp.Error, test.expectStatus)
+        }
+        if resp.StopEvents != nil {
+            resp.StopEvents()
+        }
+    }
+}
+
+func TestGetRunStatiiHidesDenied(t *testing.T) {
+    open := &Script{Name: "open.sh"}
+    restricted := &Script{Name: "restricted.sh", Allows: []ScriptAllow{{Who: "dba", Action: "status"}}}
+    server := newServer()
+    server.Scripts = map[string]*Script{"open.sh": open, "restricted.sh": restricted}
+    server.ScriptRuns = []*ScriptRun{
+        {Script: open, Id: "a", Finished: true, State: STATE_FINISHED},
+        {Script: restricted, Id: "b", Finished: true, State: STATE_FINISHED},
+    }
+    tests := []struct {
+        name      string
+        principal *Principal
+        expectIds string
+    }{
+        {"denied", &Principal{Name: "alice"}, "a"},
+        {"without principal", nil, "a"},
+        {"allowed", &Principal{Name: "bob", Groups: []string{"dba"}}, "ab"},
+    }
+    for _, test := range tests {
+        statii, err := server.getRunStatii(map[string]string{}, test.principal)
+        if err != nil {
+            t.Fatalf("%s: getRunStatii err=%v", test.name, err)
+        }
+        ids := ""
+        for _, status := range statii {
+            ids += status.Id
+        }
+        if ids != test.expectIds {
+            t.Errorf("%s: getRunStatii returned runs %q, expected %q", test.name, ids, test.expectIds)
+        }
+    }
+}
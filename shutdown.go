@@ -0,0 +1,227 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "os/signal"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+)
+
+const (
+    SHUTDOWN_HTTP_SECS = 5
+    SHUTDOWN_KILL_SECS = 5
+)
+
+var errDraining = errors.New("Draining; not accepting new runs")
+
+// Return whether new runs are refused
+func (self *Server) isDraining() bool {
+    self.QueueLock.Lock()
+    defer self.QueueLock.Unlock()
+    return self.Draining
+}
+
+// Start or stop refusing new runs. Runs already running or queued are not
+// affected. Return a description of what is left. Draining requires
+// `principal` to be an admin.
+func (self *Server) setDraining(draining bool, principal *Principal) (string, error) {
+    if !self.isAdmin(principal) {
+        return "", errPermissionDenied
+    }
+    self.QueueLock.Lock()
+    defer self.QueueLock.Unlock()
+    if !draining && self.ShuttingDown {
+        return "", errors.New("Shutting down; cannot undrain")
+    }
+    self.Draining = draining
+    if !draining {
+        infoLog.Printf("Undrained; accepting new runs\n")
+        return "Accepting new runs", nil
+    }
+    infoLog.Printf("Draining; refusing new runs\n")
+    return fmt.Sprintf("Draining; %d runs running, %d queued", self.NumRunning, len(self.RunQueue)), nil
+}
+
+// Return whether `principal` may run admin commands. If `config.Admins` is
+// empty, anyone may without an `Authenticator`, and no one may with one.
+func (self *Server) isAdmin(principal *Principal) bool {
+    if config.Admins == "" {
+        return self.Authenticator == nil
+    } else if principal == nil {
+        return false
+    }
+    for _, admin := range strings.Split(config.Admins, ",") {
+        admin = strings.TrimSpace(admin)
+        if admin == principal.Name {
+            return true
+        }
+        for _, group := range principal.Groups {
+            if admin == group {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// Shut down gracefully on SIGTERM or SIGINT. A second signal forces the
+// shutdown (see `forceShutdown`).
+func (self *Server) shutdownOnSignal(interfaces []ServerInterface) {
+    c := make(chan os.Signal, 1)
+    signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+    go func() {
+        sig := <-c
+        infoLog.Printf("Caught %s, shutting down...\n", sig)
+        go self.shutdown(interfaces)
+        sig = <-c
+        infoLog.Printf("Caught %s again, forcing shutdown...\n", sig)
+        self.forceShutdown()
+        signal.Stop(c)
+    }()
+}
+
+// Make `shutdown` stop waiting for runs to finish, and SIGKILL unfinished
+// runs instead of honoring their kill grace, unless they are left to their
+// supervisors
+func (self *Server) forceShutdown() {
+    close(self.shutdownForced)
+}
+
+// Return whether `forceShutdown` was called
+func (self *Server) isShutdownForced() bool {
+    select {
+    case <-self.shutdownForced:
+        return true
+    default:
+        return false
+    }
+}
+
+// Stop accepting connections on `interfaces` and new runs, cancel queued
+// runs, wait up to `config.ShutdownWait` seconds for running runs to finish,
+// kill what is left according to each script's kill policy (or, with
+// `-detach-runs`, leave it running to be reattached), and persist the final
+// state. Wakes `waitForShutdown` when done.
+func (self *Server) shutdown(interfaces []ServerInterface) {
+    var queuedRuns []*ScriptRun
+    func() {
+        self.QueueLock.Lock()
+        defer self.QueueLock.Unlock()
+        self.Draining = true
+        self.ShuttingDown = true
+        queuedRuns = append(queuedRuns, self.RunQueue...)
+    }()
+
+    // Stop listening
+    var ifaceWaitGroup sync.WaitGroup
+    for _, iface := range interfaces {
+        ifaceWaitGroup.Add(1)
+        go func(iface ServerInterface) {
+            defer ifaceWaitGroup.Done()
+            iface.Shutdown()
+        }(iface)
+    }
+    ifaceWaitGroup.Wait()
+
+    // Cancel queued runs
+    for _, scriptRun := range queuedRuns {
+        if self.cancelQueuedRun(scriptRun) {
+            scriptRun.logInfo("Cancelled for shutdown\n")
+        }
+    }
+
+    // Wait for running runs, then kill them, or leave them to their
+    // supervisors
+    if config.ShutdownWait > 0 {
+        infoLog.Printf("Waiting up to %d seconds for runs to finish\n", config.ShutdownWait)
+    }
+    if !self.waitForRunners(time.Duration(config.ShutdownWait)*time.Second, self.shutdownForced) {
+        if config.DetachRuns && self.Store != nil {
+            infoLog.Printf("Leaving unfinished runs to their supervisors\n")
+        } else {
+            forced := self.isShutdownForced()
+            maxGrace := self.killUnfinishedRuns(forced)
+            stop := self.shutdownForced
+            if forced {
+                stop = nil
+            }
+            finished := self.waitForRunners(time.Duration(maxGrace+SHUTDOWN_KILL_SECS)*time.Second, stop)
+            if !finished && !forced && self.isShutdownForced() {
+                // Forced during the kill grace
+                self.killUnfinishedRuns(true)
+                finished = self.waitForRunners(SHUTDOWN_KILL_SECS*time.Second, nil)
+            }
+            if !finished {
+                errLog.Printf("Gave up waiting for killed runs to finish\n")
+            }
+        }
+    }
+
+    // Persist final state
+    if self.Store != nil {
+        self.ScriptRunsLock.Lock()
+        if err := self.Store.Compact(self.ScriptRuns); err != nil {
+            errLog.Printf("Store.Compact failed err=%v\n", err)
+        }
+        self.ScriptRunsLock.Unlock()
+    }
+    infoLog.Printf("Shut down\n")
+    close(self.shutdownDone)
+}
+
+// Kill every unfinished run with its script's kill policy, or with SIGKILL
+// if `now`. Return the longest kill grace period.
+func (self *Server) killUnfinishedRuns(now bool) uint64 {
+    self.ScriptRunsLock.Lock()
+    defer self.ScriptRunsLock.Unlock()
+    maxGrace := uint64(0)
+    for _, scriptRun := range self.ScriptRuns {
+        if scriptRun.Finished {
+            continue
+        }
+        grace := scriptRun.Script.KillGrace
+        if now {
+            grace = 0
+        }
+        if grace > maxGrace {
+            maxGrace = grace
+        }
+        scriptRun.KillReason = KILL_REASON_SHUTDOWN
+        if err := scriptRun.kill(scriptRun.Script.getKillSignal(grace), grace); err != nil {
+            scriptRun.logErr("kill failed err=%v\n", err)
+        }
+    }
+    return maxGrace
+}
+
+// Wait up to `timeout`, or until `stop` is closed, for every started run to
+// finish and be persisted. Return whether they all did.
+func (self *Server) waitForRunners(timeout time.Duration, stop chan bool) bool {
+    done := make(chan bool)
+    go func() {
+        self.runners.Wait()
+        close(done)
+    }()
+    select {
+    case <-done:
+        return true
+    case <-time.After(timeout):
+        return false
+    case <-stop:
+        return false
+    }
+}
+
+// If a shutdown has started, wait for it to finish
+func (self *Server) waitForShutdown() {
+    self.QueueLock.Lock()
+    shuttingDown := self.ShuttingDown
+    self.QueueLock.Unlock()
+    if shuttingDown {
+        <-self.shutdownDone
+    }
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+    "syscall"
+    "testing"
+    "time"
+)
+
+func TestShutdownForced(t *testing.T) {
+    defer func(wait int) { config.ShutdownWait = wait }(config.ShutdownWait)
+    tests := []struct {
+        name         string
+        script       string
+        shutdownWait int
+        killGrace    uint64
+        forceAfter   time.Duration
+    }{
+        {"killed", "sleep 30", 0, 0, 0},
+        {"killed after grace", "trap '' TERM; sleep 30", 0, 1, 0},
+        {"forced while waiting", "sleep 30", 60, 0, 200 * time.Millisecond},
+        {"forced during grace", "trap '' TERM; sleep 30", 0, 60, 500 * time.Millisecond},
+    }
+    for _, test := range tests {
+        config.ShutdownWait = test.shutdownWait
+        cmd := startTestProcessGroup(t, test.script)
+        time.Sleep(100 * time.Millisecond) // Let `trap` run
+        scriptRun := &ScriptRun{
+            Script: &Script{Name: "a.sh", KillGrace: test.killGrace},
+            Id:     "abc",
+            Pgid:   cmd.Process.Pid,
+            State:  STATE_RUNNING,
+            Done:   make(chan bool),
+        }
+        server := newServer()
+        server.ScriptRuns = append(server.ScriptRuns, scriptRun)
+        server.runners.Add(1)
+        go func() {
+            defer server.runners.Done()
+            cmd.Wait()
+            scriptRun.pauseLock.Lock()
+            scriptRun.Finished = true
+            scriptRun.pauseLock.Unlock()
+            close(scriptRun.Done)
+        }()
+        go server.shutdown(nil)
+        if test.forceAfter > 0 {
+            time.Sleep(test.forceAfter)
+            server.forceShutdown()
+        }
+        timeout := time.Duration(test.killGrace)*time.Second + 3*time.Second
+        if test.forceAfter > 0 {
+            timeout = 3 * time.Second
+        }
+        select {
+        case <-server.shutdownDone:
+            if scriptRun.KillReason != KILL_REASON_SHUTDOWN {
+                t.Errorf("%s: KillReason is %q, expected %q", test.name, scriptRun.KillReason, KILL_REASON_SHUTDOWN)
+            }
+        case <-time.After(timeout):
+            if test.forceAfter > 0 {
+                t.Errorf("%s: shutdown still waiting after it was forced", test.name)
+            } else {
+                t.Errorf("%s: shutdown still waiting after the kill grace", test.name)
+            }
+            syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+            <-server.shutdownDone
+        }
+    }
+}
+
+func TestIsAdmin(t *testing.T) {
+    defer func(admins string) { config.Admins = admins }(config.Admins)
+    alice := &Principal{Name: "alice"}
+    bob := &Principal{Name: "bob", Groups: []string{"ops"}}
+    tests := []struct {
+        name      string
+        admins    string
+        auth      bool
+        principal *Principal
+        expected  bool
+    }{
+        {"no admins, no auth", "", false, nil, true},
+        {"no admins, auth", "", true, alice, false},
+        {"by name", "alice, ops", true, alice, true},
+        {"by group", "alice, ops", true, bob, true},
+        {"not listed", "alice", true, bob, false},
+        {"without principal", "alice", false, nil, false},
+    }
+    for _, test := range tests {
+        config.Admins = test.admins
+        server := newServer()
+        if test.auth {
+            server.Authenticator = &FileAuthenticator{}
+        }
+        if isAdmin := server.isAdmin(test.principal); isAdmin != test.expected {
+            t.Errorf("%s: isAdmin returned %t, expected %t", test.name, isAdmin, test.expected)
+        }
+    }
+}
+
+func TestSetDraining(t *testing.T) {
+    defer func(admins string) { config.Admins = admins }(config.Admins)
+    config.Admins = "alice"
+    alice := &Principal{Name: "alice"}
+    tests := []struct {
+        name           string
+        draining       bool
+        principal      *Principal
+        shuttingDown   bool
+        expectErr      bool
+        expectDraining bool
+    }{
+        {"drain", true, alice, false, false, true},
+        {"drain as non-admin", true, &Principal{Name: "bob"}, false, true, false},
+        {"undrain", false, alice, false, false, false},
+        {"undrain while shutting down", false, alice, true, true, true},
+    }
+    for _, test := range tests {
+        server := newServer()
+        server.Draining = !test.draining
+        server.ShuttingDown = test.shuttingDown
+        _, err := server.setDraining(test.draining, test.principal)
+        if (err != nil) != test.expectErr {
+            t.Errorf("%s: setDraining err=%v, expected err %t", test.name, err, test.expectErr)
+        } else if server.isDraining() != test.expectDraining {
+            t.Errorf("%s: isDraining returned %t, expected %t", test.name, server.isDraining(), test.expectDraining)
+        }
+    }
+
+    // Draining refuses new runs with 503
+    server := newServer()
+    server.Scripts["a.sh"] = &Script{Name: "a.sh"}
+    server.Draining = true
+    if resp := server.Handle(&Request{ScriptName: "a.sh", Params: map[string]string{}}); resp.StatusCode != 503 || resp.Error != errDraining {
+        t.Errorf("Handle while draining returned status %d err=%v, expected 503", resp.StatusCode, resp.Error)
+    }
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "math"
+    "os"
+    "path/filepath"
+)
+
+const (
+    STDIN_MAX_SIZE_DEFAULT = 16 << 20
+)
+
+var errStdinTooLarge = errors.New("Stdin payload is too large")
+
+// Return the path the stdin payload of the run with id `id` is spooled to
+// until the run starts. Like `runLogDir`, this is under the state dir if there
+// is one.
+func getStdinPath(id string) string {
+    if config.StateDir != "" {
+        return filepath.Join(config.StateDir, "stdin", id)
+    }
+    return filepath.Join(os.TempDir(), "gobashd-stdin", id)
+}
+
+// Check whether this script takes a request with (`hasStdin`) or without a
+// stdin payload, as its `@stdin` says
+func (self *Script) checkStdin(hasStdin bool) error {
+    if hasStdin && self.Stdin == "none" {
+        return errors.New(fmt.Sprintf("Script %s does not take stdin", self.Name))
+    } else if !hasStdin && self.Stdin == "required" {
+        return errors.New(fmt.Sprintf("Script %s requires stdin", self.Name))
+    }
+    return nil
+}
+
+// Spool `stdin`, the stdin payload of the request for this run, to
+// `getStdinPath`. Payloads over the script's max size are rejected.
+func (self *ScriptRun) spoolStdin(stdin io.Reader) error {
+    stdinPath := getStdinPath(self.Id)
+    if err := os.MkdirAll(filepath.Dir(stdinPath), 0700); err != nil {
+        return err
+    }
+    stdinFile, err := os.OpenFile(stdinPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+    if err != nil {
+        return err
+    }
+    maxSize := self.Script.StdinMaxSize
+    if maxSize < math.MaxInt64 {
+        maxSize++ // Read one byte too many to tell if there are more
+    }
+    size, err := io.Copy(stdinFile, io.LimitReader(stdin, maxSize))
+    if err == nil && size > self.Script.StdinMaxSize {
+        err = errStdinTooLarge
+    }
+    if closeErr := stdinFile.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        os.Remove(stdinPath)
+        return err
+    }
+    return nil
+}
+
+// Open the spooled stdin payload of this run, or return nil if it has none.
+// The spool file is unlinked right away; the script's stdin keeps it alive.
+func (self *ScriptRun) openStdin() (*os.File, error) {
+    stdinFile, err := os.Open(getStdinPath(self.Id))
+    if os.IsNotExist(err) {
+        return nil, nil
+    } else if err != nil {
+        return nil, err
+    }
+    self.removeStdin()
+    return stdinFile, nil
+}
+
+// Remove the spooled stdin payload of this run, if it is still there, e.g.,
+// because the run never started
+func (self *ScriptRun) removeStdin() {
+    if err := os.Remove(getStdinPath(self.Id)); err != nil && !os.IsNotExist(err) {
+        self.logErr("os.Remove failed err=%v\n", err)
+    }
+}
+
+// Return the max size of the stdin payload script `scriptName` takes, or 0 if
+// it takes none or does not exist
+func (self *Server) getStdinMaxSize(scriptName string) int64 {
+    self.ScriptsLock.Lock()
+    defer self.ScriptsLock.Unlock()
+    if script, exists := self.Scripts[scriptName]; exists && script.Stdin != "none" {
+        return script.StdinMaxSize
+    }
+    return 0
+}
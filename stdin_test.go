@@ -0,0 +1,78 @@
+package main
+
+import (
+    "io/ioutil"
+    "os"
+    "strings"
+    "testing"
+)
+
+func TestCheckStdin(t *testing.T) {
+    tests := []struct {
+        stdin     string
+        hasStdin  bool
+        expectErr bool
+    }{
+        {"none", false, false},
+        {"none", true, true},
+        {"optional", false, false},
+        {"optional", true, false},
+        {"required", false, true},
+        {"required", true, false},
+    }
+    for _, test := range tests {
+        script := &Script{Name: "a.sh", Stdin: test.stdin}
+        if err := script.checkStdin(test.hasStdin); (err != nil) != test.expectErr {
+            t.Errorf("checkStdin(%t) with @stdin %s err=%v, expected err %t", test.hasStdin, test.stdin, err, test.expectErr)
+        }
+    }
+}
+
+func TestSpoolStdin(t *testing.T) {
+    defer func(stateDir string) { config.StateDir = stateDir }(config.StateDir)
+    config.StateDir = t.TempDir()
+    tests := []struct {
+        name      string
+        payload   string
+        maxSize   int64
+        expectErr error
+    }{
+        {"empty", "", 10, nil},
+        {"under max", "abc", 10, nil},
+        {"at max", "0123456789", 10, nil},
+        {"over max", "0123456789a", 10, errStdinTooLarge},
+        {"no max", "abc", STDIN_MAX_SIZE_DEFAULT, nil},
+    }
+    for idx, test := range tests {
+        scriptRun := &ScriptRun{
+            Script: &Script{Name: "a.sh", Stdin: "optional", StdinMaxSize: test.maxSize},
+            Id:     string(rune('a' + idx)),
+        }
+        err := scriptRun.spoolStdin(strings.NewReader(test.payload))
+        if err != test.expectErr {
+            t.Errorf("%s: spoolStdin err=%v, expected %v", test.name, err, test.expectErr)
+        }
+        stdinFile, err := scriptRun.openStdin()
+        if err != nil {
+            t.Errorf("%s: openStdin err=%v", test.name, err)
+            continue
+        } else if test.expectErr != nil {
+            if stdinFile != nil {
+                t.Errorf("%s: rejected payload was left spooled", test.name)
+                stdinFile.Close()
+            }
+            continue
+        } else if stdinFile == nil {
+            t.Errorf("%s: payload was not spooled", test.name)
+            continue
+        }
+        spooled, _ := ioutil.ReadAll(stdinFile)
+        stdinFile.Close()
+        if string(spooled) != test.payload {
+            t.Errorf("%s: spooled %q, expected %q", test.name, spooled, test.payload)
+        }
+        if _, err = os.Stat(getStdinPath(scriptRun.Id)); !os.IsNotExist(err) {
+            t.Errorf("%s: spool file still there after openStdin; err=%v", test.name, err)
+        }
+    }
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sort"
+    "sync"
+)
+
+// A `RunStore` journals `ScriptRun` state to an append-only file in the state
+// dir. Each line of the journal is a JSON-encoded `RunRecord`. When a run
+// appears more than once, the last record wins.
+type RunStore struct {
+    Path string
+    file *os.File
+    lock sync.Mutex
+}
+
+// A `RunRecord` is a single journal entry. Besides status, it holds what is
+// needed to reattach to a run that outlives the daemon.
+type RunRecord struct {
+    ScriptRunStatus
+    BashScript    string
+    Allows        []ScriptAllow
+    OutputDefs    []ScriptDef
+    KillGrace     uint64
+    TimeoutPaused string
+    Timeout       uint64
+    PausedTs      int64
+    PausedAtSet   int64
+    ScriptPath    string
+    KeepWorkdir   string
+}
+
+// Open (or create) the journal in `stateDir`
+func openRunStore(stateDir string) (*RunStore, error) {
+    if err := os.MkdirAll(stateDir, 0700); err != nil {
+        return nil, err
+    }
+    store := &RunStore{Path: filepath.Join(stateDir, "runs.journal")}
+    file, err := os.OpenFile(store.Path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+    if err != nil {
+        return nil, err
+    }
+    store.file = file
+    return store, nil
+}
+
+// Return the latest `RunRecord` of every run in the journal, in the order in
+// which the runs were first journaled. A truncated or corrupt line (e.g.,
+// from a crash mid-write) is logged and skipped.
+func (self *RunStore) Load() ([]*RunRecord, error) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    if _, err := self.file.Seek(0, io.SeekStart); err != nil {
+        return nil, err
+    }
+    records := make([]*RunRecord, 0)
+    recordIdxs := make(map[string]int)
+    reader := bufio.NewReader(self.file)
+    for lineNum := 1; ; lineNum++ {
+        line, readErr := reader.ReadBytes('\n')
+        if len(bytes.TrimSpace(line)) > 0 {
+            record := &RunRecord{}
+            if err := json.Unmarshal(line, record); err != nil || record.Id == "" {
+                errLog.Printf("Skipping bad journal entry %s:%d; err=%v\n", self.Path, lineNum, err)
+            } else if idx, exists := recordIdxs[record.Id]; exists {
+                records[idx] = record
+            } else {
+                recordIdxs[record.Id] = len(records)
+                records = append(records, record)
+            }
+        }
+        if readErr == io.EOF {
+            break
+        } else if readErr != nil {
+            return nil, readErr
+        }
+    }
+    return records, nil
+}
+
+// Append the current state of `scriptRun` to the journal
+func (self *RunStore) Save(scriptRun *ScriptRun) error {
+    jsonBytes, err := json.Marshal(scriptRun.Record())
+    if err != nil {
+        return err
+    }
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    _, err = self.file.Write(append(jsonBytes, '\n'))
+    return err
+}
+
+// Rewrite the journal so it contains exactly one record for each of
+// `scriptRuns`. The new journal is written to a temp file and renamed over
+// the old one.
+func (self *RunStore) Compact(scriptRuns []*ScriptRun) error {
+    var journalBuf bytes.Buffer
+    for _, scriptRun := range scriptRuns {
+        jsonBytes, err := json.Marshal(scriptRun.Record())
+        if err != nil {
+            return err
+        }
+        journalBuf.Write(jsonBytes)
+        journalBuf.WriteString("\n")
+    }
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    tmpPath := fmt.Sprintf("%s.tmp", self.Path)
+    if err := ioutil.WriteFile(tmpPath, journalBuf.Bytes(), 0600); err != nil {
+        return err
+    }
+    if err := os.Rename(tmpPath, self.Path); err != nil {
+        return err
+    }
+    file, err := os.OpenFile(self.Path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+    if err != nil {
+        return err
+    }
+    self.file.Close()
+    self.file = file
+    return nil
+}
+
+// Make a `ScriptRun` out of a journaled `RunRecord`. The original `Script`
+// may have changed or been removed since, so a stand-in `Script` is made from
+// what was recorded. Runs that were not finished when journaled were in
+// flight when the daemon went away. If one was started by a supervisor, it
+// is left unfinished for `reattach`; otherwise it is marked lost.
+func newScriptRunFromRecord(record *RunRecord) *ScriptRun {
+    script := &Script{
+        Name:          record.ScriptName,
+        ParsedTs:      record.ScriptTs,
+        ParamDefs:     make([]ScriptDef, 0),
+        OutputDefs:    make([]ScriptDef, 0),
+        Allows:        record.Allows,
+        KillGrace:     record.KillGrace,
+        TimeoutPaused: record.TimeoutPaused,
+        KeepWorkdir:   record.KeepWorkdir,
+    }
+    scriptRun := &ScriptRun{
+        Script:       script,
+        Id:           record.Id,
+        LogId:        record.LogId,
+        ScheduleId:   record.ScheduleId,
+        ExitCode:     record.ExitCode,
+        CpuSecs:      record.CpuSecs,
+        PeakMemory:   record.PeakMemory,
+        Workdir:      record.Workdir,
+        KillSignal:   record.KillSignal,
+        TermSignal:   record.TermSignal,
+        BashScript:   record.BashScript,
+        TimeoutSetTs: record.TimeoutSetTs,
+        TimeoutSet:   make(chan bool),
+        Timeout:      record.Timeout,
+        Params:       make(map[string]interface{}),
+        StartTs:      record.StartTs,
+        FinishTs:     record.FinishTs,
+        PausedTs:     record.PausedTs,
+        PausedSecs:   record.PausedSecs,
+        pausedAtSet:  record.PausedAtSet,
+        scriptPath:   record.ScriptPath,
+        Finished:     record.Finished,
+        State:        record.State,
+        LockKeys:     record.Locks,
+        Callbacks:    record.Callbacks,
+        Log:          newRunLog(record.Id),
+        Done:         make(chan bool),
+    }
+    for key, val := range record.Params {
+        scriptRun.Params[key] = val
+    }
+    if record.OutputDefs != nil {
+        // Keep the original order, which decides the output fds
+        for _, outputDef := range record.OutputDefs {
+            script.OutputDefs = append(script.OutputDefs, outputDef)
+            scriptRun.Outputs = append(scriptRun.Outputs, bytes.NewBufferString(record.Outputs[outputDef.Name]))
+        }
+    } else {
+        outputNames := make([]string, 0, len(record.Outputs))
+        for name := range record.Outputs {
+            outputNames = append(outputNames, name)
+        }
+        sort.Strings(outputNames)
+        for _, name := range outputNames {
+            script.OutputDefs = append(script.OutputDefs, ScriptDef{Name: name, Type: "w"})
+            scriptRun.Outputs = append(scriptRun.Outputs, bytes.NewBufferString(record.Outputs[name]))
+        }
+    }
+    scriptRun.OutputLocks = make([]sync.Mutex, len(scriptRun.Outputs))
+    if !scriptRun.Finished && hasSupervisor(record.Id) {
+        scriptRun.RunDir = getRunDir(record.Id)
+        return scriptRun
+    } else if !scriptRun.Finished {
+        scriptRun.Finished = true
+        scriptRun.State = STATE_LOST
+        scriptRun.ExitCode = -1
+    }
+    close(scriptRun.Done)
+    return scriptRun
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    "strings"
+    "testing"
+)
+
+// Make a finished `ScriptRun` of script `scriptName` for journaling
+func newTestScriptRun(id string, scriptName string, exitCode int) *ScriptRun {
+    return &ScriptRun{
+        Script:   &Script{Name: scriptName, OutputDefs: make([]ScriptDef, 0)},
+        Id:       id,
+        Params:   map[string]interface{}{"n": 1},
+        ExitCode: exitCode,
+        Finished: true,
+        State:    STATE_FINISHED,
+    }
+}
+
+func TestRunStoreLoad(t *testing.T) {
+    tests := []struct {
+        name       string
+        journal    string
+        expectIds  string
+        expectExit []int
+    }{
+        {"empty", "", "", nil},
+        {"one run", `{"Id":"a","ExitCode":1}` + "\n", "a", []int{1}},
+        {"last record wins", `{"Id":"a","ExitCode":1}` + "\n" + `{"Id":"b"}` + "\n" + `{"Id":"a","ExitCode":2}` + "\n", "ab", []int{2, 0}},
+        {"no trailing newline", `{"Id":"a"}` + "\n" + `{"Id":"b","ExitCode":3}`, "ab", []int{0, 3}},
+        {"truncated last line", `{"Id":"a"}` + "\n" + `{"Id":"b","Exi`, "a", []int{0}},
+        {"corrupt line", `{"Id":"a"}` + "\n" + "garbage\n" + `{"Id":"b"}` + "\n", "ab", []int{0, 0}},
+        {"no id", `{"ExitCode":1}` + "\n" + `{"Id":"a"}` + "\n", "a", []int{0}},
+        {"blank lines", "\n\n" + `{"Id":"a"}` + "\n\n", "a", []int{0}},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            stateDir := t.TempDir()
+            store, err := openRunStore(stateDir)
+            if err != nil {
+                t.Fatalf("openRunStore err=%v", err)
+            }
+            defer store.file.Close()
+            if err = ioutil.WriteFile(store.Path, []byte(test.journal), 0600); err != nil {
+                t.Fatalf("ioutil.WriteFile err=%v", err)
+            }
+            records, err := store.Load()
+            if err != nil {
+                t.Fatalf("Load err=%v", err)
+            }
+            ids := ""
+            for idx, record := range records {
+                ids += record.Id
+                if idx < len(test.expectExit) && record.ExitCode != test.expectExit[idx] {
+                    t.Errorf("Record %s has exit code %d, expected %d", record.Id, record.ExitCode, test.expectExit[idx])
+                }
+            }
+            if ids != test.expectIds {
+                t.Errorf("Loaded runs %q, expected %q", ids, test.expectIds)
+            }
+        })
+    }
+}
+
+func TestRunStoreSaveCompact(t *testing.T) {
+    stateDir := t.TempDir()
+    store, err := openRunStore(stateDir)
+    if err != nil {
+        t.Fatalf("openRunStore err=%v", err)
+    }
+    defer func() { store.file.Close() }()
+    runA := newTestScriptRun("a", "a.sh", 0)
+    runB := newTestScriptRun("b", "b.sh", 0)
+    for _, scriptRun := range []*ScriptRun{runA, runB, runA} {
+        if err = store.Save(scriptRun); err != nil {
+            t.Fatalf("Save err=%v", err)
+        }
+    }
+    runA.ExitCode = 7
+    store.Save(runA)
+    if journalBytes, _ := ioutil.ReadFile(store.Path); strings.Count(string(journalBytes), "\n") != 4 {
+        t.Errorf("Journal has %q, expected 4 records", journalBytes)
+    }
+
+    // Compact down to `runA` only, then keep appending to the new journal
+    if err = store.Compact([]*ScriptRun{runA}); err != nil {
+        t.Fatalf("Compact err=%v", err)
+    }
+    if _, err = os.Stat(store.Path + ".tmp"); !os.IsNotExist(err) {
+        t.Errorf("Compact left its temp file behind; err=%v", err)
+    }
+    runC := newTestScriptRun("c", "c.sh", 1)
+    store.Save(runC)
+    records, err := store.Load()
+    if err != nil {
+        t.Fatalf("Load err=%v", err)
+    }
+    if len(records) != 2 || records[0].Id != "a" || records[1].Id != "c" {
+        t.Fatalf("Loaded %d records after Compact, expected a and c", len(records))
+    }
+    if records[0].ExitCode != 7 || records[0].ScriptName != "a.sh" || records[0].Params["n"] != "1" {
+        t.Errorf("Loaded %+v, expected the last state of a", records[0].ScriptRunStatus)
+    }
+
+    // A reopened store sees the same journal
+    reopened, err := openRunStore(stateDir)
+    if err != nil {
+        t.Fatalf("openRunStore err=%v", err)
+    }
+    defer reopened.file.Close()
+    if records, err = reopened.Load(); err != nil || len(records) != 2 {
+        t.Errorf("Reopened store loaded %d records, err=%v", len(records), err)
+    }
+}
+
+func TestNewScriptRunFromRecord(t *testing.T) {
+    outputs := map[string]string{"b": "2", "a": "1"}
+    tests := []struct {
+        name          string
+        record        *RunRecord
+        expectState   string
+        expectExit    int
+        expectOutputs string
+    }{
+        {"finished", &RunRecord{ScriptRunStatus: ScriptRunStatus{Id: "a", Finished: true, State: STATE_FINISHED, ExitCode: 3}}, STATE_FINISHED, 3, ""},
+        {"in flight", &RunRecord{ScriptRunStatus: ScriptRunStatus{Id: "b", State: STATE_RUNNING}}, STATE_LOST, -1, ""},
+        {"output defs", &RunRecord{ScriptRunStatus: ScriptRunStatus{Id: "c", Finished: true, Outputs: outputs}, OutputDefs: []ScriptDef{{Name: "b"}, {Name: "a"}}}, "", 0, "b=2 a=1 "},
+        {"no output defs", &RunRecord{ScriptRunStatus: ScriptRunStatus{Id: "d", Finished: true, Outputs: outputs}}, "", 0, "a=1 b=2 "},
+    }
+    for _, test := range tests {
+        scriptRun := newScriptRunFromRecord(test.record)
+        if scriptRun.Id != test.record.Id || !scriptRun.Finished || scriptRun.State != test.expectState || scriptRun.ExitCode != test.expectExit {
+            t.Errorf("%s: restored id=%s finished=%t state=%s exit=%d", test.name, scriptRun.Id, scriptRun.Finished, scriptRun.State, scriptRun.ExitCode)
+        }
+        restoredOutputs := ""
+        for idx, outputDef := range scriptRun.Script.OutputDefs {
+            restoredOutputs += fmt.Sprintf("%s=%s ", outputDef.Name, scriptRun.Outputs[idx].String())
+        }
+        if restoredOutputs != test.expectOutputs {
+            t.Errorf("%s: restored outputs %q, expected %q", test.name, restoredOutputs, test.expectOutputs)
+        }
+        select {
+        case <-scriptRun.Done:
+        default:
+            t.Errorf("%s: Done is not closed", test.name)
+        }
+    }
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "syscall"
+    "time"
+)
+
+// With `-detach-runs` and a state dir, each `ScriptRun` gets a run dir in the
+// state dir and its script is started by a supervisor: a copy of gobashd run
+// with `-supervise <run dir>`. The supervisor starts the script in its own process group with
+// its stdout, stderr, and other fds appending to files in the run dir, holds
+// a lock on the run dir until the script exits, and then records its wait
+// status there. The supervisor is in its own session and does not need the
+// daemon, so the script keeps running if the daemon goes away. Its exit file
+// holds the wait status, CPU usecs, and max RSS bytes of the script. The daemon
+// tails the files for output, and a restarted daemon reattaches to the run by
+// tailing them again and waiting on the lock.
+const (
+    RUN_FILE_LOCK = "lock"
+    RUN_FILE_PID  = "pid"
+    RUN_FILE_EXIT = "exit"
+
+    TAIL_POLL_MS = 100
+)
+
+var errRunLost = errors.New("Supervisor exited without recording an exit status")
+
+// A `tailReader` reads a file that is still being appended to. At the end of
+// the file it polls for more until `done` is closed.
+type tailReader struct {
+    file *os.File
+    done chan bool
+}
+
+func (self *tailReader) Read(buf []byte) (int, error) {
+    for {
+        n, err := self.file.Read(buf)
+        if n > 0 || err != io.EOF {
+            return n, err
+        }
+        select {
+        case <-self.done:
+            // Pick up anything written just before `done`
+            return self.file.Read(buf)
+        case <-time.After(TAIL_POLL_MS * time.Millisecond):
+        }
+    }
+}
+
+func (self *tailReader) Close() error {
+    return self.file.Close()
+}
+
+// Return the run dir of the run with id `id`
+func getRunDir(id string) string {
+    return filepath.Join(config.StateDir, "runs", id)
+}
+
+// Return the path of the file in `runDir` that fd `fd` of the script appends
+// to
+func getRunFdPath(runDir string, fd int) string {
+    return filepath.Join(runDir, fmt.Sprintf("fd.%d", fd))
+}
+
+// Return whether the run with id `id` was started by a supervisor, which may
+// still be running
+func hasSupervisor(id string) bool {
+    if config.StateDir == "" {
+        return false
+    }
+    _, err := os.Stat(filepath.Join(getRunDir(id), RUN_FILE_PID))
+    return err == nil
+}
+
+// Write `content` to file `name` in `runDir` atomically
+func writeRunFile(runDir string, name string, content string) error {
+    path := filepath.Join(runDir, name)
+    tmpPath := fmt.Sprintf("%s.tmp", path)
+    if err := ioutil.WriteFile(tmpPath, []byte(content), 0600); err != nil {
+        return err
+    }
+    return os.Rename(tmpPath, path)
+}
+
+// Read the space-separated integers in file `name` in `runDir`
+func readRunFile(runDir string, name string) ([]int64, error) {
+    content, err := ioutil.ReadFile(filepath.Join(runDir, name))
+    if err != nil {
+        return nil, err
+    }
+    vals := make([]int64, 0)
+    for _, field := range strings.Fields(string(content)) {
+        val, err := strconv.ParseInt(field, 10, 64)
+        if err != nil {
+            return nil, err
+        }
+        vals = append(vals, val)
+    }
+    if len(vals) == 0 {
+        return nil, errors.New(fmt.Sprintf("Empty run file %s", name))
+    }
+    return vals, nil
+}
+
+// Run the command `args` as the script of the run in `runDir` and wait for
+// it. This is the entry point of `-supervise`. Report the pid of the script,
+// or an error, on stdout, then record its wait status and usage. Return the
+// exit code of the supervisor.
+func superviseRun(runDir string, args []string) int {
+    lockFile, cmd, err := startSupervisedScript(runDir, args)
+    if err != nil {
+        fmt.Printf("error %v\n", err)
+        return 1
+    }
+    defer lockFile.Close()
+    fmt.Printf("%d\n", cmd.Process.Pid)
+    os.Stdout.Close()
+    cmd.Wait()
+    status, _ := cmd.ProcessState.Sys().(syscall.WaitStatus)
+    var cpuUsecs, maxRssBytes int64
+    if rusage, isRusage := cmd.ProcessState.SysUsage().(*syscall.Rusage); isRusage {
+        cpuUsecs = (rusage.Utime.Nano() + rusage.Stime.Nano()) / 1000
+        maxRssBytes = getMaxRssBytes(rusage)
+    }
+    if err = writeRunFile(runDir, RUN_FILE_EXIT, fmt.Sprintf("%d %d %d\n", uint32(status), cpuUsecs, maxRssBytes)); err != nil {
+        return 1
+    }
+    return 0
+}
+
+// Lock `runDir` and start `args` in its own process group with its fds
+// appending to the run files. Return the lock file, which must stay open
+// until the script exits, and the started command.
+func startSupervisedScript(runDir string, args []string) (*os.File, *exec.Cmd, error) {
+    if len(args) == 0 {
+        return nil, nil, errors.New("No command to supervise")
+    }
+    lockFile, err := os.OpenFile(filepath.Join(runDir, RUN_FILE_LOCK), os.O_RDWR|os.O_CREATE, 0600)
+    if err != nil {
+        return nil, nil, err
+    } else if err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+        lockFile.Close()
+        return nil, nil, err
+    }
+    cmd := exec.Command(args[0], args[1:]...)
+    cmd.Stdin = os.Stdin
+    cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true} // Make separate process group
+    for fd := FD_STDOUT; ; fd++ {
+        file, fileErr := os.OpenFile(getRunFdPath(runDir, fd), os.O_WRONLY|os.O_APPEND, 0)
+        if os.IsNotExist(fileErr) && fd > FD_STDERR {
+            break
+        } else if fileErr != nil {
+            lockFile.Close()
+            return nil, nil, fileErr
+        }
+        defer file.Close()
+        if fd == FD_STDOUT {
+            cmd.Stdout = file
+        } else if fd == FD_STDERR {
+            cmd.Stderr = file
+        } else {
+            cmd.ExtraFiles = append(cmd.ExtraFiles, file)
+        }
+    }
+    if err = cmd.Start(); err != nil {
+        lockFile.Close()
+        return nil, nil, err
+    } else if err = writeRunFile(runDir, RUN_FILE_PID, fmt.Sprintf("%d\n", cmd.Process.Pid)); err != nil {
+        syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+        cmd.Wait()
+        lockFile.Close()
+        return nil, nil, err
+    }
+    return lockFile, cmd, nil
+}
+
+// Make the run dir with an empty file for each fd of the script, and tail
+// them. This is the supervised counterpart of `makePipes`.
+func (self *ScriptRun) makeRunFiles() error {
+    if err := os.MkdirAll(self.RunDir, 0700); err != nil {
+        return err
+    }
+    self.tailDone = make(chan bool)
+    for fd := FD_STDOUT; fd <= self.getLastFd(); fd++ {
+        file, err := os.OpenFile(getRunFdPath(self.RunDir, fd), os.O_RDONLY|os.O_CREATE|os.O_TRUNC, 0600)
+        if err != nil {
+            return err
+        }
+        self.tailRunFile(fd, file, 0)
+    }
+    return nil
+}
+
+// Tail `file`, the run file of fd `fd`, in a go routine. See `readOutput`
+// for `replayBytes`.
+func (self *ScriptRun) tailRunFile(fd int, file *os.File, replayBytes int64) {
+    reader := &tailReader{file: file, done: self.tailDone}
+    self.ExtraPipes = append(self.ExtraPipes, reader)
+    self.readers.Add(1)
+    go func() {
+        defer self.readers.Done()
+        self.readOutput(fd, reader, replayBytes)
+    }()
+}
+
+// Start the supervisor, which starts the script, then wait for both to exit
+// and for the run files to be read
+func (self *ScriptRun) startAndWaitSupervised() error {
+    self.StartTs = time.Now().Unix()
+    self.State = STATE_RUNNING
+    supervisorCmd, err := self.startSupervisor()
+    if err != nil {
+        close(self.tailDone)
+        self.waitForReaders()
+        return err
+    }
+    self.save()
+    supervisorCmd.Wait() // The script's wait status is in the run dir
+    return self.finishSupervised()
+}
+
+// Start `Cmd` under a supervisor and set `Pgid` to its pid. Return the
+// supervisor's command.
+func (self *ScriptRun) startSupervisor() (*exec.Cmd, error) {
+    exePath, err := os.Executable()
+    if err != nil {
+        return nil, err
+    }
+    args := append([]string{"-supervise", self.RunDir, "--", self.Cmd.Path}, self.Cmd.Args[1:]...)
+    supervisorCmd := exec.Command(exePath, args...)
+    supervisorCmd.Env = self.Cmd.Env
+    supervisorCmd.Dir = self.Cmd.Dir
+    supervisorCmd.Stdin = self.Cmd.Stdin
+    supervisorCmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true} // Outlive the daemon
+    stdout, err := supervisorCmd.StdoutPipe()
+    if err != nil {
+        return nil, err
+    } else if err = supervisorCmd.Start(); err != nil {
+        return nil, err
+    }
+    reply, err := bufio.NewReader(stdout).ReadString('\n')
+    reply = strings.TrimSpace(reply)
+    if err != nil || strings.HasPrefix(reply, "error ") {
+        supervisorCmd.Wait()
+        if err == nil {
+            err = errors.New(strings.TrimPrefix(reply, "error "))
+        }
+        return nil, err
+    }
+    if self.Pgid, err = strconv.Atoi(reply); err != nil {
+        supervisorCmd.Wait()
+        return nil, err
+    }
+    return supervisorCmd, nil
+}
+
+// Pick a supervised run back up after a daemon restart. Everything already
+// in the run files is replayed into the `RunLog` and outputs. The run then
+// times out and finishes as if `run` had started it. If the script exited
+// while the daemon was away, it finishes right away.
+func (self *ScriptRun) reattach() {
+    defer self.removeScriptFile()
+    state := STATE_FINISHED
+    if err := self.reopenRunFiles(); err != nil {
+        self.logErr("Failed to reattach; err=%v\n", err)
+        self.killLostRun()
+        self.ExitCode = -1
+        state = STATE_LOST
+    } else {
+        self.logInfo("Reattached to process group %d\n", self.Pgid)
+        if runErr := self.runWithTimeout(self.waitReattached); runErr != nil {
+            self.logErr("Supervisor went away; err=%v\n", runErr)
+            self.killLostRun()
+            self.ExitCode = -1
+            state = STATE_LOST
+        }
+    }
+    self.finishCgroup()
+    self.cleanWorkdir(state)
+    self.markFinished(state)
+}
+
+// Open and tail the run files of a run being reattached, replaying what is
+// already in them
+func (self *ScriptRun) reopenRunFiles() error {
+    pid, err := readRunFile(self.RunDir, RUN_FILE_PID)
+    if err != nil {
+        return err
+    }
+    self.Pgid = int(pid[0])
+    // The old `RunLog` may be partial; rebuild it from the run files
+    if err = self.Log.Remove(); err != nil {
+        return err
+    }
+    self.Log = newRunLog(self.Id)
+    for _, output := range self.Outputs {
+        output.Reset()
+    }
+    self.tailDone = make(chan bool)
+    for fd := FD_STDOUT; fd <= self.getLastFd(); fd++ {
+        file, err := os.Open(getRunFdPath(self.RunDir, fd))
+        if os.IsNotExist(err) && fd == self.getArtifactFd() {
+            // Started by a gobashd without `_artifact`
+            continue
+        } else if err != nil {
+            close(self.tailDone)
+            return err
+        }
+        fileInfo, err := file.Stat()
+        if err != nil {
+            file.Close()
+            close(self.tailDone)
+            return err
+        }
+        self.tailRunFile(fd, file, fileInfo.Size())
+    }
+    return nil
+}
+
+// Wait for the supervisor of a reattached run to release its lock, then for
+// the run files to be read
+func (self *ScriptRun) waitReattached() error {
+    lockFile, err := os.Open(filepath.Join(self.RunDir, RUN_FILE_LOCK))
+    if err != nil {
+        close(self.tailDone)
+        self.waitForReaders()
+        return err
+    }
+    defer lockFile.Close()
+    for {
+        if err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX); err != syscall.EINTR {
+            break
+        }
+    }
+    if err != nil {
+        self.logErr("syscall.Flock failed err=%v\n", err)
+    }
+    return self.finishSupervised()
+}
+
+// Stop tailing the run files once they are fully read, then set the exit code
+// and usage from what the supervisor recorded
+func (self *ScriptRun) finishSupervised() error {
+    close(self.tailDone)
+    self.waitForReaders()
+    exit, err := readRunFile(self.RunDir, RUN_FILE_EXIT)
+    if os.IsNotExist(err) {
+        return errRunLost
+    } else if err != nil {
+        return err
+    }
+    self.setExitStatus(syscall.WaitStatus(exit[0]))
+    if len(exit) >= 3 {
+        self.CpuSecs = float64(exit[1]) / 1e6
+        self.PeakMemory = exit[2]
+    }
+    return nil
+}
+
+// Kill what is left of the process group of a run whose supervisor went away.
+// Once the run is lost, its slot and locks are released, so nothing may be
+// left running that another run could collide with. After a reboot or a
+// supervisor crash, `Pgid` may have been reused, so the group is only killed
+// if it is still this run's (see `isRunProcessGroup`).
+func (self *ScriptRun) killLostRun() {
+    if self.Pgid == 0 {
+        return
+    } else if !self.isRunProcessGroup() {
+        self.logInfo("Not killing process group %d; no process in it belongs to this run\n", self.Pgid)
+        return
+    }
+    self.logInfo("Sending KILL to process group %d\n", self.Pgid)
+    if err := syscall.Kill(-self.Pgid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+        self.logErr("syscall.Kill failed err=%v\n", err)
+    }
+}
+
+// Return whether a process in process group `Pgid` has this run's
+// `GOBASHD_RUN_ID` in its environment. A pgid is not reused while any process
+// is still in the group, so one such process is enough. Return false if that
+// cannot be told, e.g., without `/proc`.
+func (self *ScriptRun) isRunProcessGroup() bool {
+    procNames, err := ioutil.ReadDir("/proc")
+    if err != nil {
+        return false
+    }
+    runIdVar := []byte(fmt.Sprintf("GOBASHD_RUN_ID=%s", self.Id))
+    for _, procName := range procNames {
+        if _, err := strconv.Atoi(procName.Name()); err != nil {
+            continue
+        }
+        stat, err := ioutil.ReadFile(filepath.Join("/proc", procName.Name(), "stat"))
+        if err != nil {
+            continue
+        }
+        // The fields after `comm`, which may contain spaces and parens, are
+        // state, ppid, and pgrp
+        fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+        if len(fields) < 3 || fields[2] != strconv.Itoa(self.Pgid) {
+            continue
+        }
+        environ, err := ioutil.ReadFile(filepath.Join("/proc", procName.Name(), "environ"))
+        if err != nil {
+            continue
+        }
+        for _, envVar := range bytes.Split(environ, []byte{0}) {
+            if bytes.Equal(envVar, runIdVar) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// Remove the run dir once the run is finished and journaled
+func (self *ScriptRun) removeRunDir() {
+    if self.RunDir == "" {
+        return
+    }
+    if err := os.RemoveAll(self.RunDir); err != nil {
+        self.logErr("os.RemoveAll failed err=%v\n", err)
+    }
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+    "io/ioutil"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "syscall"
+    "testing"
+    "time"
+)
+
+func TestReadRunFile(t *testing.T) {
+    tests := []struct {
+        content   string
+        expect    []int64
+        expectErr bool
+    }{
+        {"1234\n", []int64{1234}, false},
+        {"0 1500 4096\n", []int64{0, 1500, 4096}, false},
+        {"  -1\t2 ", []int64{-1, 2}, false},
+        {"", nil, true},
+        {"\n", nil, true},
+        {"12 abc\n", nil, true},
+    }
+    runDir := t.TempDir()
+    for _, test := range tests {
+        if err := writeRunFile(runDir, RUN_FILE_EXIT, test.content); err != nil {
+            t.Fatalf("writeRunFile err=%v", err)
+        }
+        vals, err := readRunFile(runDir, RUN_FILE_EXIT)
+        if (err != nil) != test.expectErr {
+            t.Errorf("readRunFile of %q err=%v, expected err %t", test.content, err, test.expectErr)
+        } else if len(vals) != len(test.expect) {
+            t.Errorf("readRunFile of %q returned %v, expected %v", test.content, vals, test.expect)
+        } else {
+            for idx := range vals {
+                if vals[idx] != test.expect[idx] {
+                    t.Errorf("readRunFile of %q returned %v, expected %v", test.content, vals, test.expect)
+                }
+            }
+        }
+    }
+    if _, err := os.Stat(filepath.Join(runDir, RUN_FILE_EXIT+".tmp")); !os.IsNotExist(err) {
+        t.Errorf("writeRunFile left its temp file behind; err=%v", err)
+    }
+    if _, err := readRunFile(runDir, RUN_FILE_PID); !os.IsNotExist(err) {
+        t.Errorf("readRunFile of a missing file err=%v", err)
+    }
+}
+
+func TestStartSupervisedScript(t *testing.T) {
+    runDir := t.TempDir()
+    for fd := FD_STDOUT; fd <= FD_STDERR+1; fd++ {
+        if err := ioutil.WriteFile(getRunFdPath(runDir, fd), nil, 0600); err != nil {
+            t.Fatalf("ioutil.WriteFile err=%v", err)
+        }
+    }
+    lockFile, cmd, err := startSupervisedScript(runDir, []string{"sh", "-c", "echo out; echo err >&2; echo three >&3"})
+    if err != nil {
+        t.Fatalf("startSupervisedScript err=%v", err)
+    }
+
+    // The run dir stays locked until the script exits
+    if _, _, err = startSupervisedScript(runDir, []string{"true"}); err == nil {
+        t.Errorf("startSupervisedScript of a locked run dir succeeded")
+    }
+    cmd.Wait()
+    lockFile.Close()
+
+    if pids, err := readRunFile(runDir, RUN_FILE_PID); err != nil || pids[0] != int64(cmd.Process.Pid) {
+        t.Errorf("Pid file has %v, expected %d; err=%v", pids, cmd.Process.Pid, err)
+    }
+    for fd, expect := range map[int]string{FD_STDOUT: "out\n", FD_STDERR: "err\n", FD_STDERR + 1: "three\n"} {
+        if content, _ := ioutil.ReadFile(getRunFdPath(runDir, fd)); string(content) != expect {
+            t.Errorf("fd %d file has %q, expected %q", fd, content, expect)
+        }
+    }
+    if _, _, err = startSupervisedScript(runDir, nil); err == nil {
+        t.Errorf("startSupervisedScript without a command succeeded")
+    }
+}
+
+func TestTailReader(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "fd.1")
+    writeFile, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+    if err != nil {
+        t.Fatalf("os.OpenFile err=%v", err)
+    }
+    defer writeFile.Close()
+    readFile, err := os.Open(path)
+    if err != nil {
+        t.Fatalf("os.Open err=%v", err)
+    }
+    reader := &tailReader{file: readFile, done: make(chan bool)}
+    defer reader.Close()
+    writeFile.WriteString("one\n")
+    go func() {
+        time.Sleep(2 * TAIL_POLL_MS * time.Millisecond)
+        writeFile.WriteString("two\n")
+        time.Sleep(2 * TAIL_POLL_MS * time.Millisecond)
+        writeFile.WriteString("three\n")
+        close(reader.done)
+    }()
+    content, err := ioutil.ReadAll(reader)
+    if err != nil {
+        t.Errorf("ioutil.ReadAll err=%v", err)
+    } else if string(content) != "one\ntwo\nthree\n" {
+        t.Errorf("Read %q, expected all three lines", content)
+    }
+}
+
+func TestIsRunProcessGroup(t *testing.T) {
+    cmd := exec.Command("sh", "-c", "sleep 10 & wait")
+    cmd.Env = append(os.Environ(), "GOBASHD_RUN_ID=abc")
+    cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+    if err := cmd.Start(); err != nil {
+        t.Fatalf("cmd.Start err=%v", err)
+    }
+    defer cmd.Wait()
+    defer syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+    tests := []struct {
+        name   string
+        id     string
+        pgid   int
+        expect bool
+    }{
+        {"own group", "abc", cmd.Process.Pid, true},
+        {"other run", "abd", cmd.Process.Pid, false},
+        {"run id prefix", "ab", cmd.Process.Pid, false},
+        {"other group", "abc", syscall.Getpgrp(), false},
+    }
+    for _, test := range tests {
+        scriptRun := &ScriptRun{Id: test.id, Pgid: test.pgid}
+        if isRun := scriptRun.isRunProcessGroup(); isRun != test.expect {
+            t.Errorf("%s: isRunProcessGroup returned %t, expected %t", test.name, isRun, test.expect)
+        }
+    }
+
+    // Only the leader is gone; its child keeps the group
+    cmd.Process.Signal(syscall.SIGKILL)
+    cmd.Wait()
+    scriptRun := &ScriptRun{Id: "abc", Pgid: cmd.Process.Pid}
+    if !scriptRun.isRunProcessGroup() {
+        t.Errorf("isRunProcessGroup returned false with the leader gone")
+    }
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "sync"
+)
+
+// A `TlsLoader` holds the certificate, key, and client CA pool shared by both
+// listeners. `Reload` re-reads them from disk; connections accepted afterward
+// use the new ones.
+type TlsLoader struct {
+    CertPath          string
+    KeyPath           string
+    CaPath            string
+    RequireClientCert bool
+    cert              *tls.Certificate
+    clientCas         *x509.CertPool
+    lock              sync.Mutex
+}
+
+// Make a `TlsLoader` and load the certificate, key, and (if `caPath` is not
+// empty) client CAs
+func newTlsLoader(certPath string, keyPath string, caPath string, requireClientCert bool) (*TlsLoader, error) {
+    if requireClientCert && caPath == "" {
+        return nil, errors.New("Requiring client certs requires a CA file")
+    }
+    loader := &TlsLoader{
+        CertPath:          certPath,
+        KeyPath:           keyPath,
+        CaPath:            caPath,
+        RequireClientCert: requireClientCert,
+    }
+    if err := loader.Reload(); err != nil {
+        return nil, err
+    }
+    return loader, nil
+}
+
+// Re-read the certificate, key, and client CAs. On error, the previously
+// loaded ones remain in effect.
+func (self *TlsLoader) Reload() error {
+    cert, err := tls.LoadX509KeyPair(self.CertPath, self.KeyPath)
+    if err != nil {
+        return err
+    }
+    var clientCas *x509.CertPool
+    if self.CaPath != "" {
+        caBytes, readErr := ioutil.ReadFile(self.CaPath)
+        if readErr != nil {
+            return readErr
+        }
+        clientCas = x509.NewCertPool()
+        if !clientCas.AppendCertsFromPEM(caBytes) {
+            return errors.New(fmt.Sprintf("No PEM certificates found in %s", self.CaPath))
+        }
+    }
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.cert = &cert
+    self.clientCas = clientCas
+    return nil
+}
+
+// Return a `tls.Config` for a listener. The config is resolved per
+// connection, so it always reflects the last successful `Reload`.
+func (self *TlsLoader) Config() *tls.Config {
+    return &tls.Config{
+        MinVersion: tls.VersionTLS12,
+        GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+            self.lock.Lock()
+            defer self.lock.Unlock()
+            connConfig := &tls.Config{
+                MinVersion:   tls.VersionTLS12,
+                Certificates: []tls.Certificate{*self.cert},
+                ClientCAs:    self.clientCas,
+                ClientAuth:   tls.NoClientCert,
+            }
+            if self.clientCas != nil && self.RequireClientCert {
+                connConfig.ClientAuth = tls.RequireAndVerifyClientCert
+            } else if self.clientCas != nil {
+                connConfig.ClientAuth = tls.VerifyClientCertIfGiven
+            }
+            return connConfig, nil
+        },
+    }
+}
+
+// Return the verified client certificate of a TLS connection, or nil if the
+// client did not present one
+func getVerifiedClientCert(state *tls.ConnectionState) *x509.Certificate {
+    if state == nil || len(state.VerifiedChains) < 1 || len(state.VerifiedChains[0]) < 1 {
+        return nil
+    }
+    return state.VerifiedChains[0][0]
+}
+
+// Return the `Principal` for a verified client certificate. With an
+// `Authenticator`, the certificate must match one of its entries. Without
+// one, the certificate's common name is taken as is.
+func getClientCertPrincipal(authenticator Authenticator, clientCert *x509.Certificate) *Principal {
+    if clientCert == nil {
+        return nil
+    } else if authenticator == nil {
+        return &Principal{Name: clientCert.Subject.CommonName, Groups: make([]string, 0)}
+    }
+    principal, err := authenticator.CheckClientCert(clientCert)
+    if err != nil {
+        return nil
+    }
+    return principal
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/pem"
+    "io/ioutil"
+    "math/big"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+// Write a self-signed certificate with common name `name` and its key to
+// `dir`. Return the cert and key paths.
+func writeTestCert(t *testing.T, dir string, name string) (string, string) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatalf("ecdsa.GenerateKey err=%v", err)
+    }
+    template := &x509.Certificate{
+        SerialNumber:          big.NewInt(1),
+        Subject:               pkix.Name{CommonName: name},
+        NotBefore:             time.Now().Add(-time.Hour),
+        NotAfter:              time.Now().Add(time.Hour),
+        IsCA:                  true,
+        BasicConstraintsValid: true,
+        KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+    }
+    certDer, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        t.Fatalf("x509.CreateCertificate err=%v", err)
+    }
+    keyDer, err := x509.MarshalECPrivateKey(key)
+    if err != nil {
+        t.Fatalf("x509.MarshalECPrivateKey err=%v", err)
+    }
+    certPath := filepath.Join(dir, "cert.pem")
+    keyPath := filepath.Join(dir, "key.pem")
+    ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer}), 0600)
+    ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+    return certPath, keyPath
+}
+
+// Return the config `loader` would use for a new connection
+func getTestConnConfig(t *testing.T, loader *TlsLoader) *tls.Config {
+    connConfig, err := loader.Config().GetConfigForClient(&tls.ClientHelloInfo{})
+    if err != nil {
+        t.Fatalf("GetConfigForClient err=%v", err)
+    }
+    return connConfig
+}
+
+// Return the common name of the certificate served with `connConfig`
+func getTestServedName(t *testing.T, connConfig *tls.Config) string {
+    cert, err := x509.ParseCertificate(connConfig.Certificates[0].Certificate[0])
+    if err != nil {
+        t.Fatalf("x509.ParseCertificate err=%v", err)
+    }
+    return cert.Subject.CommonName
+}
+
+func TestNewTlsLoader(t *testing.T) {
+    dir := t.TempDir()
+    certPath, keyPath := writeTestCert(t, dir, "old")
+    garbagePath := filepath.Join(dir, "garbage")
+    ioutil.WriteFile(garbagePath, []byte("garbage"), 0600)
+    tests := []struct {
+        name              string
+        keyPath           string
+        caPath            string
+        requireClientCert bool
+        expectErr         bool
+        expectClientAuth  tls.ClientAuthType
+    }{
+        {"no CA", keyPath, "", false, false, tls.NoClientCert},
+        {"CA", keyPath, certPath, false, false, tls.VerifyClientCertIfGiven},
+        {"CA required", keyPath, certPath, true, false, tls.RequireAndVerifyClientCert},
+        {"required without CA", keyPath, "", true, true, 0},
+        {"bad key", garbagePath, "", false, true, 0},
+        {"CA without certs", keyPath, garbagePath, false, true, 0},
+        {"missing CA", keyPath, filepath.Join(dir, "missing"), false, true, 0},
+    }
+    for _, test := range tests {
+        loader, err := newTlsLoader(certPath, test.keyPath, test.caPath, test.requireClientCert)
+        if (err != nil) != test.expectErr {
+            t.Errorf("%s: newTlsLoader err=%v, expected err %t", test.name, err, test.expectErr)
+            continue
+        } else if err != nil {
+            continue
+        }
+        if clientAuth := getTestConnConfig(t, loader).ClientAuth; clientAuth != test.expectClientAuth {
+            t.Errorf("%s: ClientAuth is %v, expected %v", test.name, clientAuth, test.expectClientAuth)
+        }
+    }
+}
+
+func TestTlsLoaderReload(t *testing.T) {
+    dir := t.TempDir()
+    certPath, keyPath := writeTestCert(t, dir, "old")
+    loader, err := newTlsLoader(certPath, keyPath, "", false)
+    if err != nil {
+        t.Fatalf("newTlsLoader err=%v", err)
+    }
+    tlsConfig := loader.Config()
+
+    // A bad key leaves the old certificate in effect
+    ioutil.WriteFile(keyPath, []byte("garbage"), 0600)
+    if err = loader.Reload(); err == nil {
+        t.Errorf("Reload with a bad key succeeded")
+    } else if name := getTestServedName(t, getTestConnConfig(t, loader)); name != "old" {
+        t.Errorf("Serving %q after a failed Reload, expected %q", name, "old")
+    }
+
+    // A config made before the reload serves the new certificate
+    writeTestCert(t, dir, "new")
+    if err = loader.Reload(); err != nil {
+        t.Errorf("Reload err=%v", err)
+    }
+    connConfig, err := tlsConfig.GetConfigForClient(&tls.ClientHelloInfo{})
+    if err != nil {
+        t.Fatalf("GetConfigForClient err=%v", err)
+    } else if name := getTestServedName(t, connConfig); name != "new" {
+        t.Errorf("Serving %q after Reload, expected %q", name, "new")
+    }
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "syscall"
+)
+
+// Each run gets a private work dir named after its id under the work dir
+// root, `-workdir-root` or `gobashd-work` in the system temp dir. The script
+// starts in it, finds it in `GOBASHD_WORKDIR`, and may leave scratch files in
+// it. Once the run finishes, the script's `@keep_workdir` decides whether the
+// work dir is kept: `on_failure` (the default) keeps it if the run did not
+// exit 0, so its scratch files can be looked at, `always` keeps it, and
+// `never` removes it.
+
+// Return the dir under which runs get their work dirs. Unlike the state dir,
+// the default must be passable for the users of `@run_as`.
+func getWorkdirRoot() string {
+    if config.WorkdirRoot != "" {
+        return config.WorkdirRoot
+    }
+    return filepath.Join(os.TempDir(), "gobashd-work")
+}
+
+// Make the work dir of this run and set `Workdir` to it
+func (self *ScriptRun) makeWorkdir() error {
+    root := getWorkdirRoot()
+    if err := os.MkdirAll(root, 0711); err != nil {
+        return err
+    }
+    // Someone else may have made the root first, e.g., in a shared temp dir
+    if rootInfo, err := os.Lstat(root); err != nil {
+        return err
+    } else if !rootInfo.IsDir() || rootInfo.Sys().(*syscall.Stat_t).Uid != uint32(os.Getuid()) {
+        return errors.New(fmt.Sprintf("Work dir root %s is not a dir owned by gobashd's user", root))
+    }
+    workdir := filepath.Join(root, self.Id)
+    if err := os.Mkdir(workdir, 0700); err != nil {
+        return err
+    }
+    self.Workdir = workdir
+    if self.Script.Credential != nil {
+        return os.Chown(workdir, int(self.Script.Credential.Uid), int(self.Script.Credential.Gid))
+    }
+    return nil
+}
+
+// Remove the work dir of this run, which is finishing with `state`, or keep
+// it, as `@keep_workdir` says. `Workdir` is cleared if it is removed.
+func (self *ScriptRun) cleanWorkdir(state string) {
+    if self.Workdir == "" {
+        return
+    }
+    failed := state != STATE_FINISHED || self.ExitCode != 0
+    if self.Script.KeepWorkdir == "always" || (self.Script.KeepWorkdir == "on_failure" && failed) {
+        self.logInfo("Kept workdir %s\n", self.Workdir)
+        return
+    }
+    self.removeWorkdir()
+}
+
+// Remove the work dir of this run, if it still has one, e.g., when the run is
+// purged. `Workdir` is cleared if it is removed.
+func (self *ScriptRun) removeWorkdir() {
+    if self.Workdir == "" {
+        return
+    }
+    if err := os.RemoveAll(self.Workdir); err != nil {
+        self.logErr("os.RemoveAll failed err=%v\n", err)
+        return
+    }
+    self.Workdir = ""
+}
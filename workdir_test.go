@@ -0,0 +1,126 @@
+package main
+
+import (
+    "io/ioutil"
+    "os"
+    "os/user"
+    "path/filepath"
+    "strconv"
+    "syscall"
+    "testing"
+)
+
+func TestMakeWorkdir(t *testing.T) {
+    defer func(root string) { config.WorkdirRoot = root }(config.WorkdirRoot)
+    tests := []struct {
+        name      string
+        setup     func(root string)
+        expectErr bool
+    }{
+        {"new root", func(root string) {}, false},
+        {"existing root", func(root string) { os.Mkdir(root, 0700) }, false},
+        {"root is a file", func(root string) { ioutil.WriteFile(root, nil, 0600) }, true},
+        {"root is a symlink", func(root string) {
+            os.Mkdir(root+".real", 0700)
+            os.Symlink(root+".real", root)
+        }, true},
+        {"run dir exists", func(root string) { os.MkdirAll(filepath.Join(root, "abc"), 0700) }, true},
+    }
+    for _, test := range tests {
+        config.WorkdirRoot = filepath.Join(t.TempDir(), "work")
+        test.setup(config.WorkdirRoot)
+        scriptRun := &ScriptRun{Script: &Script{Name: "a.sh"}, Id: "abc"}
+        err := scriptRun.makeWorkdir()
+        if (err != nil) != test.expectErr {
+            t.Errorf("%s: makeWorkdir err=%v, expected err %t", test.name, err, test.expectErr)
+            continue
+        } else if err != nil {
+            if scriptRun.Workdir != "" {
+                t.Errorf("%s: Workdir is %s after failing", test.name, scriptRun.Workdir)
+            }
+            continue
+        }
+        expected := filepath.Join(config.WorkdirRoot, "abc")
+        if scriptRun.Workdir != expected {
+            t.Errorf("%s: Workdir is %s, expected %s", test.name, scriptRun.Workdir, expected)
+        } else if fileInfo, statErr := os.Stat(expected); statErr != nil {
+            t.Errorf("%s: os.Stat err=%v", test.name, statErr)
+        } else if fileInfo.Mode().Perm() != 0700 {
+            t.Errorf("%s: work dir mode is %o, expected 700", test.name, fileInfo.Mode().Perm())
+        }
+    }
+
+    config.WorkdirRoot = ""
+    if root := getWorkdirRoot(); root != filepath.Join(os.TempDir(), "gobashd-work") {
+        t.Errorf("getWorkdirRoot returned %s without -workdir-root", root)
+    }
+}
+
+func TestMakeWorkdirRunAs(t *testing.T) {
+    defer func(root string) { config.WorkdirRoot = root }(config.WorkdirRoot)
+    if os.Getuid() != 0 {
+        t.Skip("Only root can chown work dirs")
+    }
+    credential, err := lookupCredential("nobody")
+    if err != nil {
+        t.Skipf("lookupCredential err=%v", err)
+    }
+    config.WorkdirRoot = filepath.Join(t.TempDir(), "work")
+    scriptRun := &ScriptRun{Script: &Script{Name: "a.sh", Credential: credential}, Id: "abc"}
+    if err = scriptRun.makeWorkdir(); err != nil {
+        t.Fatalf("makeWorkdir err=%v", err)
+    }
+    fileInfo, err := os.Stat(scriptRun.Workdir)
+    if err != nil {
+        t.Fatalf("os.Stat err=%v", err)
+    } else if uid := fileInfo.Sys().(*syscall.Stat_t).Uid; uid != credential.Uid {
+        t.Errorf("Work dir is owned by %d, expected %d", uid, credential.Uid)
+    }
+
+    // A root owned by someone else is refused
+    nobody, _ := user.Lookup("nobody")
+    nobodyUid, _ := strconv.Atoi(nobody.Uid)
+    os.Chown(config.WorkdirRoot, nobodyUid, -1)
+    otherRun := &ScriptRun{Script: &Script{Name: "a.sh"}, Id: "def"}
+    if err = otherRun.makeWorkdir(); err == nil {
+        t.Errorf("makeWorkdir under a root owned by uid %d succeeded", nobodyUid)
+    }
+}
+
+func TestCleanWorkdir(t *testing.T) {
+    tests := []struct {
+        name        string
+        keepWorkdir string
+        state       string
+        exitCode    int
+        expectKept  bool
+    }{
+        {"on_failure success", "on_failure", STATE_FINISHED, 0, false},
+        {"on_failure exit 1", "on_failure", STATE_FINISHED, 1, true},
+        {"on_failure lost", "on_failure", STATE_LOST, 0, true},
+        {"always success", "always", STATE_FINISHED, 0, true},
+        {"never exit 1", "never", STATE_FINISHED, 1, false},
+    }
+    for _, test := range tests {
+        workdir := filepath.Join(t.TempDir(), "abc")
+        os.Mkdir(workdir, 0700)
+        ioutil.WriteFile(filepath.Join(workdir, "scratch"), []byte("data"), 0600)
+        scriptRun := &ScriptRun{
+            Script:   &Script{Name: "a.sh", KeepWorkdir: test.keepWorkdir},
+            Id:       "abc",
+            ExitCode: test.exitCode,
+            Workdir:  workdir,
+        }
+        scriptRun.cleanWorkdir(test.state)
+        _, statErr := os.Stat(workdir)
+        if (statErr == nil) != test.expectKept {
+            t.Errorf("%s: kept is %t, expected %t", test.name, statErr == nil, test.expectKept)
+        } else if (scriptRun.Workdir != "") != test.expectKept {
+            t.Errorf("%s: Workdir is %q after cleaning", test.name, scriptRun.Workdir)
+        }
+        scriptRun.removeWorkdir()
+        if _, statErr = os.Stat(workdir); !os.IsNotExist(statErr) || scriptRun.Workdir != "" {
+            t.Errorf("%s: work dir left after removeWorkdir", test.name)
+        }
+    }
+}